@@ -0,0 +1,8 @@
+#!/bin/sh
+# CPROBE_TARGET is the mount point, CPROBE_LABEL_<name> are the target labels
+set -e
+
+used=$(df -P "$CPROBE_TARGET" | awk 'NR==2 {print $5}' | tr -d '%')
+
+echo "# TYPE disk_used_percent gauge"
+echo "disk_used_percent{path=\"$CPROBE_TARGET\"} $used"
@@ -3,6 +3,7 @@ package httpd
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
@@ -14,9 +15,13 @@ import (
 	"strings"
 	"time"
 
+	"github.com/VictoriaMetrics/metrics"
 	"github.com/cprobe/cprobe/flags"
 	"github.com/cprobe/cprobe/lib/flagutil"
 	"github.com/cprobe/cprobe/lib/fs"
+	"github.com/cprobe/cprobe/lib/promrelabel"
+	"github.com/cprobe/cprobe/lib/secret"
+	"github.com/cprobe/cprobe/plugins"
 	"github.com/cprobe/cprobe/probe"
 	"github.com/cprobe/cprobe/writer"
 	"gopkg.in/yaml.v2"
@@ -107,10 +112,19 @@ func Router() *HTTPRouter {
 			"flags":   "command-line flags",
 			"config":  "cprobe config contents",
 			"reload":  "reload configuration",
+			"probe":   "scrape a target on demand, e.g. probe?plugin=mysql&target=127.0.0.1:3306&module=rule_coll.toml",
+
+			"target-relabel-debug": "debug relabel_configs, add ?job=<job_name> to use the rules and the first target of the job",
+			"metric-relabel-debug": "debug metric_relabel_configs, add ?job=<job_name> to use the rules of the job",
+			"api/v1/jobs":          "jobs and their state, POST api/v1/jobs/pause, api/v1/jobs/resume or api/v1/jobs/trigger with ?job=<job_name> to control them",
+			"api/v1/plugins":       "plugins with their target format, metrics and the JSON Schema of rule files, api/v1/plugins/<name>/schema for editors",
 		}
 		if HTTPPProf {
 			endpoints["/debug/pprof"] = "pprof"
 		}
+		if writer.PullEnabled() {
+			endpoints["federate"] = "latest values of all the scraped series"
+		}
 
 		temp := struct {
 			Endpoints map[string]string
@@ -123,6 +137,42 @@ func Router() *HTTPRouter {
 		parse, _ := template.New("index").Parse(indexHtlm)
 		parse.Execute(c.Writer, temp)
 	})
+	r.GET("/metrics", func(c *gin.Context) {
+		metrics.WritePrometheus(c.Writer, true)
+	})
+	r.GET("/federate", func(c *gin.Context) {
+		writePullMetrics(c, "")
+	})
+	r.GET("/metrics/:plugin", func(c *gin.Context) {
+		writePullMetrics(c, c.Param("plugin"))
+	})
+	r.GET("/probe", probeTarget)
+	registerJobRoutes(r)
+	registerPluginRoutes(r)
+	r.Any("/target-relabel-debug", func(c *gin.Context) {
+		relabelDebug(c, true)
+	})
+	r.Any("/metric-relabel-debug", func(c *gin.Context) {
+		relabelDebug(c, false)
+	})
+	if writer.RelayEnabled() {
+		r.POST("/api/v1/write", func(c *gin.Context) {
+			if _, err := writer.RelayRemoteWrite(c.Request.Body); err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+			c.Status(http.StatusNoContent)
+		})
+		relayInflux := func(c *gin.Context) {
+			if _, err := writer.RelayInflux(c.Request.Body, c.GetHeader("Content-Encoding"), c.Query("precision")); err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+			c.Status(http.StatusNoContent)
+		}
+		r.POST("/write", relayInflux)
+		r.POST("/api/v2/write", relayInflux)
+	}
 	r.GET("/flags", func(c *gin.Context) {
 		flagutil.WriteFlags(c.Writer)
 	})
@@ -146,7 +196,7 @@ func Router() *HTTPRouter {
 						if data == nil {
 							data, _ = fs.ReadFileOrHTTP(ruleFilePath)
 						}
-						fmt.Fprintf(c.Writer, "%s\n", string(data))
+						fmt.Fprintf(c.Writer, "%s\n", string(redactRuleFile(name, data)))
 					}
 				}
 			}
@@ -180,6 +230,93 @@ func Router() *HTTPRouter {
 	return &HTTPRouter{engine: r}
 }
 
+// writePullMetrics 把 pull 模式下缓存的最新数据按照 Prometheus 或者 OpenMetrics 的格式输出
+func writePullMetrics(c *gin.Context, plugin string) {
+	if !writer.PullEnabled() {
+		c.String(http.StatusNotFound, "pull mode is disabled, see -pull.enable")
+		return
+	}
+
+	matches, err := writer.ParsePullMatches(c.QueryArray("match[]"))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	openMetrics := strings.Contains(c.GetHeader("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		c.Header("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+
+	if err := writer.WritePullMetrics(c.Writer, plugin, matches, openMetrics); err != nil {
+		logger.Errorf("cannot write pull metrics: %s", err)
+	}
+}
+
+// probeTarget 按需抓取一个 target，配合 Prometheus 的 __param_target relabel 使用，跟 blackbox_exporter 的 /probe 一样
+func probeTarget(c *gin.Context) {
+	timeout, err := probe.ProbeTimeout(c.GetHeader("X-Prometheus-Scrape-Timeout-Seconds"))
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+
+	tss, err := probe.Probe(ctx, flags.ConfigDirectory, c.Query("plugin"), c.Query("target"), c.Query("module"))
+	if err != nil {
+		if errors.Is(err, probe.ErrInvalidProbeParams) {
+			c.String(http.StatusBadRequest, err.Error())
+		} else {
+			c.String(http.StatusServiceUnavailable, err.Error())
+		}
+		return
+	}
+
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := writer.WriteTimeSeriesText(c.Writer, tss); err != nil {
+		logger.Errorf("cannot write probe result: %s", err)
+	}
+}
+
+// redactRuleFile 把 rule 文件里的密码之类的敏感信息替换掉，插件配置里 secret.Secret 类型的字段和常见的敏感字段都会被替换。
+// secret 字段从 Describe 的零值配置里找，不能调用 ParseConfig，否则一个 GET 请求就会执行 ${exec:...}、访问 vault
+func redactRuleFile(pluginName string, data []byte) []byte {
+	var keys []string
+	if desc, ok := plugins.Describe(pluginName); ok && desc.Config != nil {
+		keys = secret.TOMLKeys(desc.Config)
+	}
+	return secret.RedactTOML(data, keys...)
+}
+
+// relabelDebug 展示每一步 relabel 的输入和输出，job 参数不为空且没有提交表单的时候，使用这个 job 配置的 relabel 规则
+func relabelDebug(c *gin.Context, isTargetRelabel bool) {
+	jobName := c.Request.FormValue("job")
+	metric := c.Request.FormValue("metric")
+	relabelConfigs := c.Request.FormValue("relabel_configs")
+	format := c.Request.FormValue("format")
+
+	var err error
+	if jobName != "" && metric == "" && relabelConfigs == "" {
+		metric, relabelConfigs, err = probe.RelabelDebugDefaults(jobName, isTargetRelabel)
+	}
+
+	if format == "json" {
+		c.Header("Content-Type", "application/json")
+	} else {
+		c.Header("Content-Type", "text/html; charset=utf-8")
+	}
+
+	if isTargetRelabel {
+		promrelabel.WriteTargetRelabelDebug(c.Writer, jobName, metric, relabelConfigs, format, err)
+	} else {
+		promrelabel.WriteMetricRelabelDebug(c.Writer, jobName, metric, relabelConfigs, format, err)
+	}
+}
+
 // Init initializes http server and return close function
 func (r *HTTPRouter) Start() func() error {
 	server := &http.Server{
@@ -0,0 +1,51 @@
+package httpd
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/secret"
+	"github.com/cprobe/cprobe/plugins"
+	"github.com/cprobe/cprobe/types"
+)
+
+type redactTestConfig struct {
+	Global struct {
+		DbKey secret.Secret `toml:"db_key"`
+	} `toml:"global"`
+}
+
+type redactTestPlugin struct {
+	t *testing.T
+}
+
+func (p redactTestPlugin) ParseConfig(string, []byte) (any, error) {
+	p.t.Fatalf("ParseConfig must not be called, it resolves the secret references")
+	return nil, nil
+}
+
+func (p redactTestPlugin) Scrape(context.Context, string, any, *types.Samples) error {
+	return nil
+}
+
+func (p redactTestPlugin) Describe() plugins.Description {
+	return plugins.Description{Config: &redactTestConfig{}}
+}
+
+func TestRedactRuleFile(t *testing.T) {
+	plugins.RegisterPlugin("redact_test", redactTestPlugin{t: t})
+
+	data := `[global]
+db_key = "${exec:/bin/echo hello}"
+password = "plain"
+user = "root"
+`
+	out := string(redactRuleFile("redact_test", []byte(data)))
+	if strings.Contains(out, "exec") || strings.Contains(out, "plain") {
+		t.Fatalf("secrets are not redacted:\n%s", out)
+	}
+	if !strings.Contains(out, `user = "root"`) {
+		t.Fatalf("unexpected redaction:\n%s", out)
+	}
+}
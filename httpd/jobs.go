@@ -0,0 +1,43 @@
+package httpd
+
+import (
+	"net/http"
+
+	"github.com/cprobe/cprobe/lib/ginx"
+	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/probe"
+	"github.com/cprobe/cprobe/writer"
+	"github.com/gin-gonic/gin"
+)
+
+// job 控制接口，job 参数是 job_name，job_name 有重复的时候再用 plugin 和 file 参数区分
+func registerJobRoutes(r *gin.Engine) {
+	r.GET("/api/v1/jobs", func(c *gin.Context) {
+		c.JSON(http.StatusOK, probe.Jobs.List())
+	})
+
+	r.POST("/api/v1/jobs/pause", func(c *gin.Context) {
+		status, err := probe.Jobs.Pause(c.Query("plugin"), ginx.QueryStr(c, "job"), c.Query("file"))
+		ginx.Dangerous(err, http.StatusBadRequest)
+		logger.Infof("job(%s) of plugin(%s) is paused by %s", status.Job, status.Plugin, c.Request.RemoteAddr)
+		c.JSON(http.StatusOK, status)
+	})
+
+	r.POST("/api/v1/jobs/resume", func(c *gin.Context) {
+		status, err := probe.Jobs.Resume(c.Query("plugin"), ginx.QueryStr(c, "job"), c.Query("file"))
+		ginx.Dangerous(err, http.StatusBadRequest)
+		logger.Infof("job(%s) of plugin(%s) is resumed by %s", status.Job, status.Plugin, c.Request.RemoteAddr)
+		c.JSON(http.StatusOK, status)
+	})
+
+	// 立即抓取一次，target 不为空的时候只抓取这一个 target，返回抓取到的数据
+	r.POST("/api/v1/jobs/trigger", func(c *gin.Context) {
+		tss, err := probe.Jobs.Trigger(c.Request.Context(), c.Query("plugin"), ginx.QueryStr(c, "job"), c.Query("file"), c.Query("target"))
+		ginx.Dangerous(err, http.StatusBadRequest)
+
+		c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := writer.WriteTimeSeriesText(c.Writer, tss); err != nil {
+			logger.Errorf("cannot write triggered series: %s", err)
+		}
+	})
+}
@@ -0,0 +1,40 @@
+package httpd
+
+import (
+	"net/http"
+
+	"github.com/cprobe/cprobe/lib/ginx"
+	"github.com/cprobe/cprobe/plugins"
+	"github.com/gin-gonic/gin"
+)
+
+type pluginDescription struct {
+	plugins.Description
+	Schema *plugins.Schema `json:"schema,omitempty"`
+}
+
+// 插件的元信息和 rule 文件的 JSON Schema，schema 接口可以直接配置到编辑器里做补全
+func registerPluginRoutes(r *gin.Engine) {
+	r.GET("/api/v1/plugins", func(c *gin.Context) {
+		names := plugins.Names()
+		ret := make([]pluginDescription, 0, len(names))
+		for _, name := range names {
+			d, _ := plugins.Describe(name)
+			ret = append(ret, pluginDescription{Description: d, Schema: plugins.ConfigSchema(d)})
+		}
+		c.JSON(http.StatusOK, ret)
+	})
+
+	r.GET("/api/v1/plugins/:name/schema", func(c *gin.Context) {
+		d, ok := plugins.Describe(c.Param("name"))
+		if !ok {
+			ginx.Bomb(http.StatusNotFound, "unknown plugin %q", c.Param("name"))
+		}
+
+		schema := plugins.ConfigSchema(d)
+		if schema == nil {
+			ginx.Bomb(http.StatusNotFound, "plugin %q doesn't describe its config", d.Name)
+		}
+		c.JSON(http.StatusOK, schema)
+	})
+}
@@ -358,14 +358,19 @@ func MustCopyFile(srcPath, dstPath string) {
 // MustCreateFlockFile creates FlockFilename file in the directory dir
 // and returns the handler to the file.
 func MustCreateFlockFile(dir string) *os.File {
-	flockFilepath := filepath.Join(dir, FlockFilename)
-	f, err := createFlockFile(flockFilepath)
+	f, err := CreateFlockFile(dir)
 	if err != nil {
 		logger.Panicf("FATAL: cannot create lock file: %s; make sure a single process has exclusive access to %q", err, dir)
 	}
 	return f
 }
 
+// CreateFlockFile is like MustCreateFlockFile, but returns an error if the lock is held by another process.
+func CreateFlockFile(dir string) (*os.File, error) {
+	flockFilepath := filepath.Join(dir, FlockFilename)
+	return createFlockFile(flockFilepath)
+}
+
 // FlockFilename is the filename for the file created by MustCreateFlockFile().
 const FlockFilename = "flock.lock"
 
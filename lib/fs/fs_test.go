@@ -1,6 +1,8 @@
 package fs
 
 import (
+	"os"
+	"runtime"
 	"testing"
 )
 
@@ -37,3 +39,34 @@ func TestIsHTTPURLSuccess(t *testing.T) {
 	f("0/filepath", false)                   // something invalid
 	f("filepath.extension", false)           // something invalid
 }
+
+func TestCreateFlockFileNoLeak(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("counting the open files needs /proc")
+	}
+
+	dir := t.TempDir()
+	f, err := CreateFlockFile(dir)
+	if err != nil {
+		t.Fatalf("cannot create flock file: %s", err)
+	}
+	defer MustClose(f)
+
+	countFDs := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Fatalf("cannot read /proc/self/fd: %s", err)
+		}
+		return len(entries)
+	}
+
+	n := countFDs()
+	for i := 0; i < 100; i++ {
+		if _, err := CreateFlockFile(dir); err == nil {
+			t.Fatalf("expecting error for the locked file")
+		}
+	}
+	if leaked := countFDs() - n; leaked > 0 {
+		t.Fatalf("%d file descriptors are leaked", leaked)
+	}
+}
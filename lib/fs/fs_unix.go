@@ -38,6 +38,7 @@ func createFlockFile(flockFile string) (*os.File, error) {
 		return nil, fmt.Errorf("cannot create lock file %q: %w", flockFile, err)
 	}
 	if err := unix.Flock(int(flockF.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		_ = flockF.Close()
 		return nil, fmt.Errorf("cannot acquire lock on file %q: %w", flockFile, err)
 	}
 	return flockF, nil
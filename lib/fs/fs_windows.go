@@ -60,11 +60,13 @@ func createFlockFile(flockFile string) (*os.File, error) {
 	}
 	ol, err := newOverlapped()
 	if err != nil {
+		_ = windows.CloseHandle(handle)
 		return nil, fmt.Errorf("cannot create Overlapped handler: %w", err)
 	}
 	// https://docs.microsoft.com/en-us/windows/win32/api/fileapi/nf-fileapi-lockfileex
 	r1, _, err := procLock.Call(uintptr(handle), uintptr(lockfileExclusiveLock), uintptr(0), uintptr(1), uintptr(0), uintptr(unsafe.Pointer(ol)))
 	if r1 == 0 {
+		_ = windows.CloseHandle(handle)
 		return nil, err
 	}
 	return os.NewFile(uintptr(handle), flockFile), nil
@@ -12,6 +12,7 @@ import (
 
 	"github.com/cprobe/cprobe/lib/httpproxy"
 	"github.com/cprobe/cprobe/lib/netutil"
+	"github.com/cprobe/cprobe/lib/secret"
 )
 
 type RequestOptions struct {
@@ -19,14 +20,14 @@ type RequestOptions struct {
 	RequestTimeoutMillis int64 `toml:"request_timeout_millis"`
 	MaxIdleConnsPerHost  int   `toml:"max_idle_conns_per_host"`
 
-	BasicAuthUser   string   `toml:"basic_auth_user"`
-	BasicAuthPass   string   `toml:"basic_auth_pass"`
-	BearerToken     string   `toml:"bearer_token"`
-	BearerTokeFile  string   `toml:"bearer_token_file"`
-	Headers         []string `toml:"headers"`
-	ProxyURL        string   `toml:"proxy_url"`
-	FollowRedirects bool     `toml:"follow_redirects"`
-	Interface       string   `toml:"interface"`
+	BasicAuthUser   string        `toml:"basic_auth_user"`
+	BasicAuthPass   secret.Secret `toml:"basic_auth_pass"`
+	BearerToken     secret.Secret `toml:"bearer_token"`
+	BearerTokeFile  string        `toml:"bearer_token_file"`
+	Headers         []string      `toml:"headers"`
+	ProxyURL        string        `toml:"proxy_url"`
+	FollowRedirects bool          `toml:"follow_redirects"`
+	Interface       string        `toml:"interface"`
 }
 
 func (o *RequestOptions) NewClient(tlsConfig *tls.Config, disableKeepAlives bool) (*http.Client, error) {
@@ -99,7 +100,7 @@ func (o *RequestOptions) FillHeaders(req *http.Request, baseDirs ...string) erro
 	}
 
 	if o.BasicAuthUser != "" && o.BasicAuthPass != "" {
-		req.SetBasicAuth(o.BasicAuthUser, o.BasicAuthPass)
+		req.SetBasicAuth(o.BasicAuthUser, o.BasicAuthPass.Value())
 	}
 
 	if o.BearerToken == "" && o.BearerTokeFile != "" {
@@ -115,11 +116,11 @@ func (o *RequestOptions) FillHeaders(req *http.Request, baseDirs ...string) erro
 		if err != nil {
 			return fmt.Errorf("read bearer token file failed, path: %s", tokenFilePath)
 		}
-		o.BearerToken = strings.TrimSpace(string(bs))
+		o.BearerToken = secret.Secret(strings.TrimSpace(string(bs)))
 	}
 
 	if o.BearerToken != "" {
-		req.Header.Set("Authorization", "Bearer "+o.BearerToken)
+		req.Header.Set("Authorization", "Bearer "+o.BearerToken.Value())
 	}
 
 	return nil
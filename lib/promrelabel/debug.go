@@ -1,104 +1,118 @@
 package promrelabel
 
 import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+
 	"github.com/cprobe/cprobe/lib/promutils"
+	"gopkg.in/yaml.v2"
 )
 
-// // WriteMetricRelabelDebug writes /metric-relabel-debug page to w with the corresponding args.
-// func WriteMetricRelabelDebug(w io.Writer, targetID, metric, relabelConfigs, format string, err error) {
-// 	writeRelabelDebug(w, false, targetID, metric, relabelConfigs, format, err)
-// }
-
-// // WriteTargetRelabelDebug writes /target-relabel-debug page to w with the corresponding args.
-// func WriteTargetRelabelDebug(w io.Writer, targetID, metric, relabelConfigs, format string, err error) {
-// 	writeRelabelDebug(w, true, targetID, metric, relabelConfigs, format, err)
-// }
-
-// func writeRelabelDebug(w io.Writer, isTargetRelabel bool, targetID, metric, relabelConfigs, format string, err error) {
-// 	if metric == "" {
-// 		metric = "{}"
-// 	}
-// 	targetURL := ""
-// 	if err != nil {
-// 		WriteRelabelDebugSteps(w, targetURL, targetID, format, nil, metric, relabelConfigs, err)
-// 		return
-// 	}
-// 	labels, err := promutils.NewLabelsFromString(metric)
-// 	if err != nil {
-// 		err = fmt.Errorf("cannot parse metric: %w", err)
-// 		WriteRelabelDebugSteps(w, targetURL, targetID, format, nil, metric, relabelConfigs, err)
-// 		return
-// 	}
-// 	pcs, err := ParseRelabelConfigsData([]byte(relabelConfigs))
-// 	if err != nil {
-// 		err = fmt.Errorf("cannot parse relabel configs: %w", err)
-// 		WriteRelabelDebugSteps(w, targetURL, targetID, format, nil, metric, relabelConfigs, err)
-// 		return
-// 	}
-
-// 	dss, targetURL := newDebugRelabelSteps(pcs, labels, isTargetRelabel)
-// 	WriteRelabelDebugSteps(w, targetURL, targetID, format, dss, metric, relabelConfigs, nil)
-// }
+// WriteMetricRelabelDebug writes /metric-relabel-debug page to w with the corresponding args.
+func WriteMetricRelabelDebug(w io.Writer, jobName, metric, relabelConfigs, format string, err error) {
+	writeRelabelDebug(w, false, jobName, metric, relabelConfigs, format, err)
+}
+
+// WriteTargetRelabelDebug writes /target-relabel-debug page to w with the corresponding args.
+func WriteTargetRelabelDebug(w io.Writer, jobName, metric, relabelConfigs, format string, err error) {
+	writeRelabelDebug(w, true, jobName, metric, relabelConfigs, format, err)
+}
+
+func writeRelabelDebug(w io.Writer, isTargetRelabel bool, jobName, metric, relabelConfigs, format string, err error) {
+	if metric == "" {
+		metric = "{}"
+	}
+	if err != nil {
+		writeRelabelDebugSteps(w, isTargetRelabel, "", jobName, format, nil, metric, relabelConfigs, err)
+		return
+	}
+	labels, err := NewLabelsFromString(metric)
+	if err != nil {
+		err = fmt.Errorf("cannot parse metric: %w", err)
+		writeRelabelDebugSteps(w, isTargetRelabel, "", jobName, format, nil, metric, relabelConfigs, err)
+		return
+	}
+	pcs, err := ParseRelabelConfigsData([]byte(relabelConfigs))
+	if err != nil {
+		err = fmt.Errorf("cannot parse relabel configs: %w", err)
+		writeRelabelDebugSteps(w, isTargetRelabel, "", jobName, format, nil, metric, relabelConfigs, err)
+		return
+	}
+
+	dss, targetAddress := newDebugRelabelSteps(pcs, labels, isTargetRelabel)
+	writeRelabelDebugSteps(w, isTargetRelabel, targetAddress, jobName, format, dss, metric, relabelConfigs, nil)
+}
+
+// ParseRelabelConfigsData parses relabel configs in yaml from data.
+func ParseRelabelConfigsData(data []byte) (*ParsedConfigs, error) {
+	var rcs []RelabelConfig
+	if err := yaml.UnmarshalStrict(data, &rcs); err != nil {
+		return nil, err
+	}
+	return ParseRelabelConfigs(rcs)
+}
 
 func newDebugRelabelSteps(pcs *ParsedConfigs, labels *promutils.Labels, isTargetRelabel bool) ([]DebugStep, string) {
-	// The target relabeling below must be in sync with the code at scrapeWorkConfig.getScrapeWork if isTargetRelabel=true
-	// and with the code at scrapeWork.addRowToTimeseries when isTargetRelabeling=false
-	targetURL := ""
+	// The target relabeling below must be in sync with the code at JobGoroutine.parseTarget if isTargetRelabel=true
+	// and with the code at JobGoroutine.convertSamples when isTargetRelabeling=false
+	targetAddress := ""
 
 	// Prevent from modifying the original labels
 	labels = labels.Clone()
 
-	// Apply relabeling
-	labelsResult, dss := pcs.ApplyDebug(labels.GetLabels())
-	labels.Labels = labelsResult
-	outStr := LabelsToString(labels.GetLabels())
+	var dss []DebugStep
 
 	if isTargetRelabel {
-		// Add missing instance label
+		// cprobe adds the missing instance label before relabeling, so relabel_configs may overwrite it
 		if labels.Get("instance") == "" {
 			address := labels.Get("__address__")
 			if address != "" {
-				inStr := outStr
+				inStr := LabelsToString(labels.GetLabels())
 				labels.Add("instance", address)
-				outStr = LabelsToString(labels.GetLabels())
 				dss = append(dss, DebugStep{
 					Rule: "add missing instance label from __address__ label",
 					In:   inStr,
-					Out:  outStr,
+					Out:  LabelsToString(labels.GetLabels()),
 				})
 			}
 		}
+	}
 
-		// Generate targetURL
-		targetURL, _ = GetScrapeURL(labels, nil)
+	// Apply relabeling
+	labelsResult, relabelSteps := pcs.ApplyDebug(labels.GetLabels())
+	labels.Labels = labelsResult
+	dss = append(dss, relabelSteps...)
+	outStr := LabelsToString(labels.GetLabels())
 
-		// Remove labels with __ prefix
-		inStr := outStr
-		labels.RemoveLabelsWithDoubleUnderscorePrefix()
-		outStr = LabelsToString(labels.GetLabels())
-		if inStr != outStr {
-			dss = append(dss, DebugStep{
-				Rule: "remove labels with __ prefix",
-				In:   inStr,
-				Out:  outStr,
-			})
-		}
-	} else {
-		// Remove labels with __ prefix except of __name__
-		inStr := outStr
-		labels.Labels = FinalizeLabels(labels.Labels[:0], labels.Labels)
-		outStr = LabelsToString(labels.GetLabels())
-		if inStr != outStr {
+	// Remove labels with __meta_ prefix
+	inStr := outStr
+	labels.RemoveMetaLabels()
+	outStr = LabelsToString(labels.GetLabels())
+	if inStr != outStr {
+		dss = append(dss, DebugStep{
+			Rule: "remove labels with __meta_ prefix",
+			In:   inStr,
+			Out:  outStr,
+		})
+	}
+
+	if isTargetRelabel && labels.Len() > 0 {
+		targetAddress = labels.Get("__address__")
+		if targetAddress == "" {
 			dss = append(dss, DebugStep{
-				Rule: "remove labels with __ prefix except of __name__",
-				In:   inStr,
-				Out:  outStr,
+				Rule: "drop the target without __address__ label",
+				In:   outStr,
+				Out:  "{}",
 			})
 		}
 	}
 
 	// There is no need in labels' sorting, since LabelsToString() automatically sorts labels.
-	return dss, targetURL
+	return dss, targetAddress
 }
 
 func getChangedLabelNames(in, out *promutils.Labels) map[string]struct{} {
@@ -119,3 +133,226 @@ func getChangedLabelNames(in, out *promutils.Labels) map[string]struct{} {
 	}
 	return changed
 }
+
+// NewLabelsFromString creates labels from s, which can have the form `metric{labels}`.
+//
+// This function must be used only in non performance-critical code, since it allocates too much
+func NewLabelsFromString(metricWithLabels string) (*promutils.Labels, error) {
+	s := strings.TrimSpace(metricWithLabels)
+
+	var x promutils.Labels
+
+	n := strings.IndexByte(s, '{')
+	if n < 0 {
+		n = len(s)
+	}
+	if name := strings.TrimSpace(s[:n]); name != "" {
+		x.Add("__name__", name)
+	}
+	s = s[n:]
+	if s == "" {
+		return &x, nil
+	}
+
+	if !strings.HasSuffix(s, "}") {
+		return nil, fmt.Errorf("missing `}` at the end of %q", metricWithLabels)
+	}
+	s = strings.TrimSpace(s[1 : len(s)-1])
+
+	for len(s) > 0 {
+		n := strings.IndexByte(s, '=')
+		if n <= 0 {
+			return nil, fmt.Errorf("missing label name in %q", metricWithLabels)
+		}
+		name := strings.TrimSpace(s[:n])
+		s = strings.TrimSpace(s[n+1:])
+
+		value, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse value of label %q in %q: %w", name, metricWithLabels, err)
+		}
+		s = strings.TrimSpace(s[len(value):])
+		value, _ = strconv.Unquote(value)
+		x.Add(name, value)
+
+		if s == "" {
+			break
+		}
+		if s[0] != ',' {
+			return nil, fmt.Errorf("missing `,` after label %q in %q", name, metricWithLabels)
+		}
+		s = strings.TrimSpace(s[1:])
+	}
+
+	return &x, nil
+}
+
+type debugLabelView struct {
+	Name    string
+	Value   string
+	Changed bool
+}
+
+type debugStepView struct {
+	Index int
+	Rule  string
+	In    []debugLabelView
+	Out   []debugLabelView
+}
+
+func newDebugLabelViews(s string, changed map[string]struct{}) []debugLabelView {
+	labels, err := NewLabelsFromString(s)
+	if err != nil {
+		return []debugLabelView{{Name: s}}
+	}
+	labels.Sort()
+	views := make([]debugLabelView, 0, labels.Len())
+	for _, label := range labels.GetLabels() {
+		_, ok := changed[label.Name]
+		views = append(views, debugLabelView{Name: label.Name, Value: strconv.Quote(label.Value), Changed: ok})
+	}
+	return views
+}
+
+func writeRelabelDebugSteps(w io.Writer, isTargetRelabel bool, targetAddress, jobName, format string, dss []DebugStep, metric, relabelConfigs string, err error) {
+	if format == "json" {
+		writeRelabelDebugStepsJSON(w, dss, err)
+		return
+	}
+
+	data := struct {
+		IsTargetRelabel bool
+		TargetAddress   string
+		JobName         string
+		Metric          string
+		RelabelConfigs  string
+		Error           error
+		Original        string
+		Resulting       string
+		Steps           []debugStepView
+	}{
+		IsTargetRelabel: isTargetRelabel,
+		TargetAddress:   targetAddress,
+		JobName:         jobName,
+		Metric:          metric,
+		RelabelConfigs:  relabelConfigs,
+		Error:           err,
+	}
+
+	if len(dss) > 0 {
+		data.Original = dss[0].In
+		data.Resulting = dss[len(dss)-1].Out
+	}
+	for i, ds := range dss {
+		changed := make(map[string]struct{})
+		inLabels, inErr := NewLabelsFromString(ds.In)
+		outLabels, outErr := NewLabelsFromString(ds.Out)
+		if inErr == nil && outErr == nil {
+			changed = getChangedLabelNames(inLabels, outLabels)
+		}
+		data.Steps = append(data.Steps, debugStepView{
+			Index: i,
+			Rule:  ds.Rule,
+			In:    newDebugLabelViews(ds.In, changed),
+			Out:   newDebugLabelViews(ds.Out, changed),
+		})
+	}
+
+	if err := relabelDebugTemplate.Execute(w, data); err != nil {
+		fmt.Fprintf(w, "cannot render relabel debug page: %s", err)
+	}
+}
+
+func writeRelabelDebugStepsJSON(w io.Writer, dss []DebugStep, err error) {
+	type step struct {
+		Rule      string `json:"rule"`
+		InLabels  string `json:"inLabels"`
+		OutLabels string `json:"outLabels"`
+	}
+
+	resp := struct {
+		Status          string `json:"status"`
+		Error           string `json:"error,omitempty"`
+		OriginalLabels  string `json:"originalLabels,omitempty"`
+		ResultingLabels string `json:"resultingLabels,omitempty"`
+		Steps           []step `json:"steps"`
+	}{
+		Status: "success",
+		Steps:  []step{},
+	}
+
+	if err != nil {
+		resp.Status = "error"
+		resp.Error = fmt.Sprintf("Error: %s", err)
+	} else if len(dss) > 0 {
+		resp.OriginalLabels = dss[0].In
+		resp.ResultingLabels = dss[len(dss)-1].Out
+		for _, ds := range dss {
+			resp.Steps = append(resp.Steps, step{Rule: ds.Rule, InLabels: ds.In, OutLabels: ds.Out})
+		}
+	}
+
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+var relabelDebugTemplate = template.Must(template.New("relabel-debug").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{ if .IsTargetRelabel }}Target{{ else }}Metric{{ end }} relabel debug</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+textarea { width: 100%; font-family: monospace; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border: 1px solid #ccc; padding: 4px; vertical-align: top; text-align: left; }
+pre { margin: 0; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h2>{{ if .IsTargetRelabel }}Target{{ else }}Metric{{ end }} relabel debug</h2>
+<a href="https://docs.victoriametrics.com/relabeling.html" target="_blank">Relabeling docs</a>
+{{ if .IsTargetRelabel }}
+<a href="metric-relabel-debug{{ if .JobName }}?job={{ .JobName }}{{ end }}">Metric relabel debug</a>
+{{ else }}
+<a href="target-relabel-debug{{ if .JobName }}?job={{ .JobName }}{{ end }}">Target relabel debug</a>
+{{ end }}
+{{ if .Error }}<p class="error">{{ .Error }}</p>{{ end }}
+<form method="POST">
+<div>
+{{ if .IsTargetRelabel }}relabel_configs{{ else }}metric_relabel_configs{{ end }}:<br/>
+<textarea name="relabel_configs" style="height: 15em">{{ .RelabelConfigs }}</textarea>
+</div>
+<div>
+Labels:<br/>
+<textarea name="metric" style="height: 5em">{{ .Metric }}</textarea>
+</div>
+{{ if .JobName }}<input type="hidden" name="job" value="{{ .JobName }}" />{{ end }}
+<input type="submit" value="Submit" />
+{{ if .JobName }}<button type="button" onclick="location.href='?job={{ .JobName }}'">Reset</button>{{ end }}
+</form>
+{{ if .Steps }}
+<p><b>Original labels:</b> <samp>{{ .Original }}</samp></p>
+{{ end }}
+<table>
+<thead>
+<tr><th style="width: 5%">Step</th><th style="width: 25%">Relabeling Rule</th><th style="width: 35%">Input Labels</th><th style="width: 35%">Output labels</th></tr>
+</thead>
+<tbody>
+{{ range .Steps }}
+<tr>
+<td>{{ .Index }}</td>
+<td><b><pre>{{ .Rule }}</pre></b></td>
+<td title="deleted and updated labels highlighted in red">{{ range .In }}{{ if .Changed }}<span style="font-weight:bold;color:red">{{ .Name }}={{ .Value }}</span>{{ else }}{{ .Name }}={{ .Value }}{{ end }}<br/>{{ end }}</td>
+<td title="added and updated labels highlighted in blue">{{ range .Out }}{{ if .Changed }}<span style="font-weight:bold;color:blue">{{ .Name }}={{ .Value }}</span>{{ else }}{{ .Name }}={{ .Value }}{{ end }}<br/>{{ end }}</td>
+</tr>
+{{ end }}
+</tbody>
+</table>
+{{ if .Steps }}
+<p><b>Resulting labels:</b> <samp>{{ .Resulting }}</samp></p>
+{{ if .TargetAddress }}<p><b>Target address:</b> <samp>{{ .TargetAddress }}</samp></p>{{ end }}
+{{ end }}
+</body>
+</html>
+`))
@@ -0,0 +1,64 @@
+package promrelabel
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNewLabelsFromString(t *testing.T) {
+	f := func(s, resultExpected string) {
+		t.Helper()
+		labels, err := NewLabelsFromString(s)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		result := LabelsToString(labels.GetLabels())
+		if result != resultExpected {
+			t.Fatalf("unexpected result; got %s; want %s", result, resultExpected)
+		}
+	}
+	f("{}", "{}")
+	f("up", "up")
+	f(`up{instance="a:1", job="x\"y"}`, `up{instance="a:1",job="x\"y"}`)
+	f(`{__address__="a,b", __meta_foo="="}`, `{__address__="a,b",__meta_foo="="}`)
+
+	for _, s := range []string{`up{`, `{a}`, `{a="b" c="d"}`, `{a=b}`} {
+		if _, err := NewLabelsFromString(s); err == nil {
+			t.Fatalf("expecting error for %q", s)
+		}
+	}
+}
+
+func TestWriteTargetRelabelDebug(t *testing.T) {
+	relabelConfigs := `
+- source_labels: [__meta_consul_service]
+  target_label: service
+`
+	var bb bytes.Buffer
+	WriteTargetRelabelDebug(&bb, "", `{__address__="a:1",__meta_consul_service="db"}`, relabelConfigs, "json", nil)
+
+	result := bb.String()
+	for _, s := range []string{
+		`"status":"success"`,
+		`"originalLabels":"{__address__=\"a:1\",__meta_consul_service=\"db\"}"`,
+		`"resultingLabels":"{__address__=\"a:1\",instance=\"a:1\",service=\"db\"}"`,
+		`"rule":"remove labels with __meta_ prefix"`,
+	} {
+		if !strings.Contains(result, s) {
+			t.Fatalf("missing %s in %s", s, result)
+		}
+	}
+
+	bb.Reset()
+	WriteTargetRelabelDebug(&bb, "consul", `{__address__="a:1",__meta_consul_service="db"}`, relabelConfigs, "", nil)
+	if !strings.Contains(bb.String(), `<span style="font-weight:bold;color:blue">service=&#34;db&#34;</span>`) {
+		t.Fatalf("missing highlighted label in %s", bb.String())
+	}
+
+	bb.Reset()
+	WriteMetricRelabelDebug(&bb, "", "up", "- action: foo", "json", nil)
+	if !strings.Contains(bb.String(), `"status":"error"`) {
+		t.Fatalf("expecting error for invalid relabel configs, got %s", bb.String())
+	}
+}
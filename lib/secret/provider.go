@@ -0,0 +1,293 @@
+package secret
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/cmdx"
+)
+
+var (
+	cacheTTL     = flag.Duration("secret.cacheTTL", 5*time.Minute, "How long the resolved secret references such as ${file:/run/secrets/mysql} are cached, 0 disables the cache")
+	execTimeout  = flag.Duration("secret.execTimeout", 10*time.Second, "Timeout of the commands of ${exec:cmd} secret references")
+	vaultAddr    = flag.String("secret.vault.addr", "", "Address of the vault server for ${vault:path#key} secret references, e.g. http://127.0.0.1:8200")
+	vaultToken   = flag.String("secret.vault.token", "", "Token sent to the vault server in X-Vault-Token header")
+	vaultTimeout = flag.Duration("secret.vault.timeout", 5*time.Second, "Timeout of the requests to the vault server")
+	// target 标签来自 http_sd 或者 CMDB，不能让它们执行命令或者读本地文件
+	targetProviders = flag.String("secret.targetProviders", "vault", "Comma separated providers allowed in the secret references of target labels such as __cprobe_password_ref, "+
+		"file and exec are never allowed since the labels may come from service discovery")
+)
+
+// untrustedProviders are never allowed in the secret references of target labels
+var untrustedProviders = map[string]struct{}{
+	"file": {},
+	"exec": {},
+}
+
+// Provider resolves the reference of ${<name>:<ref>} to the secret.
+type Provider func(ref string) (string, error)
+
+var (
+	providersLock sync.RWMutex
+	providers     = map[string]Provider{
+		"file":  resolveFile,
+		"exec":  resolveExec,
+		"vault": resolveVault,
+	}
+)
+
+// RegisterProvider registers p for the secret references ${name:ref}, the builtin providers are file, exec and vault.
+func RegisterProvider(name string, p Provider) {
+	providersLock.Lock()
+	providers[name] = p
+	providersLock.Unlock()
+}
+
+func getProvider(name string) (Provider, bool) {
+	providersLock.RLock()
+	p, ok := providers[name]
+	providersLock.RUnlock()
+	return p, ok
+}
+
+type cacheEntry struct {
+	value    string
+	deadline time.Time
+}
+
+var (
+	cacheLock sync.Mutex
+	cache     = make(map[string]cacheEntry)
+)
+
+var refRe = regexp.MustCompile(`\$\{(\w+):([^}]*)\}`)
+
+// Resolve replaces the secret references in s, e.g. ${file:/run/secrets/mysql}, with the secrets.
+// References with unknown provider names are kept as is, so a password may contain `${`.
+// The secrets are cached for -secret.cacheTTL, failures aren't cached.
+// Secret.UnmarshalText calls it, so the plugin configs must only be parsed on the scrape path,
+// never for serving http requests, e.g. ${exec:...} runs a command.
+func Resolve(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	var firstErr error
+	ret := refRe.ReplaceAllStringFunc(s, func(m string) string {
+		sub := refRe.FindStringSubmatch(m)
+		p, ok := getProvider(sub[1])
+		if !ok {
+			return m
+		}
+
+		v, err := resolveCached(m, sub[2], p)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("cannot resolve secret reference %s: %w", m, err)
+		}
+		return v
+	})
+
+	if firstErr != nil {
+		return "", firstErr
+	}
+	return ret, nil
+}
+
+// ResolveTargetValue is Resolve for the values from target labels, which are controlled by service discovery.
+// Only the providers in -secret.targetProviders are allowed, the references of the other known providers are rejected.
+// The result must be used as is, never resolved again, a secret from vault may contain ${exec:...} as well.
+func ResolveTargetValue(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	for _, sub := range refRe.FindAllStringSubmatch(s, -1) {
+		if _, ok := getProvider(sub[1]); !ok {
+			continue
+		}
+		if !isTargetProvider(sub[1]) {
+			return "", fmt.Errorf("secret provider %q isn't allowed in target labels, see -secret.targetProviders", sub[1])
+		}
+	}
+
+	return Resolve(s)
+}
+
+func isTargetProvider(name string) bool {
+	if _, ok := untrustedProviders[name]; ok {
+		return false
+	}
+	for _, p := range strings.Split(*targetProviders, ",") {
+		if strings.TrimSpace(p) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func resolveCached(key, ref string, p Provider) (string, error) {
+	ttl := *cacheTTL
+	now := time.Now()
+
+	if ttl > 0 {
+		cacheLock.Lock()
+		e, ok := cache[key]
+		cacheLock.Unlock()
+		if ok && now.Before(e.deadline) {
+			return e.value, nil
+		}
+	}
+
+	v, err := p(ref)
+	if err != nil {
+		return "", err
+	}
+
+	if ttl > 0 {
+		cacheLock.Lock()
+		cache[key] = cacheEntry{value: v, deadline: now.Add(ttl)}
+		cacheLock.Unlock()
+	}
+
+	return v, nil
+}
+
+// HasReferences reports whether data contains secret references of the known providers.
+func HasReferences(data []byte) bool {
+	if !bytes.Contains(data, []byte("${")) {
+		return false
+	}
+	for _, sub := range refRe.FindAllSubmatch(data, -1) {
+		if _, ok := getProvider(string(sub[1])); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CacheTTL returns -secret.cacheTTL, configs holding resolved secrets shouldn't be reused for longer.
+func CacheTTL() time.Duration {
+	return *cacheTTL
+}
+
+// ResetCache drops the cached secrets, so the next Resolve reads them again.
+func ResetCache() {
+	cacheLock.Lock()
+	cache = make(map[string]cacheEntry)
+	cacheLock.Unlock()
+}
+
+// resolveFile reads the secret from a file, e.g. docker or kubernetes secrets, the trailing newline is trimmed.
+func resolveFile(ref string) (string, error) {
+	bs, err := os.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(bs), "\r\n"), nil
+}
+
+// resolveExec runs the command without shell and uses the trimmed stdout as the secret.
+func resolveExec(ref string) (string, error) {
+	args := strings.Fields(ref)
+	if len(args) == 0 {
+		return "", fmt.Errorf("empty command")
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err, timeout := cmdx.RunTimeout(cmd, *execTimeout)
+	if timeout {
+		return "", fmt.Errorf("command timed out after %s", *execTimeout)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s, stderr: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+var (
+	vaultClientOnce sync.Once
+	vaultClient     *http.Client
+)
+
+// resolveVault reads key of a vault kv secret, ref is <path>#<key>, e.g. secret/data/mysql#password.
+// Both kv v1 and v2 responses are supported.
+func resolveVault(ref string) (string, error) {
+	if *vaultAddr == "" {
+		return "", fmt.Errorf("-secret.vault.addr is not set")
+	}
+
+	path, key, ok := strings.Cut(ref, "#")
+	if !ok || path == "" || key == "" {
+		return "", fmt.Errorf("the vault reference must be <path>#<key>")
+	}
+
+	vaultClientOnce.Do(func() {
+		vaultClient = &http.Client{Timeout: *vaultTimeout}
+	})
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(*vaultAddr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	if *vaultToken != "" {
+		req.Header.Set("X-Vault-Token", *vaultToken)
+	}
+
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	bs, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("cannot read vault response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected vault response status code: %d, body: %s", resp.StatusCode, bs)
+	}
+
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err = json.Unmarshal(bs, &body); err != nil {
+		return "", fmt.Errorf("cannot parse vault response: %w", err)
+	}
+
+	data := body.Data
+	// kv v2 的数据多包了一层 data
+	if raw, ok := data["data"]; ok && len(data["metadata"]) > 0 {
+		var inner map[string]json.RawMessage
+		if err = json.Unmarshal(raw, &inner); err == nil {
+			data = inner
+		}
+	}
+
+	raw, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("cannot find key %q in vault secret %q", key, path)
+	}
+
+	var v string
+	if err = json.Unmarshal(raw, &v); err != nil {
+		return "", fmt.Errorf("value of key %q in vault secret %q is not a string", key, path)
+	}
+
+	return v, nil
+}
@@ -0,0 +1,153 @@
+package secret
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+func TestResolveFile(t *testing.T) {
+	ResetCache()
+
+	path := filepath.Join(t.TempDir(), "mysql")
+	if err := os.WriteFile(path, []byte("123456\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	type config struct {
+		User     string `toml:"user" yaml:"user"`
+		Password Secret `toml:"password" yaml:"password"`
+	}
+
+	var tc config
+	if _, err := toml.Decode(`user = "root"
+password = "${file:`+path+`}"`, &tc); err != nil {
+		t.Fatalf("cannot decode toml: %s", err)
+	}
+	if tc.Password.Value() != "123456" {
+		t.Fatalf("unexpected password from toml: %q", tc.Password.Value())
+	}
+
+	var yc config
+	if err := yaml.Unmarshal([]byte("user: root\npassword: x${file:"+path+"}y\n"), &yc); err != nil {
+		t.Fatalf("cannot decode yaml: %s", err)
+	}
+	if yc.Password.Value() != "x123456y" {
+		t.Fatalf("unexpected password from yaml: %q", yc.Password.Value())
+	}
+
+	var bad config
+	if _, err := toml.Decode(`password = "${file:/non-existing/cprobe}"`, &bad); err == nil {
+		t.Fatalf("expecting error for missing file")
+	}
+}
+
+func TestResolveUnknownProvider(t *testing.T) {
+	for _, s := range []string{"", "plain", "a${b", "${unknown:x}", "${nocolon}"} {
+		v, err := Resolve(s)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", s, err)
+		}
+		if v != s {
+			t.Fatalf("unexpected value for %q: %q", s, v)
+		}
+	}
+}
+
+func TestHasReferences(t *testing.T) {
+	f := func(s string, expected bool) {
+		t.Helper()
+		if got := HasReferences([]byte(s)); got != expected {
+			t.Fatalf("unexpected result for %q: got %v, want %v", s, got, expected)
+		}
+	}
+
+	f(``, false)
+	f(`password = "plain"`, false)
+	f(`password = "${unknown:x}"`, false)
+	f(`password = "a${b"`, false)
+	f(`password = "${file:/run/secrets/mysql}"`, true)
+	f("user = \"${unknown:x}\"\npassword = \"${vault:secret/mysql#password}\"", true)
+}
+
+func TestResolveExec(t *testing.T) {
+	ResetCache()
+
+	v, err := Resolve("${exec:echo  hello}")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if v != "hello" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+
+	if _, err = Resolve("${exec:/non-existing/cprobe}"); err == nil {
+		t.Fatalf("expecting error for missing command")
+	}
+}
+
+func TestResolveVault(t *testing.T) {
+	ResetCache()
+
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("X-Vault-Token") != "root-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/mysql":
+			w.Write([]byte(`{"data":{"data":{"password":"kv2"},"metadata":{"version":1}}}`))
+		case "/v1/kv/redis":
+			w.Write([]byte(`{"data":{"password":"kv1"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	oldAddr, oldToken := *vaultAddr, *vaultToken
+	*vaultAddr, *vaultToken = srv.URL, "root-token"
+	defer func() { *vaultAddr, *vaultToken = oldAddr, oldToken }()
+
+	f := func(s, expected string) {
+		t.Helper()
+		v, err := Resolve(s)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", s, err)
+		}
+		if v != expected {
+			t.Fatalf("unexpected value for %q: got %q, want %q", s, v, expected)
+		}
+	}
+
+	f("${vault:secret/data/mysql#password}", "kv2")
+	f("${vault:kv/redis#password}", "kv1")
+
+	// cached
+	f("${vault:secret/data/mysql#password}", "kv2")
+	if n := requests.Load(); n != 2 {
+		t.Fatalf("unexpected number of vault requests: %d", n)
+	}
+
+	for _, s := range []string{"${vault:kv/redis#user}", "${vault:kv/missing#password}", "${vault:kv/redis}"} {
+		if _, err := Resolve(s); err == nil {
+			t.Fatalf("expecting error for %q", s)
+		}
+	}
+
+	// failures aren't cached
+	*vaultToken = "bad"
+	_, err := Resolve("${vault:kv/other#password}")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("expecting 403 error, got %v", err)
+	}
+}
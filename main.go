@@ -33,6 +33,7 @@ var (
 	update     = flag.Bool("update", false, "Update binary")
 	updateFile = flag.String("update.file", "", "new version tar.gz file or url")
 	nohttp     = flag.Bool("no-httpd", false, "Disable http server")
+	checkCfg   = flag.Bool("check-config", false, "Check the config files under -conf.d, including the unknown keys in rule files, and exit")
 )
 
 func main() {
@@ -59,6 +60,10 @@ func main() {
 	logger.Init()
 	runner.PrintRuntime()
 
+	if *checkCfg {
+		os.Exit(checkConfig())
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	if err := writer.Init(flags.ConfigDirectory); err != nil {
@@ -103,6 +108,26 @@ EXIT:
 	cancel()
 }
 
+func checkConfig() int {
+	problems, err := probe.CheckConfig(flags.ConfigDirectory)
+	if err != nil {
+		fmt.Println("error:", err)
+		return 1
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+
+	if len(problems) > 0 {
+		fmt.Printf("%d problems found in %s\n", len(problems), flags.ConfigDirectory)
+		return 1
+	}
+
+	fmt.Println("config is ok")
+	return 0
+}
+
 func usage() {
 	const s = `
 cprobe is a frankenstein made up of vmagent and exporters.
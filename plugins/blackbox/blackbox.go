@@ -21,6 +21,18 @@ func init() {
 	plugins.RegisterPlugin(types.PluginBlackbox, &Blackbox{})
 }
 
+// Describe implements plugins.Describer
+func (p *Blackbox) Describe() plugins.Description {
+	return plugins.Description{
+		Name:         types.PluginBlackbox,
+		Description:  "Probe endpoints over http, tcp, icmp, dns and grpc, like blackbox_exporter",
+		TargetFormat: "depends on the prober: url for http, ip:port for tcp and grpc, host for icmp and dns",
+		ConfigFormat: plugins.ConfigFormatYAML,
+		Config:       &prober.Module{},
+		Metrics:      []string{"probe_success", "probe_dns_lookup_time_seconds"},
+	}
+}
+
 func (p *Blackbox) ParseConfig(baseDir string, bs []byte) (any, error) {
 	var moduleConfig prober.Module
 	err := yaml.Unmarshal(bs, &moduleConfig)
@@ -31,6 +43,12 @@ func (p *Blackbox) ParseConfig(baseDir string, bs []byte) (any, error) {
 	return &moduleConfig, nil
 }
 
+// CloneConfig implements plugins.ConfigCloner, Scrape only modifies the top level fields of the module
+func (p *Blackbox) CloneConfig(c any) any {
+	module := *c.(*prober.Module)
+	return &module
+}
+
 func (p *Blackbox) Scrape(ctx context.Context, address string, c any, ss *types.Samples) error {
 	err := p.scrape(ctx, address, c, ss)
 	// 冗余一份 probe_success 的指标，方便仪表盘展示，避免用户再去修改仪表盘了
@@ -45,6 +45,17 @@ func init() {
 	plugins.RegisterPlugin(types.PluginConsul, &Consul{})
 }
 
+// Describe implements plugins.Describer
+func (*Consul) Describe() plugins.Description {
+	return plugins.Description{
+		Name:         types.PluginConsul,
+		Description:  "Consul cluster, service and health check metrics, like consul_exporter",
+		TargetFormat: "ip:port, e.g. 127.0.0.1:8500",
+		Config:       &Config{},
+		Metrics:      []string{"consul_up"},
+	}
+}
+
 func (*Consul) ParseConfig(baseDir string, bs []byte) (any, error) {
 	var c Config
 	err := toml.Unmarshal(bs, &c)
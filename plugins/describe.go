@@ -0,0 +1,66 @@
+package plugins
+
+import (
+	"sort"
+)
+
+const (
+	ConfigFormatTOML = "toml"
+	ConfigFormatYAML = "yaml"
+)
+
+// Description is the capability metadata of a plugin, see Describer
+type Description struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// TargetFormat is the format of __address__, e.g. ip:port/service for oracledb
+	TargetFormat string `json:"target_format"`
+	// ConfigFormat is the format of the rule files, toml or yaml, defaults to toml
+	ConfigFormat string `json:"config_format"`
+	// Config is a pointer to the zero value of the rule config struct, the JSON Schema is generated from it
+	Config any `json:"-"`
+	// Metrics are the main metric names emitted by the plugin, not necessarily complete
+	Metrics []string `json:"metrics,omitempty"`
+	// TargetParams are the options which can be overridden per target by __param_<key>
+	// in addition to DefaultTargetParams, see CheckTargetParams
+	TargetParams []string `json:"target_params,omitempty"`
+}
+
+// Describer is optionally implemented by plugins, the description is served at /api/v1/plugins
+// and used by -check-config to find the unknown keys in rule files
+type Describer interface {
+	Describe() Description
+}
+
+// Names returns the names of all the registered plugins, sorted
+func Names() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Describe returns the description of the plugin, ok is false if the plugin isn't registered.
+// The plugins which don't implement Describer get a description with the name only.
+func Describe(pluginName string) (Description, bool) {
+	p, ok := GetPlugin(pluginName)
+	if !ok {
+		return Description{}, false
+	}
+
+	var d Description
+	if describer, ok := p.(Describer); ok {
+		d = describer.Describe()
+	}
+
+	d.Name = pluginName
+	if d.ConfigFormat == "" {
+		d.ConfigFormat = ConfigFormatTOML
+	}
+	return d, true
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/secret"
 	"github.com/cprobe/cprobe/plugins"
 	"github.com/cprobe/cprobe/types"
 	"github.com/pkg/errors"
@@ -18,7 +19,7 @@ type Config struct {
 	MaxOpenConns            int           `toml:"max_open_conns"`
 	ConnMaxLifetime         time.Duration `toml:"conn_max_lifetime"`
 	DbUser                  string        `toml:"db_user"`
-	DbPwd                   string        `toml:"db_pwd"`
+	DbPwd                   secret.Secret `toml:"db_pwd"`
 	BigKeyDataCacheTime     time.Duration `toml:"big_key_data_cache_time"`
 	AlarmKeyCacheTime       time.Duration `toml:"alarm_key_cache_time"`
 	RegisterHostMetrics     bool          `toml:"register_host_metrics"`
@@ -37,6 +38,17 @@ func init() {
 	plugins.RegisterPlugin(types.PluginDm, &Dm{})
 }
 
+// Describe implements plugins.Describer
+func (d *Dm) Describe() plugins.Description {
+	return plugins.Description{
+		Name:         types.PluginDm,
+		Description:  "DM8 (Dameng) database metrics from custom SQL",
+		TargetFormat: "ip:port with optional dsn params, e.g. 127.0.0.1:5236?autoCommit=true",
+		Config:       &Config{},
+		TargetParams: []string{"db_user", "db_pwd"},
+	}
+}
+
 func (d *Dm) ParseConfig(baseDir string, bs []byte) (any, error) {
 	var c Config
 	err := toml.Unmarshal(bs, &c)
@@ -53,7 +65,7 @@ func (d *Dm) ParseConfig(baseDir string, bs []byte) (any, error) {
 func (d *Dm) Scrape(ctx context.Context, target string, cfg any, ss *types.Samples) error {
 	config := cfg.(*Config)
 	// DSN (Data Source Name) format: user/password@host:port/service_name
-	dsn := buildDSN(config.DbUser, config.DbPwd, target)
+	dsn := buildDSN(config.DbUser, config.DbPwd.Value(), target)
 	hn, err := os.Hostname()
 	if err != nil {
 		logger.Errorf("Failed to get Hostname: %s", err)
@@ -1,12 +1,16 @@
 package collector
 
-import "time"
+import (
+	"time"
+
+	"github.com/cprobe/cprobe/lib/secret"
+)
 
 type Config struct {
 	BaseDir               string        `toml:"-"`
 	Username              string        `toml:"username"`
-	Password              string        `toml:"password"`
-	ApiKey                string        `toml:"apikey"`
+	Password              secret.Secret `toml:"password"`
+	ApiKey                secret.Secret `toml:"apikey"`
 	Timeout               time.Duration `toml:"timeout"`
 	GatherNode            string        `toml:"gather_node"`
 	GatherClusterInfo     bool          `toml:"gather_cluster_info"`
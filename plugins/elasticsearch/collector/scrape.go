@@ -25,7 +25,7 @@ func (c *Config) Scrape(ctx context.Context, _target string, ss *types.Samples)
 	}
 
 	if c.Username != "" && c.Password != "" {
-		target.User = url.UserPassword(c.Username, c.Password)
+		target.User = url.UserPassword(c.Username, c.Password.Value())
 	}
 
 	// returns nil if not provided and falls back to simple TCP.
@@ -40,7 +40,7 @@ func (c *Config) Scrape(ctx context.Context, _target string, ss *types.Samples)
 	if c.ApiKey != "" {
 		httpTransport = &transportWithAPIKey{
 			underlyingTransport: httpTransport,
-			apiKey:              c.ApiKey,
+			apiKey:              c.ApiKey.Value(),
 		}
 	}
 
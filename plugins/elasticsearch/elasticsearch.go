@@ -15,6 +15,16 @@ func init() {
 
 type ElasticSearch struct{}
 
+// Describe implements plugins.Describer
+func (*ElasticSearch) Describe() plugins.Description {
+	return plugins.Description{
+		Name:         types.PluginElasticSearch,
+		Description:  "Elasticsearch cluster, node and index metrics, like elasticsearch_exporter",
+		TargetFormat: "http url, e.g. http://127.0.0.1:9200",
+		Config:       &collector.Config{},
+	}
+}
+
 func (*ElasticSearch) ParseConfig(baseDir string, bs []byte) (any, error) {
 	var c collector.Config
 	err := toml.Unmarshal(bs, &c)
@@ -0,0 +1,262 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/cprobe/cprobe/lib/cmdx"
+	"github.com/cprobe/cprobe/plugins"
+	"github.com/cprobe/cprobe/types"
+	"github.com/cprobe/cprobe/types/metric"
+)
+
+const (
+	DataFormatPrometheus = "prometheus"
+	DataFormatInflux     = "influx"
+	DataFormatJSON       = "json"
+)
+
+var maxOutputSize = flag.Int("exec.maxOutputSize", 64*1024*1024, "The maximum size of the stdout of exec commands, the output of a scrape exceeding it is dropped")
+
+// stderr 可能很长，错误信息里只带最后这么多
+const maxStderrInError = 512
+
+// stderr 只保留最后这么多，末尾的空白去掉之后还要够 maxStderrInError
+const maxStderrSize = 8 * maxStderrInError
+
+type Config struct {
+	BaseDir string `toml:"-"`
+	// 不经过 shell 执行，需要管道之类的写法就用 command = "/bin/sh" 加 args = ["-c", "..."]
+	// 相对路径是相对 main.yaml 所在目录的，check.sh 这样的裸命令名也是，不会去 $PATH 里找，命令的工作目录也是这个目录
+	Command string        `toml:"command" description:"path of the command, relative to the directory of main.yaml, $PATH isn't searched"`
+	Args    []string      `toml:"args"`
+	Env     []string      `toml:"env" description:"extra environment variables, e.g. KEY=value"`
+	Timeout time.Duration `toml:"timeout"`
+	// DataFormat is the format of stdout: prometheus, influx or json
+	DataFormat      string `toml:"data_format" description:"format of stdout: prometheus, influx or json"`
+	InfluxPrecision string `toml:"influx_precision" description:"unit of the timestamps in influx lines, e.g. s, ms, defaults to ns"`
+}
+
+func (c *Config) initDefault() {
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Second
+	}
+
+	if c.DataFormat == "" {
+		c.DataFormat = DataFormatPrometheus
+	}
+}
+
+// jsonSample is an item of the json output, the same as the samples of the external plugins
+type jsonSample struct {
+	Name        string            `json:"name"`
+	Labels      map[string]string `json:"labels"`
+	Value       float64           `json:"value"`
+	Type        string            `json:"type"`
+	TimestampMs int64             `json:"timestamp_ms"`
+}
+
+type Exec struct{}
+
+func init() {
+	plugins.RegisterPlugin(types.PluginExec, &Exec{})
+}
+
+// Describe implements plugins.Describer
+func (*Exec) Describe() plugins.Description {
+	return plugins.Description{
+		Name:         types.PluginExec,
+		Description:  "Run a command per target and parse its stdout as Prometheus text, Influx line protocol or JSON",
+		TargetFormat: "anything, passed to the command as CPROBE_TARGET",
+		Config:       &Config{},
+		Metrics:      []string{"exec_exit_code", "exec_duration_seconds", "exec_timeout"},
+	}
+}
+
+func (*Exec) ParseConfig(baseDir string, bs []byte) (any, error) {
+	var c Config
+	err := toml.Unmarshal(bs, &c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Command == "" {
+		return nil, errors.New("command is empty")
+	}
+
+	switch c.DataFormat {
+	case "", DataFormatPrometheus, DataFormatInflux, DataFormatJSON:
+	default:
+		return nil, fmt.Errorf("unsupported data_format %q", c.DataFormat)
+	}
+
+	if !filepath.IsAbs(c.Command) {
+		// exec.Command 会在 $PATH 里找裸命令名，拼成绝对路径就不会了
+		c.Command, err = filepath.Abs(filepath.Join(baseDir, c.Command))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.BaseDir = baseDir
+	c.initDefault()
+	return &c, nil
+}
+
+// CloneConfig implements plugins.ConfigCloner, the config is never modified by Scrape
+func (*Exec) CloneConfig(c any) any {
+	cfg := *c.(*Config)
+	return &cfg
+}
+
+func (*Exec) Scrape(ctx context.Context, target string, c any, ss *types.Samples) error {
+	cfg := c.(*Config)
+
+	timeout := cfg.Timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if d := time.Until(deadline); d < timeout {
+			timeout = d
+		}
+	}
+
+	cmd := exec.Command(cfg.Command, cfg.Args...)
+	cmd.Dir = cfg.BaseDir
+	cmd.Env = append(os.Environ(), cfg.Env...)
+	cmd.Env = append(cmd.Env, "CPROBE_TARGET="+target, fmt.Sprintf("CPROBE_TIMEOUT_SECONDS=%.3f", timeout.Seconds()))
+	for k, v := range plugins.TargetLabels(ctx) {
+		cmd.Env = append(cmd.Env, "CPROBE_LABEL_"+k+"="+v)
+	}
+
+	stdout := &cappedBuffer{limit: *maxOutputSize}
+	stderr := &tailBuffer{limit: maxStderrSize}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	start := time.Now()
+	err, timedOut := cmdx.RunTimeout(cmd, timeout)
+	duration := time.Since(start)
+
+	exitCode := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	} else if err != nil || timedOut {
+		exitCode = -1
+	}
+
+	ss.AddMetric("exec", map[string]interface{}{
+		"exit_code":        exitCode,
+		"duration_seconds": duration.Seconds(),
+		"timeout":          timedOut,
+	})
+
+	if timedOut {
+		// 超时的时候进程组已经被 kill，但 stdout 可能还在被写，不能再读
+		return fmt.Errorf("command %s timed out after %s", cfg.Command, timeout)
+	}
+
+	if err != nil && exitErr == nil {
+		return fmt.Errorf("cannot run command %s: %s", cfg.Command, err)
+	}
+
+	// 命令失败的时候也可能输出了一部分数据，照样收集；被截断的输出可能缺了一半，不能要
+	var parseErr error
+	if stdout.truncated {
+		parseErr = fmt.Errorf("stdout exceeds -exec.maxOutputSize=%d bytes", *maxOutputSize)
+	} else {
+		parseErr = parseOutput(cfg, stdout.buf, ss)
+	}
+
+	if exitErr != nil {
+		return fmt.Errorf("command %s exited with code %d, stderr: %s", cfg.Command, exitCode, tail(stderr.buf, maxStderrInError))
+	}
+
+	if stdout.truncated {
+		return fmt.Errorf("command %s: %s", cfg.Command, parseErr)
+	}
+
+	if parseErr != nil {
+		return fmt.Errorf("cannot parse output of command %s as %s: %s", cfg.Command, cfg.DataFormat, parseErr)
+	}
+
+	return nil
+}
+
+func parseOutput(cfg *Config, out []byte, ss *types.Samples) error {
+	if len(bytes.TrimSpace(out)) == 0 {
+		return nil
+	}
+
+	switch cfg.DataFormat {
+	case DataFormatInflux:
+		return ss.AddInfluxLines(string(out), cfg.InfluxPrecision)
+	case DataFormatJSON:
+		var samples []jsonSample
+		if err := json.Unmarshal(out, &samples); err != nil {
+			return err
+		}
+		for _, s := range samples {
+			if s.Name == "" {
+				continue
+			}
+			ss.PushFront(metric.New(s.Name, s.Labels, map[string]interface{}{"": s.Value}, s.TimestampMs, metric.ParseValueType(s.Type)))
+		}
+		return nil
+	default:
+		return ss.AddMetricsBody(out, nil, false)
+	}
+}
+
+// cappedBuffer keeps the first limit bytes, the rest are dropped instead of failing the write,
+// so the command doesn't get EPIPE and exits as usual
+type cappedBuffer struct {
+	buf       []byte
+	limit     int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	n := b.limit - len(b.buf)
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > 0 {
+		b.buf = append(b.buf, p[:n]...)
+	}
+	if n < len(p) {
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+// tailBuffer keeps the last limit bytes
+type tailBuffer struct {
+	buf   []byte
+	limit int
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	// 攒到两倍再挪，避免每次写都拷贝
+	if len(b.buf) > 2*b.limit {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.limit:]...)
+	}
+	return len(p), nil
+}
+
+func tail(bs []byte, n int) string {
+	bs = bytes.TrimSpace(bs)
+	if len(bs) > n {
+		bs = bs[len(bs)-n:]
+	}
+	return string(bs)
+}
@@ -0,0 +1,164 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/conv"
+	"github.com/cprobe/cprobe/plugins"
+	"github.com/cprobe/cprobe/types"
+	"github.com/cprobe/cprobe/types/metric"
+)
+
+func TestScrape(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test commands need /bin/sh")
+	}
+
+	p := &Exec{}
+
+	// f runs script and returns the values of the samples by name, the tags are appended as name{k=v}
+	f := func(ctx context.Context, rule, script string) (map[string]float64, error) {
+		t.Helper()
+		cfg, err := p.ParseConfig(t.TempDir(), []byte(rule+"\ncommand = \"/bin/sh\"\nargs = [\"-c\", '''"+script+"''']\n"))
+		if err != nil {
+			t.Fatalf("cannot parse config: %s", err)
+		}
+
+		ss := types.NewSamples()
+		err = p.Scrape(ctx, "127.0.0.1:9000", cfg, ss)
+
+		values := make(map[string]float64)
+		for _, m := range ss.PopBackAll() {
+			for k, v := range m.Fields() {
+				// the same naming as the scheduler
+				name := m.Name()
+				if name == "" {
+					name = k
+				} else if k != "" {
+					name += "_" + k
+				}
+				if tags := m.Tags(); len(tags) > 0 {
+					name += "{" + tagsString(m) + "}"
+				}
+				values[name], _ = conv.ToFloat64(v)
+			}
+		}
+		return values, err
+	}
+
+	ctx := plugins.WithTargetLabels(context.Background(), map[string]string{"team": "ops"})
+	values, err := f(ctx, ``, `echo "# TYPE up gauge"; echo "up{target=\"$CPROBE_TARGET\",team=\"$CPROBE_LABEL_team\"} 1"`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if values["up{target=127.0.0.1:9000,team=ops}"] != 1 || values["exec_exit_code"] != 0 || values["exec_timeout"] != 0 {
+		t.Fatalf("unexpected values: %v", values)
+	}
+
+	values, err = f(context.Background(), `data_format = "influx"`, `echo "disk,path=/ used=12,ok=t 1700000000000000000"`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if values["disk_used{path=/}"] != 12 || values["disk_ok{path=/}"] != 1 {
+		t.Fatalf("unexpected values: %v", values)
+	}
+
+	values, err = f(context.Background(), `data_format = "json"`, `echo '[{"name": "queue_size", "labels": {"q": "a"}, "value": 3, "type": "gauge"}]'`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if values["queue_size{q=a}"] != 3 {
+		t.Fatalf("unexpected values: %v", values)
+	}
+
+	// the output is kept if the command fails
+	values, err = f(context.Background(), ``, `echo "partial 1"; echo "no such file" >&2; exit 2`)
+	if err == nil || !strings.Contains(err.Error(), "no such file") {
+		t.Fatalf("expecting error with stderr, got %v", err)
+	}
+	if values["partial"] != 1 || values["exec_exit_code"] != 2 {
+		t.Fatalf("unexpected values: %v", values)
+	}
+
+	values, err = f(context.Background(), `timeout = "100ms"`, `sleep 5`)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expecting timeout error, got %v", err)
+	}
+	if values["exec_timeout"] != 1 || values["exec_exit_code"] != -1 {
+		t.Fatalf("unexpected values: %v", values)
+	}
+
+	if _, err = f(context.Background(), ``, `echo "not prometheus text {"`); err == nil {
+		t.Fatalf("expecting parse error")
+	}
+
+	// stdout over -exec.maxOutputSize is dropped, stderr keeps its tail
+	old := *maxOutputSize
+	*maxOutputSize = 1000
+	values, err = f(context.Background(), ``, `i=0; while [ $i -lt 1000 ]; do echo "big_$i 1"; i=$((i+1)); done`)
+	*maxOutputSize = old
+	if err == nil || !strings.Contains(err.Error(), "exceeds -exec.maxOutputSize") {
+		t.Fatalf("expecting output size error, got %v", err)
+	}
+	if values["big_0"] != 0 || values["exec_exit_code"] != 0 {
+		t.Fatalf("unexpected values: %v", values)
+	}
+
+	_, err = f(context.Background(), ``, `i=0; while [ $i -lt 1000 ]; do echo "noise $i" >&2; i=$((i+1)); done; echo "the last line" >&2; exit 1`)
+	if err == nil || !strings.Contains(err.Error(), "the last line") || len(err.Error()) > 2*maxStderrInError {
+		t.Fatalf("expecting error with the tail of stderr, got %v", err)
+	}
+
+	if _, err = p.ParseConfig("", []byte(`command = "true"`+"\n"+`data_format = "xml"`)); err == nil {
+		t.Fatalf("expecting error for unsupported data_format")
+	}
+}
+
+func TestScrapeRelativeCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test commands need /bin/sh")
+	}
+
+	p := &Exec{}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "check.sh"), []byte("#!/bin/sh\necho \"check_ok 1\"\n"), 0o755); err != nil {
+		t.Fatalf("cannot write script: %s", err)
+	}
+
+	// a bare name is relative to the base dir too, it isn't searched in $PATH
+	for _, command := range []string{"check.sh", "./check.sh", filepath.Join(dir, "check.sh")} {
+		cfg, err := p.ParseConfig(dir, []byte(fmt.Sprintf("command = %q", command)))
+		if err != nil {
+			t.Fatalf("cannot parse config: %s", err)
+		}
+		ss := types.NewSamples()
+		if err = p.Scrape(context.Background(), "", cfg, ss); err != nil {
+			t.Fatalf("unexpected error of %s: %s", command, err)
+		}
+		if n := len(ss.PopBackAll()); n != 2 {
+			t.Fatalf("unexpected number of samples of %s: %d", command, n)
+		}
+	}
+
+	cfg, err := p.ParseConfig(dir, []byte(`command = "sh"`))
+	if err != nil {
+		t.Fatalf("cannot parse config: %s", err)
+	}
+	if err = p.Scrape(context.Background(), "", cfg, types.NewSamples()); err == nil || !strings.Contains(err.Error(), "cannot run command") {
+		t.Fatalf("expecting sh not to be found in the base dir, got %v", err)
+	}
+}
+
+func tagsString(m metric.Metric) string {
+	var parts []string
+	for _, tag := range m.TagList() {
+		parts = append(parts, tag.Key+"="+tag.Value)
+	}
+	return strings.Join(parts, ",")
+}
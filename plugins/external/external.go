@@ -0,0 +1,505 @@
+// Package external runs plugins shipped as separate binaries, so they can be written in any language
+// and added without recompiling cprobe.
+//
+// An external plugin is declared by conf.d/<plugin>/plugin.yaml:
+//
+//	command: /usr/local/bin/my-probe
+//	args: ["--verbose"]
+//	env: ["MY_PROBE_MODE=fast"]
+//	# the options which can be overridden per target by __param_<key>, besides user and password
+//	target_params: ["database"]
+//
+// cprobe starts the command once and keeps it running, the scrapes of all the targets are sent
+// to its stdin and the results are read from its stdout, one JSON object per line.
+// Requests may be answered in any order, the id of the response must be the id of the request.
+// Lines written to stderr are logged.
+//
+// Request:
+//
+//	{"id": 1, "target": "10.0.0.1:9000", "config": "<content of the rule files>", "config_dir": "/etc/cprobe/conf.d/my-probe",
+//	 "deadline_unix_ms": 1700000000000, "params": {"user": "alice"}}
+//
+// Response:
+//
+//	{"id": 1, "error": "", "samples": [{"name": "my_probe_up", "labels": {"role": "primary"}, "value": 1, "type": "gauge", "timestamp_ms": 0}]}
+//
+// type is one of counter, gauge, summary, histogram and untyped, timestamp_ms 0 means the scrape time.
+// The samples of a response with error are kept, the error is reported by cprobe_up and cprobe_error.
+//
+// The secret references such as ${vault:secret/mysql#password} are resolved by cprobe before sending,
+// the plugin never sees them. The references in config are replaced in the text as is, the secrets aren't
+// escaped for the format of the rule files. The references in params come from target labels, so they may only use
+// the providers of -secret.targetProviders, the same as the builtin plugins.
+package external
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/cmdx"
+	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/secret"
+	"github.com/cprobe/cprobe/plugins"
+	"github.com/cprobe/cprobe/types"
+	"github.com/cprobe/cprobe/types/metric"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	scrapeTimeout   = flag.Duration("external.scrapeTimeout", 30*time.Second, "Timeout of the scrapes of external plugins if the scrape has no deadline")
+	maxResponseSize = flag.Int("external.maxResponseSize", 64*1024*1024, "The maximum size of a response line from external plugins")
+)
+
+// DeclarationFile is the file under conf.d/<plugin> declaring an external plugin
+const DeclarationFile = "plugin.yaml"
+
+// restartInterval is the minimum interval between the restarts of a crashed plugin process
+const restartInterval = time.Second
+
+// Declaration is the content of DeclarationFile
+type Declaration struct {
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args"`
+	Env     []string `yaml:"env"`
+	// TargetParams are the keys allowed in params besides plugins.DefaultTargetParams
+	TargetParams []string `yaml:"target_params"`
+}
+
+type request struct {
+	ID             uint64            `json:"id"`
+	Target         string            `json:"target"`
+	Config         string            `json:"config"`
+	ConfigDir      string            `json:"config_dir"`
+	DeadlineUnixMs int64             `json:"deadline_unix_ms"`
+	Params         map[string]string `json:"params,omitempty"`
+}
+
+type response struct {
+	ID      uint64   `json:"id"`
+	Error   string   `json:"error"`
+	Samples []sample `json:"samples"`
+}
+
+type sample struct {
+	Name        string            `json:"name"`
+	Labels      map[string]string `json:"labels"`
+	Value       float64           `json:"value"`
+	Type        string            `json:"type"`
+	TimestampMs int64             `json:"timestamp_ms"`
+}
+
+type config struct {
+	baseDir string
+	data    []byte
+}
+
+var (
+	loadedLock sync.Mutex
+	loaded     = make(map[string]*External)
+)
+
+// Load registers the external plugins declared under configDirectory/<pluginDir> for each of pluginDirs.
+// It's called on start and reload: the processes of the plugins whose declaration changed or was removed are stopped,
+// they are started again on the next scrape.
+func Load(configDirectory string, pluginDirs []string) error {
+	loadedLock.Lock()
+	defer loadedLock.Unlock()
+
+	declared := make(map[string]struct{})
+	for _, name := range pluginDirs {
+		path := filepath.Join(configDirectory, name, DeclarationFile)
+		bs, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read %s: %w", path, err)
+		}
+
+		var decl Declaration
+		if err = yaml.UnmarshalStrict(bs, &decl); err != nil {
+			return fmt.Errorf("cannot parse %s: %w", path, err)
+		}
+		if decl.Command == "" {
+			return fmt.Errorf("%s: command is empty", path)
+		}
+
+		declared[name] = struct{}{}
+
+		if e, ok := loaded[name]; ok {
+			e.update(decl)
+			continue
+		}
+
+		if _, ok := plugins.GetPlugin(name); ok {
+			return fmt.Errorf("%s: external plugin %q conflicts with the builtin plugin", path, name)
+		}
+
+		e := &External{name: name, decl: decl}
+		loaded[name] = e
+		plugins.RegisterPlugin(name, e)
+	}
+
+	for name, e := range loaded {
+		if _, ok := declared[name]; !ok {
+			// job 都没了，不会再有抓取，只停掉进程，插件保留注册
+			e.stop()
+		}
+	}
+
+	return nil
+}
+
+// External is a plugin implemented by an external process
+type External struct {
+	name string
+
+	mu        sync.Mutex
+	decl      Declaration
+	proc      *process
+	lastStart time.Time
+}
+
+// ParseConfig keeps the rule files with the secret references resolved, they are sent to the process with each request
+func (e *External) ParseConfig(baseDir string, bs []byte) (any, error) {
+	data, err := secret.Resolve(string(bs))
+	if err != nil {
+		return nil, err
+	}
+	return &config{baseDir: baseDir, data: []byte(data)}, nil
+}
+
+// CloneConfig implements plugins.ConfigCloner, the config is never modified
+func (e *External) CloneConfig(cfg any) any {
+	return cfg
+}
+
+// Describe implements plugins.Describer
+func (e *External) Describe() plugins.Description {
+	e.mu.Lock()
+	decl := e.decl
+	e.mu.Unlock()
+
+	return plugins.Description{
+		Name:         e.name,
+		Description:  "external plugin " + decl.Command,
+		TargetParams: decl.TargetParams,
+	}
+}
+
+// RawTargetParams implements plugins.RawTargetParams, the params are sent to the process as is
+func (e *External) RawTargetParams() {}
+
+func (e *External) Scrape(ctx context.Context, target string, cfg any, ss *types.Samples) error {
+	c := cfg.(*config)
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *scrapeTimeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+
+	params, err := resolveParams(plugins.TargetParams(ctx))
+	if err != nil {
+		return fmt.Errorf("external plugin %s: %w", e.name, err)
+	}
+
+	p, err := e.getProcess()
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.call(ctx, &request{
+		Target:         target,
+		Config:         string(c.data),
+		ConfigDir:      c.baseDir,
+		DeadlineUnixMs: deadline.UnixMilli(),
+		Params:         params,
+	})
+	if err != nil {
+		return fmt.Errorf("external plugin %s: %w", e.name, err)
+	}
+
+	for _, s := range resp.Samples {
+		if s.Name == "" {
+			continue
+		}
+		ss.PushFront(metric.New(s.Name, s.Labels, map[string]interface{}{"": s.Value}, s.TimestampMs, metric.ParseValueType(s.Type)))
+	}
+
+	if resp.Error != "" {
+		return fmt.Errorf("external plugin %s: %s", e.name, resp.Error)
+	}
+	return nil
+}
+
+// resolveParams returns a copy of params with the secret references resolved,
+// params come from target labels, so only the providers of -secret.targetProviders are allowed
+func resolveParams(params map[string]string) (map[string]string, error) {
+	if len(params) == 0 {
+		return params, nil
+	}
+
+	ret := make(map[string]string, len(params))
+	for k, v := range params {
+		resolved, err := secret.ResolveTargetValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("param %q: %w", k, err)
+		}
+		ret[k] = resolved
+	}
+	return ret, nil
+}
+
+func (e *External) update(decl Declaration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if reflect.DeepEqual(e.decl, decl) {
+		return
+	}
+
+	logger.Infof("external plugin %s is changed, restart it", e.name)
+	e.decl = decl
+	if e.proc != nil {
+		e.proc.stop()
+		e.proc = nil
+	}
+}
+
+func (e *External) stop() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.proc != nil {
+		e.proc.stop()
+		e.proc = nil
+	}
+}
+
+// getProcess returns the running process, it starts the process if it isn't started or exited
+func (e *External) getProcess() (*process, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.proc != nil && !e.proc.exited() {
+		return e.proc, nil
+	}
+
+	if e.proc != nil && time.Since(e.lastStart) < restartInterval {
+		return nil, fmt.Errorf("external plugin %s exited: %w", e.name, e.proc.exitErr())
+	}
+
+	e.lastStart = time.Now()
+	p, err := startProcess(e.name, e.decl)
+	if err != nil {
+		return nil, fmt.Errorf("cannot start external plugin %s: %w", e.name, err)
+	}
+	e.proc = p
+	return p, nil
+}
+
+type process struct {
+	name  string
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	writeMu sync.Mutex
+	nextID  atomic.Uint64
+
+	mu      sync.Mutex
+	pending map[uint64]chan *response
+	done    chan struct{}
+	err     error
+}
+
+func startProcess(name string, decl Declaration) (*process, error) {
+	cmd := exec.Command(decl.Command, decl.Args...)
+	cmd.Env = append(os.Environ(), decl.Env...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cmdx.CmdStart(cmd); err != nil {
+		return nil, err
+	}
+
+	p := &process{
+		name:    name,
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: make(map[uint64]chan *response),
+		done:    make(chan struct{}),
+	}
+
+	go p.logStderr(stderr)
+	go p.readLoop(stdout)
+
+	logger.Infof("external plugin %s started, pid: %d", name, cmd.Process.Pid)
+	return p, nil
+}
+
+func (p *process) logStderr(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		logger.Warnf("external plugin %s: %s", p.name, scanner.Text())
+	}
+}
+
+func (p *process) readLoop(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), *maxResponseSize)
+
+	for scanner.Scan() {
+		var resp response
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			logger.Errorf("external plugin %s: cannot parse response: %s", p.name, err)
+			continue
+		}
+
+		p.mu.Lock()
+		ch, ok := p.pending[resp.ID]
+		delete(p.pending, resp.ID)
+		p.mu.Unlock()
+
+		// 超时之后才回来的响应直接丢弃
+		if ok {
+			ch <- &resp
+		}
+	}
+
+	err := scanner.Err()
+	if err == nil {
+		err = io.EOF
+	} else {
+		// 比如响应超过了 -external.maxResponseSize，没人读 stdout 了，子进程会卡在写 stdout 上，Wait 永远不会返回
+		_ = p.cmd.Process.Kill()
+	}
+	waitErr := p.cmd.Wait()
+	if waitErr != nil {
+		err = fmt.Errorf("%s, stdout: %w", waitErr, err)
+	}
+
+	p.mu.Lock()
+	p.err = err
+	p.pending = nil
+	p.mu.Unlock()
+	close(p.done)
+
+	logger.Warnf("external plugin %s exited: %s", p.name, err)
+}
+
+func (p *process) call(ctx context.Context, req *request) (*response, error) {
+	req.ID = p.nextID.Add(1)
+	ch := make(chan *response, 1)
+
+	p.mu.Lock()
+	if p.pending == nil {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("process exited: %w", p.exitErr())
+	}
+	p.pending[req.ID] = ch
+	p.mu.Unlock()
+
+	bs, err := json.Marshal(req)
+	if err != nil {
+		p.forget(req.ID)
+		return nil, err
+	}
+
+	// 子进程不读 stdin 的时候 Write 会一直阻塞，所以放到 goroutine 里，超时就不等了
+	written := make(chan error, 1)
+	go func() {
+		p.writeMu.Lock()
+		_, err := p.stdin.Write(append(bs, '\n'))
+		p.writeMu.Unlock()
+		written <- err
+	}()
+
+	select {
+	case err = <-written:
+		if err != nil {
+			p.forget(req.ID)
+			return nil, fmt.Errorf("cannot send request: %w", err)
+		}
+	case <-p.done:
+		return nil, fmt.Errorf("process exited: %w", p.exitErr())
+	case <-ctx.Done():
+		// 请求可能只写了一半，后面的请求都没法解析了，杀掉进程，下次抓取的时候重启
+		p.forget(req.ID)
+		logger.Errorf("external plugin %s doesn't read the requests, kill it", p.name)
+		_ = p.cmd.Process.Kill()
+		return nil, fmt.Errorf("cannot send request: %w", ctx.Err())
+	}
+
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-p.done:
+		return nil, fmt.Errorf("process exited: %w", p.exitErr())
+	case <-ctx.Done():
+		p.forget(req.ID)
+		return nil, ctx.Err()
+	}
+}
+
+func (p *process) forget(id uint64) {
+	p.mu.Lock()
+	if p.pending != nil {
+		delete(p.pending, id)
+	}
+	p.mu.Unlock()
+}
+
+func (p *process) exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *process) exitErr() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		return errors.New("unknown error")
+	}
+	return p.err
+}
+
+// stop closes stdin so the process can exit gracefully, and kills it if it doesn't exit in time
+func (p *process) stop() {
+	_ = p.stdin.Close()
+	go func() {
+		select {
+		case <-p.done:
+		case <-time.After(5 * time.Second):
+			_ = p.cmd.Process.Kill()
+		}
+	}()
+}
@@ -0,0 +1,268 @@
+package external
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/secret"
+	"github.com/cprobe/cprobe/plugins"
+	"github.com/cprobe/cprobe/types"
+)
+
+const helperEnv = "CPROBE_EXTERNAL_HELPER"
+
+// TestMain runs the test binary itself as the external plugin if helperEnv is set
+func TestMain(m *testing.M) {
+	if os.Getenv(helperEnv) == "1" {
+		runHelper()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runHelper answers the requests by target:
+// error returns an error with a sample, slow never answers, crash exits, huge returns a very long line,
+// block stops reading stdin, others return the echoed request as labels
+func runHelper() {
+	out := json.NewEncoder(os.Stdout)
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var req request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			fmt.Fprintf(os.Stderr, "bad request: %s\n", err)
+			continue
+		}
+
+		switch req.Target {
+		case "slow":
+			continue
+		case "crash":
+			os.Exit(3)
+		case "huge":
+			// much more than the pipe buffer, the write blocks if nobody reads stdout
+			_ = out.Encode(response{ID: req.ID, Error: strings.Repeat("x", 4*1024*1024)})
+		case "block":
+			// stops reading stdin
+			time.Sleep(time.Hour)
+		case "error":
+			_ = out.Encode(response{ID: req.ID, Error: "connection refused", Samples: []sample{{Name: "helper_up", Value: 0, Type: "gauge"}}})
+		default:
+			_ = out.Encode(response{ID: req.ID, Samples: []sample{{
+				Name: "helper_up",
+				Labels: map[string]string{
+					"target":   req.Target,
+					"config":   req.Config,
+					"dir":      req.ConfigDir,
+					"user":     req.Params["user"],
+					"deadline": fmt.Sprint(req.DeadlineUnixMs > 0),
+				},
+				Value: 1,
+				Type:  "gauge",
+			}}})
+		}
+	}
+}
+
+func loadHelper(t *testing.T, name string) plugins.Plugin {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, name), 0o755); err != nil {
+		t.Fatalf("cannot create plugin dir: %s", err)
+	}
+
+	decl := fmt.Sprintf("command: %q\nargs: [\"-test.run=^$\"]\nenv: [\"%s=1\"]\n", os.Args[0], helperEnv)
+	if err := os.WriteFile(filepath.Join(dir, name, DeclarationFile), []byte(decl), 0o644); err != nil {
+		t.Fatalf("cannot write %s: %s", DeclarationFile, err)
+	}
+
+	if err := Load(dir, []string{name}); err != nil {
+		t.Fatalf("cannot load external plugins: %s", err)
+	}
+	t.Cleanup(func() {
+		if err := Load(dir, nil); err != nil {
+			t.Errorf("cannot unload external plugins: %s", err)
+		}
+	})
+
+	p, ok := plugins.GetPlugin(name)
+	if !ok {
+		t.Fatalf("plugin %s isn't registered", name)
+	}
+	return p
+}
+
+func scrape(ctx context.Context, p plugins.Plugin, target string, cfg any) (map[string]string, error) {
+	ss := types.NewSamples()
+	err := p.Scrape(ctx, target, cfg, ss)
+	ms := ss.PopBackAll()
+	if len(ms) != 1 {
+		return nil, fmt.Errorf("unexpected number of samples: %d, scrape error: %v", len(ms), err)
+	}
+	return ms[0].Tags(), err
+}
+
+func TestExternal(t *testing.T) {
+	p := loadHelper(t, "external_test_helper")
+
+	cfg, err := p.ParseConfig("/etc/cprobe/conf.d/helper", []byte(`key = "value"`))
+	if err != nil {
+		t.Fatalf("cannot parse config: %s", err)
+	}
+
+	ctx := plugins.WithTargetParams(context.Background(), map[string]string{"user": "alice"})
+	tags, err := scrape(ctx, p, "10.0.0.1:9000", cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := map[string]string{
+		"target":   "10.0.0.1:9000",
+		"config":   `key = "value"`,
+		"dir":      "/etc/cprobe/conf.d/helper",
+		"user":     "alice",
+		"deadline": "true",
+	}
+	for k, v := range expected {
+		if tags[k] != v {
+			t.Fatalf("unexpected label %s: got %q, want %q", k, tags[k], v)
+		}
+	}
+
+	// the samples are kept with the error
+	if _, err = scrape(context.Background(), p, "error", cfg); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("expecting connection refused error, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err = p.Scrape(ctx, "slow", cfg, types.NewSamples()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expecting %s, got %v", context.DeadlineExceeded, err)
+	}
+
+	// the process keeps serving after a timed out request
+	if _, err = scrape(context.Background(), p, "after-slow", cfg); err != nil {
+		t.Fatalf("unexpected error after timeout: %s", err)
+	}
+
+	if err = p.Scrape(context.Background(), "crash", cfg, types.NewSamples()); err == nil || !strings.Contains(err.Error(), "exited") {
+		t.Fatalf("expecting process exited error, got %v", err)
+	}
+
+	// restarted on the scrape after restartInterval
+	time.Sleep(restartInterval)
+	if _, err = scrape(context.Background(), p, "after-crash", cfg); err != nil {
+		t.Fatalf("unexpected error after restart: %s", err)
+	}
+}
+
+func TestExternalSecrets(t *testing.T) {
+	secret.RegisterProvider("vault", func(ref string) (string, error) {
+		return "s3cret:" + ref, nil
+	})
+	secret.ResetCache()
+
+	p := loadHelper(t, "external_test_secrets")
+
+	cfg, err := p.ParseConfig("", []byte(`password = "${vault:secret/helper#password}"`))
+	if err != nil {
+		t.Fatalf("cannot parse config: %s", err)
+	}
+
+	ctx := plugins.WithTargetParams(context.Background(), map[string]string{"user": "${vault:secret/helper#user}"})
+	tags, err := scrape(ctx, p, "10.0.0.1:9000", cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if tags["config"] != `password = "s3cret:secret/helper#password"` {
+		t.Fatalf("unexpected config: %q", tags["config"])
+	}
+	if tags["user"] != "s3cret:secret/helper#user" {
+		t.Fatalf("unexpected user: %q", tags["user"])
+	}
+
+	// target labels can't read local files
+	ctx = plugins.WithTargetParams(context.Background(), map[string]string{"user": "${file:/etc/passwd}"})
+	if err = p.Scrape(ctx, "10.0.0.1:9000", cfg, types.NewSamples()); err == nil || !strings.Contains(err.Error(), "isn't allowed") {
+		t.Fatalf("expecting the file provider to be rejected, got %v", err)
+	}
+}
+
+func TestExternalStuck(t *testing.T) {
+	p := loadHelper(t, "external_test_stuck")
+
+	cfg, err := p.ParseConfig("", nil)
+	if err != nil {
+		t.Fatalf("cannot parse config: %s", err)
+	}
+
+	defer func(n int) { *maxResponseSize = n }(*maxResponseSize)
+	*maxResponseSize = 1024
+
+	// the process is killed if the response is too long, instead of blocking on writing stdout forever
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = p.Scrape(ctx, "huge", cfg, types.NewSamples()); err == nil || !strings.Contains(err.Error(), "exited") {
+		t.Fatalf("expecting process exited error, got %v", err)
+	}
+
+	time.Sleep(restartInterval)
+	if _, err = scrape(context.Background(), p, "after-huge", cfg); err != nil {
+		t.Fatalf("unexpected error after restart: %s", err)
+	}
+
+	blockCtx, blockCancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer blockCancel()
+	if err = p.Scrape(blockCtx, "block", cfg, types.NewSamples()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expecting %s, got %v", context.DeadlineExceeded, err)
+	}
+
+	// the request is larger than the pipe buffer, so writing it blocks
+	bigCfg, err := p.ParseConfig("", []byte(strings.Repeat("#", 1024*1024)))
+	if err != nil {
+		t.Fatalf("cannot parse config: %s", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err = p.Scrape(ctx, "blocked", bigCfg, types.NewSamples()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expecting %s, got %v", context.DeadlineExceeded, err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("the scrape ignored the deadline: %s", d)
+	}
+
+	time.Sleep(restartInterval)
+	if _, err = scrape(context.Background(), p, "after-block", cfg); err != nil {
+		t.Fatalf("unexpected error after restart: %s", err)
+	}
+}
+
+func TestLoadConflict(t *testing.T) {
+	plugins.RegisterPlugin("external_test_builtin", &External{name: "external_test_builtin"})
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "external_test_builtin"), 0o755); err != nil {
+		t.Fatalf("cannot create plugin dir: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "external_test_builtin", DeclarationFile), []byte("command: /bin/true\n"), 0o644); err != nil {
+		t.Fatalf("cannot write %s: %s", DeclarationFile, err)
+	}
+	if err := Load(dir, []string{"external_test_builtin"}); err == nil || !strings.Contains(err.Error(), "conflicts") {
+		t.Fatalf("expecting conflict error, got %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "external_test_builtin", DeclarationFile), []byte("commnd: /bin/true\n"), 0o644); err != nil {
+		t.Fatalf("cannot write %s: %s", DeclarationFile, err)
+	}
+	if err := Load(dir, []string{"external_test_builtin"}); err == nil {
+		t.Fatalf("expecting error for unknown key")
+	}
+}
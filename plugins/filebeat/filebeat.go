@@ -30,6 +30,16 @@ func init() {
 	plugins.RegisterPlugin(types.PluginFilebeat, &Filebeat{})
 }
 
+// Describe implements plugins.Describer
+func (f *Filebeat) Describe() plugins.Description {
+	return plugins.Description{
+		Name:         types.PluginFilebeat,
+		Description:  "Filebeat metrics from its http stats endpoint, like beat-exporter",
+		TargetFormat: "ip:port of the http endpoint, e.g. 127.0.0.1:5066",
+		Config:       &Config{},
+	}
+}
+
 func (f *Filebeat) ParseConfig(baseDir string, bs []byte) (any, error) {
 	var c Config
 	err := toml.Unmarshal(bs, &c)
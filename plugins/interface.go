@@ -2,6 +2,7 @@ package plugins
 
 import (
 	"context"
+	"sync"
 
 	"github.com/cprobe/cprobe/types"
 )
@@ -13,13 +14,30 @@ type Plugin interface {
 	Scrape(ctx context.Context, target string, cfg any, ss *types.Samples) error
 }
 
-var registry = make(map[string]Plugin)
+// ConfigCloner is optionally implemented by plugins whose parsed config can be reused.
+// The scheduler then parses the rule files once per content revision instead of once per target,
+// and hands every target a copy from CloneConfig.
+// The copy must be safe to modify in Scrape without affecting the other targets,
+// a shallow copy is enough if Scrape doesn't modify the nested pointers, maps and slices.
+type ConfigCloner interface {
+	CloneConfig(cfg any) any
+}
+
+// external 插件是 Reload 的时候注册的，跟抓取并发，所以要加锁
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]Plugin)
+)
 
 func GetPlugin(pluginName string) (Plugin, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
 	p, ok := registry[pluginName]
 	return p, ok
 }
 
 func RegisterPlugin(pluginName string, p Plugin) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
 	registry[pluginName] = p
 }
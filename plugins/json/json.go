@@ -20,6 +20,17 @@ func init() {
 	plugins.RegisterPlugin(types.PluginJson, &Json{})
 }
 
+// Describe implements plugins.Describer
+func (p *Json) Describe() plugins.Description {
+	return plugins.Description{
+		Name:         types.PluginJson,
+		Description:  "Extract metrics from JSON http responses with JSONPath, like json_exporter",
+		TargetFormat: "http url of the json document, e.g. http://localhost:8000/data.json",
+		ConfigFormat: plugins.ConfigFormatYAML,
+		Config:       &config.Module{},
+	}
+}
+
 func (p *Json) ParseConfig(_ string, bs []byte) (any, error) {
 	var moduleConfig config.Module
 	err := yaml.Unmarshal(bs, &moduleConfig)
@@ -8,6 +8,7 @@ import (
 	"github.com/Shopify/sarama"
 	"github.com/cprobe/cprobe/lib/cgroup"
 	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/secret"
 	"github.com/cprobe/cprobe/plugins"
 	"github.com/cprobe/cprobe/plugins/kafka/exporter"
 	"github.com/cprobe/cprobe/types"
@@ -20,17 +21,17 @@ type Config struct {
 	KafkaVersion string `toml:"kafka_version" description:"Kafka broker version"`
 	Namespace    string `toml:"namespace"`
 
-	SaslEnabled            bool   `toml:"sasl_enabled" description:"Connect using SASL/PLAIN"`
-	SASLHandshake          bool   `toml:"sasl_handshake" description:"Only set this to false if using a non-Kafka SASL proxy"`
-	SaslUsername           string `toml:"sasl_username" description:"SASL user name"`
-	SaslPassword           string `toml:"sasl_password" description:"SASL user password"`
-	SaslMechanism          string `toml:"sasl_mechanism" description:"SASL mechanism can be plain, scram-sha512, scram-sha256"`
-	SaslServiceName        string `toml:"sasl_service_name" description:"Service name when using Kerberos Auth"`
-	SaslKerberosConfigPath string `toml:"sasl_kerberos_config_path" description:"Kerberos config path"`
-	SaslRealm              string `toml:"sasl_realm" description:"Kerberos realm"`
-	SaslKeytabPath         string `toml:"sasl_keytab_path" description:"Kerberos keytab file path"`
-	SaslKerberosAuthType   string `toml:"sasl_kerberos_auth_type" description:"Kerberos auth type. Either 'keytabAuth' or 'userAuth'"`
-	SaslDisablePAFXFast    bool   `toml:"sasl_disable_pafxfast" description:"Configure the Kerberos client to not use PA_FX_FAST"`
+	SaslEnabled            bool          `toml:"sasl_enabled" description:"Connect using SASL/PLAIN"`
+	SASLHandshake          bool          `toml:"sasl_handshake" description:"Only set this to false if using a non-Kafka SASL proxy"`
+	SaslUsername           string        `toml:"sasl_username" description:"SASL user name"`
+	SaslPassword           secret.Secret `toml:"sasl_password" description:"SASL user password"`
+	SaslMechanism          string        `toml:"sasl_mechanism" description:"SASL mechanism can be plain, scram-sha512, scram-sha256"`
+	SaslServiceName        string        `toml:"sasl_service_name" description:"Service name when using Kerberos Auth"`
+	SaslKerberosConfigPath string        `toml:"sasl_kerberos_config_path" description:"Kerberos config path"`
+	SaslRealm              string        `toml:"sasl_realm" description:"Kerberos realm"`
+	SaslKeytabPath         string        `toml:"sasl_keytab_path" description:"Kerberos keytab file path"`
+	SaslKerberosAuthType   string        `toml:"sasl_kerberos_auth_type" description:"Kerberos auth type. Either 'keytabAuth' or 'userAuth'"`
+	SaslDisablePAFXFast    bool          `toml:"sasl_disable_pafxfast" description:"Configure the Kerberos client to not use PA_FX_FAST"`
 
 	TLSEnabled               bool   `toml:"tls_enabled" description:"Connect to Kafka using TLS"`
 	TLSServerName            string `toml:"tls_server_name" description:"Used to verify the hostname on the returned certificates unless tls.insecure-skip-tls-verify is given. The kafka server's name should be given"`
@@ -60,6 +61,17 @@ func init() {
 	plugins.RegisterPlugin(types.PluginKafka, &Kafka{})
 }
 
+// Describe implements plugins.Describer
+func (*Kafka) Describe() plugins.Description {
+	return plugins.Description{
+		Name:         types.PluginKafka,
+		Description:  "Kafka broker, topic and consumer group metrics, like kafka_exporter",
+		TargetFormat: "ip:port of a broker, e.g. 127.0.0.1:9092",
+		Config:       &Config{},
+		TargetParams: []string{"sasl_username", "sasl_password"},
+	}
+}
+
 func (*Kafka) ParseConfig(baseDir string, bs []byte) (any, error) {
 	var c Config
 	err := toml.Unmarshal(bs, &c)
@@ -109,7 +121,7 @@ func (*Kafka) Scrape(ctx context.Context, target string, c any, ss *types.Sample
 		UseSASL:                  conf.SaslEnabled,
 		UseSASLHandshake:         conf.SASLHandshake,
 		SaslUsername:             conf.SaslUsername,
-		SaslPassword:             conf.SaslPassword,
+		SaslPassword:             conf.SaslPassword.Value(),
 		SaslMechanism:            conf.SaslMechanism,
 		SaslDisablePAFXFast:      conf.SaslDisablePAFXFast,
 		UseTLS:                   conf.TLSEnabled,
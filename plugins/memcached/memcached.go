@@ -14,6 +14,17 @@ func init() {
 
 type Memcached struct{}
 
+// Describe implements plugins.Describer
+func (*Memcached) Describe() plugins.Description {
+	return plugins.Description{
+		Name:         types.PluginMemcached,
+		Description:  "Memcached metrics, like memcached_exporter",
+		TargetFormat: "ip:port, e.g. 127.0.0.1:11211",
+		Config:       &Config{},
+		Metrics:      []string{"memcached_up"},
+	}
+}
+
 func (*Memcached) ParseConfig(baseDir string, bs []byte) (any, error) {
 	var c Config
 	err := toml.Unmarshal(bs, &c)
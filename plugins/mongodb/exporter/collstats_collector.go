@@ -20,6 +20,7 @@ import (
 	"strings"
 
 	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/secret"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -70,7 +71,7 @@ func (d *collstatsCollector) collect(ch chan<- prometheus.Metric) {
 	if d.discoveringMode {
 		namespaces, err := listAllCollections(d.ctx, client, d.collections, systemDBs)
 		if err != nil {
-			logger.Errorf("cannot auto discover databases and collections: %s, target uri: %v", err.Error(), d.opts.URI)
+			logger.Errorf("cannot auto discover databases and collections: %s, target uri: %v", err.Error(), secret.RedactURL(d.opts.URI))
 			return
 		}
 
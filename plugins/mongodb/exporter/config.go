@@ -6,6 +6,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/cprobe/cprobe/lib/secret"
 	"github.com/cprobe/cprobe/types"
 	"github.com/pkg/errors"
 )
@@ -13,7 +14,7 @@ import (
 type Config struct {
 	BaseDir                                    string        `toml:"-"`
 	User                                       string        `toml:"user"`
-	Password                                   string        `toml:"password"`
+	Password                                   secret.Secret `toml:"password"`
 	DirectConnect                              bool          `toml:"direct_connect"`
 	ConnectTimeout                             time.Duration `toml:"connect_timeout"`
 	CollstatsColls                             []string      `toml:"collstats_colls"`
@@ -35,7 +36,7 @@ type Config struct {
 }
 
 func (c *Config) Scrape(ctx context.Context, target string, ss *types.Samples) error {
-	uri := buildURI(target, c.User, c.Password)
+	uri := buildURI(target, c.User, c.Password.Value())
 
 	exporterOpts := &Opts{
 		CollStatsNamespaces:   c.CollstatsColls,
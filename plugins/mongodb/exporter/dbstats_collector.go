@@ -19,6 +19,7 @@ import (
 	"context"
 
 	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/secret"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -70,7 +71,7 @@ func (d *dbstatsCollector) collect(ch chan<- prometheus.Metric) {
 
 	dbNames, err := databases(d.ctx, client, d.databaseFilter, nil)
 	if err != nil {
-		logger.Errorf("Failed to get database names: %s uri: %v", err, d.opts.URI)
+		logger.Errorf("Failed to get database names: %s uri: %v", err, secret.RedactURL(d.opts.URI))
 		return
 	}
 
@@ -21,6 +21,7 @@ import (
 	"strings"
 
 	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/secret"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -73,7 +74,7 @@ func (d *indexstatsCollector) collect(ch chan<- prometheus.Metric) {
 	if d.discoveringMode {
 		namespaces, err := listAllCollections(d.ctx, client, d.collections, systemDBs)
 		if err != nil {
-			logger.Errorf("cannot auto discover databases and collections, uri: %v, err: %s", d.opts.URI, err)
+			logger.Errorf("cannot auto discover databases and collections, uri: %v, err: %s", secret.RedactURL(d.opts.URI), err)
 			return
 		}
 
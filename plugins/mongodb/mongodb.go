@@ -15,6 +15,17 @@ func init() {
 
 type MongoDB struct{}
 
+// Describe implements plugins.Describer
+func (*MongoDB) Describe() plugins.Description {
+	return plugins.Description{
+		Name:         types.PluginMongoDB,
+		Description:  "MongoDB metrics, like mongodb_exporter",
+		TargetFormat: "ip:port, e.g. 127.0.0.1:27017",
+		Config:       &exporter.Config{},
+		Metrics:      []string{"mongodb_up"},
+	}
+}
+
 func (*MongoDB) ParseConfig(baseDir string, bs []byte) (any, error) {
 	var c exporter.Config
 	err := toml.Unmarshal(bs, &c)
@@ -126,7 +126,7 @@ func (e *Exporter) scrape(ctx context.Context, ch chan<- prometheus.Metric) erro
 	scrapeTime := time.Now()
 	db, err := sql.Open("mysql", e.dsn)
 	if err != nil {
-		return fmt.Errorf("cannot opening connection to database: %s, error: %s", e.dsn, err)
+		return fmt.Errorf("cannot opening connection to database: %s, error: %s", e.getTargetFromDsn(), err)
 	}
 
 	defer db.Close()
@@ -11,6 +11,7 @@ import (
 
 	"github.com/BurntSushi/toml"
 	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/secret"
 	"github.com/cprobe/cprobe/plugins"
 	"github.com/cprobe/cprobe/plugins/mysql/collector"
 	"github.com/cprobe/cprobe/plugins/sqlc"
@@ -20,16 +21,16 @@ import (
 )
 
 type Global struct {
-	User                  string   `toml:"user"`
-	Password              string   `toml:"password"`
-	SslCa                 string   `toml:"ssl_ca"`
-	SslCert               string   `toml:"ssl_cert"`
-	SslKey                string   `toml:"ssl_key"`
-	TlsInsecureSkipVerify bool     `toml:"ssl_skip_verfication"`
-	Tls                   string   `toml:"tls"`
-	ScraperEnabled        []string `toml:"scraper_enabled"`
-	LockWaitTimeout       int      `toml:"lock_wait_timeout"`
-	LogSlowFilter         bool     `toml:"log_slow_filter"`
+	User                  string        `toml:"user"`
+	Password              secret.Secret `toml:"password"`
+	SslCa                 string        `toml:"ssl_ca"`
+	SslCert               string        `toml:"ssl_cert"`
+	SslKey                string        `toml:"ssl_key"`
+	TlsInsecureSkipVerify bool          `toml:"ssl_skip_verfication"`
+	Tls                   string        `toml:"tls"`
+	ScraperEnabled        []string      `toml:"scraper_enabled"`
+	LockWaitTimeout       int           `toml:"lock_wait_timeout"`
+	LogSlowFilter         bool          `toml:"log_slow_filter"`
 }
 
 func (g Global) FormDSN(target string) (string, error) {
@@ -39,7 +40,7 @@ func (g Global) FormDSN(target string) (string, error) {
 
 	config := mysql.NewConfig()
 	config.User = g.User
-	config.Passwd = g.Password
+	config.Passwd = g.Password.Value()
 	config.Net = "tcp"
 	if prefix := "unix://"; strings.HasPrefix(target, prefix) {
 		config.Net = "unix"
@@ -392,6 +393,16 @@ func init() {
 	plugins.RegisterPlugin(types.PluginMySQL, &MySQL{})
 }
 
+// Describe implements plugins.Describer
+func (*MySQL) Describe() plugins.Description {
+	return plugins.Description{
+		Name:         types.PluginMySQL,
+		Description:  "MySQL metrics, like mysqld_exporter, with custom SQL queries",
+		TargetFormat: "ip:port or unix://<socket path>, e.g. 127.0.0.1:3306",
+		Config:       &Config{},
+	}
+}
+
 func (*MySQL) ParseConfig(baseDir string, bs []byte) (any, error) {
 	var c Config
 	err := toml.Unmarshal(bs, &c)
@@ -404,6 +415,12 @@ func (*MySQL) ParseConfig(baseDir string, bs []byte) (any, error) {
 	return &c, nil
 }
 
+// CloneConfig implements plugins.ConfigCloner, Scrape doesn't modify the config
+func (*MySQL) CloneConfig(c any) any {
+	cfg := *c.(*Config)
+	return &cfg
+}
+
 // mysqld_exporter 原来的很多参数都是通过命令行传的，在 cprobe 的场景下，需要改造
 // cprobe 是并发抓取很多个数据库实例的监控数据，不同的数据库实例其抓取参数可能不同
 // 如果直接修改 collector pkg 下面的变量，就会有并发使用变量的问题
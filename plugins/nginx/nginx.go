@@ -39,6 +39,16 @@ func init() {
 	plugins.RegisterPlugin(types.PluginNginx, &Nginx{})
 }
 
+// Describe implements plugins.Describer
+func (n *Nginx) Describe() plugins.Description {
+	return plugins.Description{
+		Name:         types.PluginNginx,
+		Description:  "Nginx stub_status or nginx plus metrics, like nginx-prometheus-exporter",
+		TargetFormat: "ip:port/path of the status page, e.g. 127.0.0.1:80/nginx-status",
+		Config:       &Config{},
+	}
+}
+
 func (n *Nginx) ParseConfig(baseDir string, bs []byte) (any, error) {
 	var c Config
 	err := toml.Unmarshal(bs, &c)
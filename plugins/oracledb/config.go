@@ -9,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/cprobe/cprobe/lib/secret"
 	"github.com/cprobe/cprobe/plugins/sqlc"
 	"github.com/cprobe/cprobe/types"
 	go_ora "github.com/sijms/go-ora/v2"
@@ -16,7 +17,7 @@ import (
 
 type Global struct {
 	Username  string            `toml:"username"`
-	Password  string            `toml:"password"`
+	Password  secret.Secret     `toml:"password"`
 	Options   map[string]string `toml:"options"`
 	Namespace string            `toml:"namespace"`
 }
@@ -41,7 +42,7 @@ func (c *Config) Scrape(ctx context.Context, target string, ss *types.Samples) e
 		c.Global.Namespace = ""
 	}
 
-	connString := go_ora.BuildUrl(ip, port, service, c.Global.Username, c.Global.Password, c.Global.Options)
+	connString := go_ora.BuildUrl(ip, port, service, c.Global.Username, c.Global.Password.Value(), c.Global.Options)
 	conn, err := sql.Open("oracle", connString)
 	if err != nil {
 		return fmt.Errorf("cannot opening connection to database: %s, error: %s", target, err)
@@ -14,6 +14,16 @@ func init() {
 
 type OracleDB struct{}
 
+// Describe implements plugins.Describer
+func (*OracleDB) Describe() plugins.Description {
+	return plugins.Description{
+		Name:         types.PluginOracleDB,
+		Description:  "Oracle Database metrics from custom SQL, like oracledb_exporter",
+		TargetFormat: "ip:port/service, e.g. 10.99.1.107:1521/xe",
+		Config:       &Config{},
+	}
+}
+
 func (*OracleDB) ParseConfig(baseDir string, bs []byte) (any, error) {
 	var c Config
 	err := toml.Unmarshal(bs, &c)
@@ -0,0 +1,309 @@
+package plugins
+
+import (
+	"context"
+	"encoding"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/secret"
+)
+
+// Target labels set by service discovery or relabeling to override the plugin options of a single target,
+// e.g. the credentials of each instance from CMDB. They are removed from the scraped series.
+const (
+	// TargetLabelUser overrides the `user` or `username` option
+	TargetLabelUser = "__cprobe_user"
+	// TargetLabelPasswordRef overrides the `password` option, it may be a secret reference such as ${vault:path#key}
+	TargetLabelPasswordRef = "__cprobe_password_ref"
+	// TargetLabelParamPrefix + <key> overrides the option <key>, e.g. __param_timeout
+	TargetLabelParamPrefix = "__param_"
+)
+
+// DefaultTargetParams are the options of every plugin which can be overridden per target,
+// the plugins allow more by Description.TargetParams
+var DefaultTargetParams = []string{"user", "username", "password"}
+
+// 这些选项决定了执行什么命令，target 可能来自 http_sd 或者 CMDB，绝对不能让它们改
+var forbiddenTargetParams = map[string]struct{}{
+	"command": {},
+	"args":    {},
+	"env":     {},
+}
+
+// IsTargetParamLabel returns true if the target label name overrides a plugin option
+func IsTargetParamLabel(name string) bool {
+	return name == TargetLabelUser || name == TargetLabelPasswordRef || strings.HasPrefix(name, TargetLabelParamPrefix)
+}
+
+// TargetParamFromLabel returns the option key overridden by the target label name
+func TargetParamFromLabel(name string) (string, bool) {
+	switch {
+	case name == TargetLabelUser:
+		return "user", true
+	case name == TargetLabelPasswordRef:
+		return "password", true
+	case strings.HasPrefix(name, TargetLabelParamPrefix) && len(name) > len(TargetLabelParamPrefix):
+		return name[len(TargetLabelParamPrefix):], true
+	default:
+		return "", false
+	}
+}
+
+type targetParamsKey struct{}
+
+// WithTargetParams returns a copy of ctx carrying the per-target option overrides, key is the toml key
+func WithTargetParams(ctx context.Context, params map[string]string) context.Context {
+	return context.WithValue(ctx, targetParamsKey{}, params)
+}
+
+// TargetParams returns the per-target option overrides passed to Plugin.Scrape, nil if there are none.
+// They are already applied to cfg by the scheduler unless the plugin implements RawTargetParams.
+func TargetParams(ctx context.Context) map[string]string {
+	params, _ := ctx.Value(targetParamsKey{}).(map[string]string)
+	return params
+}
+
+type targetLabelsKey struct{}
+
+// WithTargetLabels returns a copy of ctx carrying the labels of the target, which are attached to the scraped series
+func WithTargetLabels(ctx context.Context, labels map[string]string) context.Context {
+	return context.WithValue(ctx, targetLabelsKey{}, labels)
+}
+
+// TargetLabels returns the labels of the target passed to Plugin.Scrape, the ones starting with __ are not included
+func TargetLabels(ctx context.Context) map[string]string {
+	labels, _ := ctx.Value(targetLabelsKey{}).(map[string]string)
+	return labels
+}
+
+// RawTargetParams is implemented by the plugins whose config can't be overridden by ApplyTargetParams,
+// e.g. external plugins, they read the checked params by TargetParams(ctx) instead
+type RawTargetParams interface {
+	RawTargetParams()
+}
+
+// CheckTargetParams returns an error if any of params can't be overridden per target for the plugin,
+// only DefaultTargetParams and Description.TargetParams are allowed, command, args and env never are.
+func CheckTargetParams(pluginName string, params map[string]string) error {
+	d, _ := Describe(pluginName)
+
+	for _, key := range sortedKeys(params) {
+		if _, ok := forbiddenTargetParams[key]; ok {
+			return fmt.Errorf("option %q can never be overridden per target", key)
+		}
+		if !slices.Contains(DefaultTargetParams, key) && !slices.Contains(d.TargetParams, key) {
+			return fmt.Errorf("option %q can't be overridden per target, allowed: %s", key,
+				strings.Join(append(append([]string(nil), DefaultTargetParams...), d.TargetParams...), ", "))
+		}
+	}
+
+	return nil
+}
+
+func sortedKeys(params map[string]string) []string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// 不同插件的用户名 key 不一样，user 找不到的时候试试 username
+var paramAliases = map[string][]string{
+	"user": {"username"},
+}
+
+// ApplyTargetParams sets the options of cfg, which must be a pointer to the plugin config, by toml key.
+// The shallowest field with the key wins, e.g. `user` of mysql is in the [global] table.
+// Values are parsed like toml does: encoding.TextUnmarshaler, strings, bools, numbers, durations
+// and comma separated string lists. The values of secret.Secret options are resolved by secret.ResolveTargetValue,
+// so the target labels can't run commands or read local files by ${exec:...} or ${file:...}.
+// The nested structs referenced by pointers are copied before they are modified, so cfg may be
+// a shallow copy from ConfigCloner.
+func ApplyTargetParams(cfg any, params map[string]string) error {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return fmt.Errorf("BUG: plugin config must be a non-nil pointer, got %T", cfg)
+	}
+
+	for _, key := range sortedKeys(params) {
+		if _, ok := forbiddenTargetParams[key]; ok {
+			return fmt.Errorf("option %q can never be overridden per target", key)
+		}
+
+		path, ok := findTOMLField(v.Elem(), key)
+		for _, alias := range paramAliases[key] {
+			if ok {
+				break
+			}
+			path, ok = findTOMLField(v.Elem(), alias)
+		}
+		if !ok {
+			return fmt.Errorf("cannot override option %q: no such option", key)
+		}
+
+		// 不要把值放到错误信息里，可能是密码
+		if err := setFieldFromString(fieldByPath(v.Elem(), path), params[key]); err != nil {
+			return fmt.Errorf("cannot override option %q: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// findTOMLField walks the struct breadth first and returns the index path of the field,
+// slices and maps aren't walked
+func findTOMLField(root reflect.Value, key string) ([]int, bool) {
+	type node struct {
+		v    reflect.Value
+		path []int
+	}
+
+	queue := []node{{v: root}}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+
+		if n.v.Kind() != reflect.Struct {
+			continue
+		}
+
+		t := n.v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+
+			name, _, _ := strings.Cut(f.Tag.Get("toml"), ",")
+			if name == "-" {
+				continue
+			}
+
+			path := append(append([]int(nil), n.path...), i)
+
+			fv := n.v.Field(i)
+			if name == key || (name == "" && !f.Anonymous && strings.EqualFold(f.Name, key)) {
+				return path, true
+			}
+
+			if fv.Kind() == reflect.Pointer {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				queue = append(queue, node{v: fv, path: path})
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// fieldByPath returns the field at path, the structs on the way referenced by pointers are
+// replaced with copies, so the config shared by other targets isn't touched
+func fieldByPath(v reflect.Value, path []int) reflect.Value {
+	for i, idx := range path {
+		v = v.Field(idx)
+		if i == len(path)-1 {
+			break
+		}
+		if v.Kind() == reflect.Pointer {
+			cp := reflect.New(v.Type().Elem())
+			cp.Elem().Set(v.Elem())
+			v.Set(cp)
+			v = cp.Elem()
+		}
+	}
+	return v
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func setFieldFromString(field reflect.Value, s string) error {
+	if field.Kind() == reflect.Pointer {
+		// 指向的值可能被其他 target 共享，总是新建一个
+		np := reflect.New(field.Type().Elem())
+		field.Set(np)
+		field = np.Elem()
+	}
+
+	if field.Type() == secretType {
+		// 不能走 Secret.UnmarshalText，它会用所有的 provider 解析
+		v, err := secret.ResolveTargetValue(s)
+		if err != nil {
+			return err
+		}
+		field.SetString(v)
+		return nil
+	}
+
+	if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("cannot parse bool")
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if field.Type() == durationType {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return fmt.Errorf("cannot parse duration")
+			}
+			field.SetInt(int64(d))
+			return nil
+		}
+		n, err := strconv.ParseInt(s, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("cannot parse integer")
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("cannot parse unsigned integer")
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("cannot parse float")
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported option type %s", field.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		slice := reflect.MakeSlice(field.Type(), len(items), len(items))
+		for i, item := range items {
+			slice.Index(i).SetString(item)
+		}
+		field.Set(slice)
+	default:
+		return fmt.Errorf("unsupported option type %s", field.Type())
+	}
+
+	return nil
+}
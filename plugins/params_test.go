@@ -0,0 +1,230 @@
+package plugins
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/secret"
+	"github.com/cprobe/cprobe/types"
+)
+
+func TestApplyTargetParams(t *testing.T) {
+	type global struct {
+		User     string        `toml:"user"`
+		Password secret.Secret `toml:"password"`
+	}
+	type config struct {
+		Global   *global       `toml:"global"`
+		Username string        `toml:"username"`
+		Timeout  time.Duration `toml:"timeout"`
+		Port     int           `toml:"port"`
+		Insecure bool          `toml:"insecure"`
+		Scrapers []string      `toml:"scrapers"`
+		Ratio    *float64      `toml:"ratio"`
+	}
+
+	c := &config{Global: &global{User: "root", Password: "old"}}
+	err := ApplyTargetParams(c, map[string]string{
+		"user":     "alice",
+		"password": "new",
+		"timeout":  "3s",
+		"port":     "3307",
+		"insecure": "true",
+		"scrapers": "a, b,,c",
+		"ratio":    "0.5",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ratio := 0.5
+	expected := &config{
+		// the shallowest user wins, username is only an alias
+		Global:   &global{User: "alice", Password: "new"},
+		Timeout:  3 * time.Second,
+		Port:     3307,
+		Insecure: true,
+		Scrapers: []string{"a", "b", "c"},
+		Ratio:    &ratio,
+	}
+	if !reflect.DeepEqual(c, expected) {
+		t.Fatalf("unexpected config\ngot  %+v %+v\nwant %+v %+v", c, c.Global, expected, expected.Global)
+	}
+
+	// user falls back to username
+	type pgConfig struct {
+		Username string `toml:"username"`
+	}
+	pc := &pgConfig{}
+	if err = ApplyTargetParams(pc, map[string]string{"user": "bob"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if pc.Username != "bob" {
+		t.Fatalf("unexpected username: %q", pc.Username)
+	}
+
+	for _, params := range []map[string]string{
+		{"unknown": "x"},
+		{"port": "abc"},
+		{"timeout": "3"},
+	} {
+		if err = ApplyTargetParams(&config{}, params); err == nil {
+			t.Fatalf("expecting error for %v", params)
+		}
+	}
+
+	if err = ApplyTargetParams(config{}, map[string]string{"port": "1"}); err == nil {
+		t.Fatalf("expecting error for non-pointer config")
+	}
+
+	type execConfig struct {
+		Command string   `toml:"command"`
+		Args    []string `toml:"args"`
+	}
+	for _, key := range []string{"command", "args"} {
+		if err = ApplyTargetParams(&execConfig{}, map[string]string{key: "/bin/sh"}); err == nil {
+			t.Fatalf("expecting error for overriding %s", key)
+		}
+	}
+}
+
+func TestApplyTargetParamsSecretProviders(t *testing.T) {
+	type config struct {
+		Password secret.Secret `toml:"password"`
+	}
+
+	pwned := filepath.Join(t.TempDir(), "pwned")
+	file := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(file, []byte("123456"), 0o600); err != nil {
+		t.Fatalf("cannot write file: %s", err)
+	}
+
+	// target labels come from service discovery, they can't run commands or read local files
+	for _, v := range []string{"${exec:touch " + pwned + "}", "${file:" + file + "}", "x${exec:touch " + pwned + "}y"} {
+		c := &config{Password: "old"}
+		if err := ApplyTargetParams(c, map[string]string{"password": v}); err == nil {
+			t.Fatalf("expecting error for %q, got password %q", v, c.Password.Value())
+		}
+	}
+	if _, err := os.Stat(pwned); err == nil {
+		t.Fatalf("the command of the target label was run")
+	}
+
+	// the allowed providers are resolved, unknown providers are kept as is
+	f := flag.Lookup("secret.targetProviders")
+	defer func(v string) { _ = f.Value.Set(v) }(f.Value.String())
+	if err := f.Value.Set("vault,testvault"); err != nil {
+		t.Fatalf("cannot set -secret.targetProviders: %s", err)
+	}
+	secret.RegisterProvider("testvault", func(ref string) (string, error) {
+		return "from-vault:${exec:touch " + pwned + "}", nil
+	})
+	c := &config{}
+	if err := ApplyTargetParams(c, map[string]string{"password": "${testvault:secret/mysql#password}${other:x}"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// the secret from vault isn't resolved again
+	if c.Password.Value() != "from-vault:${exec:touch "+pwned+"}${other:x}" {
+		t.Fatalf("unexpected password: %q", c.Password.Value())
+	}
+	if _, err := os.Stat(pwned); err == nil {
+		t.Fatalf("the command in the secret from vault was run")
+	}
+}
+
+type checkParamsPlugin struct{}
+
+func (checkParamsPlugin) ParseConfig(string, []byte) (any, error) { return nil, nil }
+func (checkParamsPlugin) Scrape(context.Context, string, any, *types.Samples) error {
+	return nil
+}
+func (checkParamsPlugin) Describe() Description {
+	return Description{TargetParams: []string{"database", "command"}}
+}
+
+func TestCheckTargetParams(t *testing.T) {
+	RegisterPlugin("check_params_test", checkParamsPlugin{})
+
+	f := func(params map[string]string, ok bool) {
+		t.Helper()
+		err := CheckTargetParams("check_params_test", params)
+		if ok && err != nil {
+			t.Fatalf("unexpected error for %v: %s", params, err)
+		}
+		if !ok && err == nil {
+			t.Fatalf("expecting error for %v", params)
+		}
+	}
+
+	f(map[string]string{"user": "alice", "password": "x", "database": "db1"}, true)
+	f(map[string]string{"timeout": "3s"}, false)
+	// never allowed even if the plugin says so
+	f(map[string]string{"command": "/bin/sh"}, false)
+	f(map[string]string{"env": "A=1"}, false)
+
+	if err := CheckTargetParams("no_such_plugin", map[string]string{"database": "db1"}); err == nil {
+		t.Fatalf("expecting error for unknown plugin")
+	}
+}
+
+func TestTargetParamFromLabel(t *testing.T) {
+	f := func(name, key string, ok bool) {
+		t.Helper()
+		k, o := TargetParamFromLabel(name)
+		if k != key || o != ok {
+			t.Fatalf("unexpected result for %q: %q %v", name, k, o)
+		}
+	}
+
+	f("__cprobe_user", "user", true)
+	f("__cprobe_password_ref", "password", true)
+	f("__param_ssl_ca", "ssl_ca", true)
+	f("__param_", "", false)
+	f("__address__", "", false)
+	f("instance", "", false)
+
+	// removed from the series even if it doesn't override anything
+	if !IsTargetParamLabel("__param_") || IsTargetParamLabel("__address__") {
+		t.Fatalf("unexpected IsTargetParamLabel result")
+	}
+
+	params := map[string]string{"user": "alice"}
+	if got := TargetParams(WithTargetParams(context.Background(), params)); !reflect.DeepEqual(got, params) {
+		t.Fatalf("unexpected params from context: %v", got)
+	}
+	if got := TargetParams(context.Background()); got != nil {
+		t.Fatalf("unexpected params from empty context: %v", got)
+	}
+}
+
+func TestApplyTargetParamsSharedConfig(t *testing.T) {
+	type global struct {
+		User string `toml:"user"`
+	}
+	type config struct {
+		Global *global  `toml:"global"`
+		Ratio  *float64 `toml:"ratio"`
+		Tags   []string `toml:"tags"`
+	}
+
+	ratio := 0.5
+	shared := &config{Global: &global{User: "root"}, Ratio: &ratio, Tags: []string{"a"}}
+
+	// a shallow copy like ConfigCloner implementations do
+	c := *shared
+	if err := ApplyTargetParams(&c, map[string]string{"user": "alice", "ratio": "1", "tags": "b"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if c.Global.User != "alice" || *c.Ratio != 1 || c.Tags[0] != "b" {
+		t.Fatalf("unexpected config: %+v %+v", c, c.Global)
+	}
+	if shared.Global.User != "root" || *shared.Ratio != 0.5 || shared.Tags[0] != "a" {
+		t.Fatalf("shared config was modified: %+v %+v", shared, shared.Global)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/secret"
 	"github.com/cprobe/cprobe/plugins/postgres/collector"
 	"github.com/cprobe/cprobe/plugins/postgres/dsn"
 	"github.com/cprobe/cprobe/types"
@@ -13,7 +14,7 @@ import (
 type Config struct {
 	BaseDir                string            `toml:"-"`
 	Username               string            `toml:"username"`
-	Password               string            `toml:"password"`
+	Password               secret.Secret     `toml:"password"`
 	Options                map[string]string `toml:"options"`
 	DisableDefaultMetrics  bool              `toml:"disable_default_metrics"`
 	DisableSettingsMetrics bool              `toml:"disable_settings_metrics"`
@@ -25,7 +26,7 @@ func (c *Config) ConfigureTarget(target string) (dsn.DSN, error) {
 	if err != nil {
 		return dsn.DSN{}, err
 	}
-	d.SetUserAndOptions(c.Username, c.Password, c.Options)
+	d.SetUserAndOptions(c.Username, c.Password.Value(), c.Options)
 	return d, nil
 }
 
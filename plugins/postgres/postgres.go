@@ -14,6 +14,17 @@ func init() {
 
 type Postgres struct{}
 
+// Describe implements plugins.Describer
+func (*Postgres) Describe() plugins.Description {
+	return plugins.Description{
+		Name:         types.PluginPostgres,
+		Description:  "PostgreSQL metrics, like postgres_exporter, with custom SQL queries",
+		TargetFormat: "ip:port, e.g. 127.0.0.1:5432",
+		Config:       &Config{},
+		Metrics:      []string{"pg_up"},
+	}
+}
+
 func (*Postgres) ParseConfig(baseDir string, bs []byte) (any, error) {
 	var c Config
 	err := toml.Unmarshal(bs, &c)
@@ -4,37 +4,51 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/alecthomas/units"
 	"github.com/cprobe/cprobe/lib/clienttls"
 	"github.com/cprobe/cprobe/lib/httpproxy"
 	"github.com/cprobe/cprobe/lib/netutil"
+	"github.com/cprobe/cprobe/lib/secret"
 	"github.com/cprobe/cprobe/types"
 	"github.com/pkg/errors"
 )
 
 type Config struct {
-	BaseDir              string   `toml:"-"`
-	Namespace            string   `toml:"namespace"`
-	BasicAuthUser        string   `toml:"basic_auth_user"`
-	BasicAuthPass        string   `toml:"basic_auth_pass"`
-	Headers              []string `toml:"headers"`
-	ConnectTimeoutMillis int64    `toml:"connect_timeout_millis"`
-	RequestTimeoutMillis int64    `toml:"request_timeout_millis"`
-	MaxIdleConnsPerHost  int      `toml:"max_idle_conns_per_host"`
-	ProxyURL             string   `toml:"proxy_url"`
-	Interface            string   `toml:"interface"`
-	FollowRedirects      bool     `toml:"follow_redirects"`
-	Method               string   `toml:"method"`
-	Payload              string   `toml:"payload"`
-	BearerToken          string   `toml:"bearer_token"`
-	BearerTokeFile       string   `toml:"bearer_token_file"`
-	SplitBody            bool     `toml:"split_body"`
+	BaseDir              string        `toml:"-"`
+	Namespace            string        `toml:"namespace"`
+	BasicAuthUser        string        `toml:"basic_auth_user"`
+	BasicAuthPass        secret.Secret `toml:"basic_auth_pass"`
+	Headers              []string      `toml:"headers"`
+	ConnectTimeoutMillis int64         `toml:"connect_timeout_millis"`
+	RequestTimeoutMillis int64         `toml:"request_timeout_millis"`
+	MaxIdleConnsPerHost  int           `toml:"max_idle_conns_per_host"`
+	ProxyURL             string        `toml:"proxy_url"`
+	Interface            string        `toml:"interface"`
+	FollowRedirects      bool          `toml:"follow_redirects"`
+	Method               string        `toml:"method"`
+	Payload              string        `toml:"payload"`
+	BearerToken          secret.Secret `toml:"bearer_token"`
+	BearerTokeFile       string        `toml:"bearer_token_file"`
+	SplitBody            bool          `toml:"split_body"`
+
+	// federation mode, enabled if match is not empty
+	Match           []string `toml:"match"`
+	HonorLabels     bool     `toml:"honor_labels"`
+	HonorTimestamps bool     `toml:"honor_timestamps"`
+
+	// parse the body line by line instead of building the whole metric families in memory
+	StreamParse   bool             `toml:"stream_parse"`
+	SampleLimit   int              `toml:"sample_limit"`
+	BodySizeLimit units.Base2Bytes `toml:"body_size_limit"`
 
 	clienttls.ClientConfig
 }
@@ -125,7 +139,7 @@ func (cfg *Config) fillHeaders(req *http.Request) error {
 	}
 
 	if cfg.BasicAuthUser != "" && cfg.BasicAuthPass != "" {
-		req.SetBasicAuth(cfg.BasicAuthUser, cfg.BasicAuthPass)
+		req.SetBasicAuth(cfg.BasicAuthUser, cfg.BasicAuthPass.Value())
 	}
 
 	if cfg.BearerToken == "" && cfg.BearerTokeFile != "" {
@@ -137,11 +151,11 @@ func (cfg *Config) fillHeaders(req *http.Request) error {
 		if err != nil {
 			return fmt.Errorf("read bearer token file failed, path: %s", tokenFilePath)
 		}
-		cfg.BearerToken = strings.TrimSpace(string(bs))
+		cfg.BearerToken = secret.Secret(strings.TrimSpace(string(bs)))
 	}
 
 	if cfg.BearerToken != "" {
-		req.Header.Set("Authorization", "Bearer "+cfg.BearerToken)
+		req.Header.Set("Authorization", "Bearer "+cfg.BearerToken.Value())
 	}
 
 	return nil
@@ -160,6 +174,14 @@ func (cfg *Config) Scrape(ctx context.Context, target string, ss *types.Samples)
 		payload = strings.NewReader(cfg.Payload)
 	}
 
+	if len(cfg.Match) > 0 {
+		federateURL, err := cfg.federateURL(target)
+		if err != nil {
+			return errors.WithMessagef(err, "build federate url failed, target: %s", target)
+		}
+		target = federateURL
+	}
+
 	req, err := http.NewRequest(cfg.Method, target, payload)
 	if err != nil {
 		return errors.WithMessagef(err, "new request failed, target: %s", target)
@@ -182,14 +204,103 @@ func (cfg *Config) Scrape(ctx context.Context, target string, ss *types.Samples)
 
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	var body io.Reader = resp.Body
+	if cfg.BodySizeLimit > 0 {
+		body = &limitedReader{r: resp.Body, n: int64(cfg.BodySizeLimit)}
+	}
+
+	if cfg.StreamParse || len(cfg.Match) > 0 {
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("unexpected status code %d, target: %s", resp.StatusCode, target)
+		}
+
+		// the streaming parser only understands the text format
+		if !isProtobuf(resp.Header) {
+			if err := ss.AddMetricsStream(body, cfg.streamParseOptions()); err != nil {
+				return errors.WithMessagef(err, "parse response failed, target: %s", target)
+			}
+			return nil
+		}
+	}
+
+	bs, err := io.ReadAll(body)
 	if err != nil {
 		return errors.WithMessagef(err, "read response body failed, target: %s", target)
 	}
 
-	if err := ss.AddMetricsBody(body, resp.Header, cfg.SplitBody); err != nil {
+	before := ss.Len()
+	if err := ss.AddMetricsBody(bs, resp.Header, cfg.SplitBody); err != nil {
 		return errors.WithMessagef(err, "parse response failed, target: %s", target)
 	}
 
+	if cfg.SampleLimit > 0 && ss.Len()-before > cfg.SampleLimit {
+		return fmt.Errorf("%w: more than %d samples, target: %s", types.ErrSampleLimitExceeded, cfg.SampleLimit, target)
+	}
+
 	return nil
 }
+
+// federateURL appends match[] selectors to target, /federate is used if target has no path.
+func (cfg *Config) federateURL(target string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/federate"
+	}
+
+	q := u.Query()
+	for _, m := range cfg.Match {
+		q.Add("match[]", m)
+	}
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+func (cfg *Config) streamParseOptions() *types.StreamParseOptions {
+	opts := &types.StreamParseOptions{
+		HonorTimestamps: cfg.HonorTimestamps,
+		SampleLimit:     cfg.SampleLimit,
+		// 超过 body_size_limit 的时候本次抓取失败，不能先把一部分数据发出去
+		KeepAll: cfg.BodySizeLimit > 0,
+	}
+
+	if len(cfg.Match) > 0 && !cfg.HonorLabels {
+		// keep job and instance of cprobe, the upstream ones become exported_job and exported_instance
+		opts.ConflictLabels = []string{"job", "instance"}
+	}
+
+	return opts
+}
+
+func isProtobuf(header http.Header) bool {
+	mediatype, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && mediatype == "application/vnd.google.protobuf"
+}
+
+// limitedReader fails instead of silently truncating the body like io.LimitReader does.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if lr.n <= 0 {
+		var b [1]byte
+		if n, _ := lr.r.Read(b[:]); n > 0 {
+			return 0, fmt.Errorf("response body exceeds body_size_limit")
+		}
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > lr.n {
+		p = p[:lr.n]
+	}
+
+	n, err := lr.r.Read(p)
+	lr.n -= int64(n)
+	return n, err
+}
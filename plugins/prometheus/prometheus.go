@@ -14,6 +14,16 @@ func init() {
 
 type Prometheus struct{}
 
+// Describe implements plugins.Describer
+func (*Prometheus) Describe() plugins.Description {
+	return plugins.Description{
+		Name:         types.PluginPrometheus,
+		Description:  "Scrape Prometheus or OpenMetrics endpoints",
+		TargetFormat: "http url of the metrics endpoint, e.g. http://127.0.0.1:8080/metrics",
+		Config:       &Config{},
+	}
+}
+
 func (*Prometheus) ParseConfig(baseDir string, bs []byte) (any, error) {
 	var c Config
 	err := toml.Unmarshal(bs, &c)
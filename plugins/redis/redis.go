@@ -10,6 +10,7 @@ import (
 
 	"github.com/BurntSushi/toml"
 	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/secret"
 	"github.com/cprobe/cprobe/plugins"
 	"github.com/cprobe/cprobe/plugins/redis/exporter"
 	"github.com/cprobe/cprobe/types"
@@ -20,7 +21,7 @@ import (
 type Config struct {
 	BaseDir           string        `toml:"-"`
 	User              string        `toml:"user"`
-	Password          string        `toml:"password"`
+	Password          secret.Secret `toml:"password"`
 	Namespace         string        `toml:"namespace"`
 	ConnectionTimeout time.Duration `toml:"connection_timeout"`
 	PingOnConnect     bool          `toml:"ping_on_connect"`
@@ -62,6 +63,17 @@ func init() {
 	plugins.RegisterPlugin(types.PluginRedis, &Redis{})
 }
 
+// Describe implements plugins.Describer
+func (*Redis) Describe() plugins.Description {
+	return plugins.Description{
+		Name:         types.PluginRedis,
+		Description:  "Redis metrics, like redis_exporter",
+		TargetFormat: "ip:port, e.g. 127.0.0.1:6379",
+		Config:       &Config{},
+		Metrics:      []string{"redis_up"},
+	}
+}
+
 func (*Redis) ParseConfig(baseDir string, bs []byte) (any, error) {
 	var c Config
 	err := toml.Unmarshal(bs, &c)
@@ -140,7 +152,7 @@ func (*Redis) Scrape(ctx context.Context, target string, c any, ss *types.Sample
 
 	opts := exporter.Options{
 		User:                      conf.User,
-		Password:                  conf.Password,
+		Password:                  conf.Password.Value(),
 		Namespace:                 conf.Namespace,
 		ConnectionTimeout:         conf.ConnectionTimeout,
 		PingOnConnect:             conf.PingOnConnect,
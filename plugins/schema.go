@@ -0,0 +1,253 @@
+package plugins
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/secret"
+)
+
+// Schema is the subset of JSON Schema generated for the rule files
+type Schema struct {
+	Schema      string             `json:"$schema,omitempty"`
+	Title       string             `json:"title,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Type        any                `json:"type,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	// false or *Schema, nil means any property is allowed
+	AdditionalProperties any     `json:"additionalProperties,omitempty"`
+	Items                *Schema `json:"items,omitempty"`
+	WriteOnly            bool    `json:"writeOnly,omitempty"`
+}
+
+var (
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	secretType          = reflect.TypeOf(secret.Secret(""))
+)
+
+// ConfigSchema generates the JSON Schema of the rule files from d.Config, nil if d.Config is nil
+func ConfigSchema(d Description) *Schema {
+	if d.Config == nil {
+		return nil
+	}
+
+	tag := d.ConfigFormat
+	if tag == "" {
+		tag = ConfigFormatTOML
+	}
+
+	g := &schemaGenerator{tag: tag, seen: make(map[reflect.Type]bool)}
+
+	t := reflect.TypeOf(d.Config)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	s := g.structSchema(t)
+	s.Schema = "https://json-schema.org/draft/2020-12/schema"
+	s.Title = d.Name
+	s.Description = d.Description
+	return s
+}
+
+type schemaGenerator struct {
+	tag  string
+	seen map[reflect.Type]bool
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t == secretType {
+		return &Schema{Type: "string", WriteOnly: true}
+	}
+	if t == reflect.TypeOf(time.Duration(0)) {
+		return &Schema{Type: []string{"string", "integer"}, Description: "duration, e.g. 10s"}
+	}
+	if reflect.PointerTo(t).Implements(textUnmarshalerType) {
+		return &Schema{Type: "string"}
+	}
+	if g.opaque(t) {
+		// 自定义了解析逻辑，不知道具体格式
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string"}
+		}
+		return &Schema{Type: "array", Items: g.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+	case reflect.Struct:
+		if g.seen[t] {
+			// recursive types
+			return &Schema{Type: "object"}
+		}
+		g.seen[t] = true
+		defer delete(g.seen, t)
+		return g.structSchema(t)
+	default:
+		return &Schema{}
+	}
+}
+
+// opaque returns true if t has a custom unmarshaler and its format can't be told from the fields.
+// Structs with exported fields are still walked, the unmarshalers of them are mostly the
+// `type plain T` trick which sets the defaults.
+func (g *schemaGenerator) opaque(t reflect.Type) bool {
+	method := "UnmarshalTOML"
+	if g.tag == ConfigFormatYAML {
+		method = "UnmarshalYAML"
+	}
+	if _, ok := reflect.PointerTo(t).MethodByName(method); !ok {
+		return false
+	}
+
+	if t.Kind() != reflect.Struct {
+		return true
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).IsExported() {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) *Schema {
+	s := &Schema{
+		Type:                 "object",
+		Properties:           make(map[string]*Schema),
+		AdditionalProperties: false,
+	}
+	g.addFields(s, t)
+	return s
+}
+
+// addFields adds the fields of struct t to s, the embedded and inline structs are flattened like the decoders do
+func (g *schemaGenerator) addFields(s *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		// 非导出类型的嵌入字段，其导出字段照样会被解析
+		if !f.IsExported() && !f.Anonymous {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(f.Tag.Get(g.tag), ",")
+		if name == "-" {
+			continue
+		}
+
+		inline := (f.Anonymous && name == "") || (g.tag == ConfigFormatYAML && strings.Contains(opts, "inline"))
+		if inline {
+			ft := f.Type
+			for ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct && !g.opaque(ft) {
+				g.addFields(s, ft)
+			} else if f.IsExported() {
+				// 不知道 inline 进来的字段有哪些，只能放开
+				s.AdditionalProperties = nil
+			}
+			continue
+		}
+
+		if name == "" {
+			if g.tag == ConfigFormatYAML {
+				name = strings.ToLower(f.Name)
+			} else {
+				name = f.Name
+			}
+		}
+
+		fs := g.schema(f.Type)
+		if desc := f.Tag.Get("description"); desc != "" {
+			fs.Description = desc
+		}
+		s.Properties[name] = fs
+	}
+}
+
+// UnknownKeys returns the paths of the keys in data which aren't defined by s,
+// data is a rule file decoded into map[string]any. Keys are matched case-insensitively like toml does.
+func UnknownKeys(s *Schema, data any) []string {
+	var ret []string
+	collectUnknownKeys(s, reflect.ValueOf(data), "", &ret)
+	sort.Strings(ret)
+	return ret
+}
+
+func collectUnknownKeys(s *Schema, v reflect.Value, path string, ret *[]string) {
+	if s == nil || !v.IsValid() {
+		return
+	}
+	for v.Kind() == reflect.Interface || v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			key := fmt.Sprint(iter.Key().Interface())
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+
+			if prop := s.property(key); prop != nil {
+				collectUnknownKeys(prop, iter.Value(), keyPath, ret)
+				continue
+			}
+
+			switch ap := s.AdditionalProperties.(type) {
+			case bool:
+				if !ap {
+					*ret = append(*ret, keyPath)
+				}
+			case *Schema:
+				collectUnknownKeys(ap, iter.Value(), keyPath, ret)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if s.Items == nil {
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			collectUnknownKeys(s.Items, v.Index(i), fmt.Sprintf("%s[%d]", path, i), ret)
+		}
+	}
+}
+
+func (s *Schema) property(key string) *Schema {
+	if p, ok := s.Properties[key]; ok {
+		return p
+	}
+	for name, p := range s.Properties {
+		if strings.EqualFold(name, key) {
+			return p
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package plugins
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/cprobe/cprobe/lib/secret"
+)
+
+type schemaTestQuery struct {
+	Mesurement string            `toml:"mesurement" description:"metric name prefix"`
+	Labels     []string          `toml:"label_fields"`
+	Extra      map[string]string `toml:"extra"`
+}
+
+type schemaTestCommon struct {
+	Timeout time.Duration `toml:"timeout"`
+}
+
+type schemaTestConfig struct {
+	BaseDir string `toml:"-"`
+	schemaTestCommon
+	Global struct {
+		User     string        `toml:"user"`
+		Password secret.Secret `toml:"password"`
+		Port     int           `toml:"port"`
+		Enabled  *bool         `toml:"enabled"`
+	} `toml:"global"`
+	Queries []schemaTestQuery `toml:"queries"`
+	Any     interface{}       `toml:"any"`
+}
+
+func TestConfigSchema(t *testing.T) {
+	s := ConfigSchema(Description{Name: "test", Config: &schemaTestConfig{}})
+
+	bs, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("cannot marshal schema: %s", err)
+	}
+
+	expected := `{"$schema":"https://json-schema.org/draft/2020-12/schema","title":"test","type":"object",` +
+		`"properties":{"any":{},` +
+		`"global":{"type":"object","properties":{"enabled":{"type":"boolean"},"password":{"type":"string","writeOnly":true},"port":{"type":"integer"},"user":{"type":"string"}},"additionalProperties":false},` +
+		`"queries":{"type":"array","items":{"type":"object","properties":{"extra":{"type":"object","additionalProperties":{"type":"string"}},"label_fields":{"type":"array","items":{"type":"string"}},"mesurement":{"description":"metric name prefix","type":"string"}},"additionalProperties":false}},` +
+		`"timeout":{"description":"duration, e.g. 10s","type":["string","integer"]}},` +
+		`"additionalProperties":false}`
+	if string(bs) != expected {
+		t.Fatalf("unexpected schema\ngot  %s\nwant %s", bs, expected)
+	}
+
+	if ConfigSchema(Description{Name: "nil"}) != nil {
+		t.Fatalf("expecting nil schema for nil config")
+	}
+}
+
+func TestUnknownKeys(t *testing.T) {
+	s := ConfigSchema(Description{Name: "test", Config: &schemaTestConfig{}})
+
+	f := func(data string, expected []string) {
+		t.Helper()
+		var m map[string]any
+		if err := toml.Unmarshal([]byte(data), &m); err != nil {
+			t.Fatalf("cannot parse toml: %s", err)
+		}
+		keys := UnknownKeys(s, m)
+		if !reflect.DeepEqual(keys, expected) {
+			t.Fatalf("unexpected unknown keys for %q: got %v, want %v", data, keys, expected)
+		}
+	}
+
+	f(`timeout = "3s"
+[global]
+User = "root"
+password = "x"
+[[queries]]
+mesurement = "m"
+[queries.extra]
+a = "b"
+`, nil)
+
+	f(`timeot = "3s"
+[global]
+usr = "root"
+[[queries]]
+mesurement = "m"
+measurement = "m"
+[any.whatever]
+x = 1
+`, []string{"global.usr", "queries[0].measurement", "timeot"})
+}
@@ -14,6 +14,16 @@ func init() {
 
 type Tomcat struct{}
 
+// Describe implements plugins.Describer
+func (*Tomcat) Describe() plugins.Description {
+	return plugins.Description{
+		Name:         types.PluginTomcat,
+		Description:  "Tomcat metrics from the manager status page",
+		TargetFormat: "ip:port, e.g. 127.0.0.1:8080",
+		Config:       &Config{},
+	}
+}
+
 func (*Tomcat) ParseConfig(baseDir string, bs []byte) (any, error) {
 	var c Config
 	err := toml.Unmarshal(bs, &c)
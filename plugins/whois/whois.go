@@ -24,6 +24,16 @@ func init() {
 	plugins.RegisterPlugin(types.PluginWhois, &Whois{})
 }
 
+// Describe implements plugins.Describer
+func (wh *Whois) Describe() plugins.Description {
+	return plugins.Description{
+		Name:         types.PluginWhois,
+		Description:  "Domain expiration from whois",
+		TargetFormat: "domain, e.g. example.com",
+		Metrics:      []string{"whois_domain_expiration"},
+	}
+}
+
 func (wh *Whois) ParseConfig(baseDir string, bs []byte) (any, error) {
 	return nil, nil
 }
@@ -29,6 +29,16 @@ func init() {
 	plugins.RegisterPlugin(types.PluginZookeeper, &Zookeeper{})
 }
 
+// Describe implements plugins.Describer
+func (f *Zookeeper) Describe() plugins.Description {
+	return plugins.Description{
+		Name:         types.PluginZookeeper,
+		Description:  "ZooKeeper metrics from the four letter word commands",
+		TargetFormat: "ip:port, e.g. 127.0.0.1:2181",
+		Config:       &Config{},
+	}
+}
+
 func (f *Zookeeper) ParseConfig(baseDir string, bs []byte) (any, error) {
 	var c Config
 	//fmt.Printf("zk: %s\n", string(bs))
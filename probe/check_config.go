@@ -0,0 +1,115 @@
+package probe
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+	"github.com/cprobe/cprobe/plugins"
+	"github.com/cprobe/cprobe/plugins/external"
+	"gopkg.in/yaml.v2"
+)
+
+// CheckConfig parses all the main*.yaml and rule files under configDirectory like Start does,
+// and returns the problems found, including the unknown keys in rule files which the decoders ignore silently.
+// The unknown keys are found only for the plugins implementing plugins.Describer.
+func CheckConfig(configDirectory string) ([]string, error) {
+	pluginDirs, err := listPlugins(configDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = external.Load(configDirectory, pluginDirs); err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for _, pluginName := range pluginDirs {
+		plugin, has := plugins.GetPlugin(pluginName)
+		if !has {
+			problems = append(problems, fmt.Sprintf("%s: unknown plugin", pluginName))
+			continue
+		}
+
+		desc, _ := plugins.Describe(pluginName)
+		schema := plugins.ConfigSchema(desc)
+
+		pluginDirPath := filepath.Join(configDirectory, pluginName)
+		entryYamlFilePaths, err := filepath.Glob(filepath.Join(pluginDirPath, "main*.yaml"))
+		if err != nil {
+			return nil, fmt.Errorf("cannot glob main*.yaml under %s: %s", pluginDirPath, err)
+		}
+
+		for _, entryYamlFilePath := range entryYamlFilePaths {
+			cfg, err := loadConfig(entryYamlFilePath)
+			if err != nil {
+				problems = append(problems, err.Error())
+				continue
+			}
+
+			for _, sc := range cfg.ScrapeConfigs {
+				if sc == nil {
+					continue
+				}
+
+				prefix := fmt.Sprintf("%s job(%s)", entryYamlFilePath, sc.JobName)
+
+				// 每个 rule 文件单独检查，这样能告诉用户是哪个文件里的 key 不对
+				broken := false
+				for _, ruleFile := range sc.ScrapeRuleFiles {
+					data, err := readRuleFiles(cfg.BaseDir, []string{ruleFile})
+					if err != nil {
+						problems = append(problems, fmt.Sprintf("%s %s", prefix, err))
+						broken = true
+						continue
+					}
+
+					if schema == nil {
+						continue
+					}
+
+					keys, err := unknownRuleKeys(schema, desc.ConfigFormat, data)
+					if err != nil {
+						problems = append(problems, fmt.Sprintf("%s cannot parse rule file(%s): %s", prefix, ruleFile, err))
+						broken = true
+						continue
+					}
+					for _, key := range keys {
+						problems = append(problems, fmt.Sprintf("%s rule file(%s): unknown key %q", prefix, ruleFile, key))
+					}
+				}
+
+				if broken {
+					continue
+				}
+
+				tomlBytes, err := readRuleFiles(cfg.BaseDir, sc.ScrapeRuleFiles)
+				if err != nil {
+					problems = append(problems, fmt.Sprintf("%s %s", prefix, err))
+					continue
+				}
+
+				if _, err = plugin.ParseConfig(cfg.BaseDir, tomlBytes); err != nil {
+					problems = append(problems, fmt.Sprintf("%s parse plugin config error: %s", prefix, err))
+				}
+			}
+		}
+	}
+
+	return problems, nil
+}
+
+func unknownRuleKeys(schema *plugins.Schema, format string, data []byte) ([]string, error) {
+	var m map[string]any
+	var err error
+	if format == plugins.ConfigFormatYAML {
+		err = yaml.Unmarshal(data, &m)
+	} else {
+		err = toml.Unmarshal(data, &m)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return plugins.UnknownKeys(schema, m), nil
+}
@@ -85,7 +85,10 @@ type ScrapeConfig struct {
 	ParsedRelabelConfigs       *promrelabel.ParsedConfigs `yaml:"-"`
 	ParsedMetricRelabelConfigs *promrelabel.ParsedConfigs `yaml:"-"`
 
-	// SampleLimit          int                         `yaml:"sample_limit,omitempty"`
+	// SampleLimit rejects the whole scrape of a target if it produces more samples after metric relabeling
+	SampleLimit int `yaml:"sample_limit,omitempty"`
+	// SeriesLimit drops new series of the job beyond the limit during an hour
+	SeriesLimit int `yaml:"series_limit,omitempty"`
 
 	AzureSDConfigs        []azure.SDConfig        `yaml:"azure_sd_configs,omitempty"`
 	DigitaloceanSDConfigs []digitalocean.SDConfig `yaml:"digitalocean_sd_configs,omitempty"`
@@ -108,7 +111,6 @@ type ScrapeConfig struct {
 	// StreamParse         bool                       `yaml:"stream_parse,omitempty"`
 	// ScrapeAlignInterval *promutils.Duration        `yaml:"scrape_align_interval,omitempty"`
 	// ScrapeOffset        *promutils.Duration        `yaml:"scrape_offset,omitempty"`
-	// SeriesLimit         int                        `yaml:"series_limit,omitempty"`
 	// NoStaleMarkers      *bool                      `yaml:"no_stale_markers,omitempty"`
 	// ProxyClientConfig   promauth.ProxyClientConfig `yaml:",inline"`
 
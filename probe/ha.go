@@ -0,0 +1,141 @@
+package probe
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/cprobe/cprobe/lib/logger"
+)
+
+var (
+	haBackend      = flag.String("ha.backend", "", "Lock backend for active/standby HA. One of: {file|consul|redis}. Only the instance holding the lock scrapes targets. HA is disabled if empty")
+	haKey          = flag.String("ha.key", "cprobe/leader", "The lock key shared by the cprobe instances of the same HA group")
+	haLeaseTimeout = flag.Duration("ha.leaseTimeout", 15*time.Second, "The standby instance takes over if the active one doesn't renew the lock during this time. It doesn't apply to -ha.backend=file, see -ha.file.dir")
+)
+
+// haLocker is a lock backend for leader election
+type haLocker interface {
+	// tryLock acquires the lock, or renews it if it is already held by this instance
+	tryLock(ttl time.Duration) (bool, error)
+	// unlock releases the lock if it is held by this instance
+	unlock()
+}
+
+// haLeaderUntil is the unix nano time until which this instance holds the lock,
+// it's the start of the last successful renewal plus -ha.leaseTimeout
+var haLeaderUntil atomic.Int64
+
+// isLeader returns true if this instance should scrape targets
+func isLeader() bool {
+	return time.Now().UnixNano() < haLeaderUntil.Load()
+}
+
+func newHALocker(backend string) (haLocker, error) {
+	id, err := haInstanceID()
+	if err != nil {
+		return nil, err
+	}
+
+	switch backend {
+	case "file":
+		return newFileLocker()
+	case "consul":
+		return newConsulLocker(*haKey, id)
+	case "redis":
+		return newRedisLocker(*haKey, id)
+	default:
+		return nil, fmt.Errorf("unsupported -ha.backend %q", backend)
+	}
+}
+
+func haInstanceID() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("cannot get hostname: %w", err)
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid()), nil
+}
+
+// startHA 启动选主的 goroutine，没有配置 -ha.backend 的时候总是认为自己是 leader
+func startHA(ctx context.Context) error {
+	if *haBackend == "" {
+		haLeaderUntil.Store(math.MaxInt64)
+		return nil
+	}
+
+	if *haLeaseTimeout < 3*time.Second {
+		return fmt.Errorf("-ha.leaseTimeout must be at least 3s, got %s", *haLeaseTimeout)
+	}
+
+	locker, err := newHALocker(*haBackend)
+	if err != nil {
+		return err
+	}
+
+	_ = metrics.NewGauge(`cprobe_ha_leader`, func() float64 {
+		if isLeader() {
+			return 1
+		}
+		return 0
+	})
+
+	e := &haElector{locker: locker, lease: *haLeaseTimeout}
+	e.renew()
+
+	go func() {
+		// 续约的间隔是 lease 的三分之一，偶尔失败一两次不会丢掉 lock
+		ticker := time.NewTicker(*haLeaseTimeout / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				e.renew()
+			case <-ctx.Done():
+				haLeaderUntil.Store(0)
+				locker.unlock()
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// haElector renews the lock and maintains haLeaderUntil
+type haElector struct {
+	locker    haLocker
+	lease     time.Duration
+	wasLeader bool
+}
+
+func (e *haElector) renew() {
+	// lease 从发出请求的时候开始算，保守一点
+	start := time.Now()
+	held, err := e.locker.tryLock(e.lease)
+	switch {
+	case err != nil:
+		// 续约失败不马上放弃，上次续约成功之后的 lease 内 lock 仍然是自己的，网络抖动不至于触发切换
+		logger.Errorf("cannot acquire ha lock %q via %s: %s", *haKey, *haBackend, err)
+	case held:
+		haLeaderUntil.Store(start.Add(e.lease).UnixNano())
+	default:
+		haLeaderUntil.Store(0)
+	}
+
+	leader := isLeader()
+	if leader != e.wasLeader {
+		if leader {
+			logger.Infof("became the active instance of ha lock %q", *haKey)
+		} else {
+			logger.Infof("became a standby instance of ha lock %q", *haKey)
+		}
+	}
+	e.wasLeader = leader
+}
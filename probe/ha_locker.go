@@ -0,0 +1,186 @@
+package probe
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/fs"
+	"github.com/gomodule/redigo/redis"
+	consul_api "github.com/hashicorp/consul/api"
+)
+
+var (
+	haFileDir       = flag.String("ha.file.dir", "", "Directory for the lock file if -ha.backend=file. It should be on a filesystem shared by all the instances, e.g. NFS. The file lock has no lease, it is held until the active instance exits, so a hung instance isn't taken over")
+	haConsulAddress = flag.String("ha.consul.address", "127.0.0.1:8500", "Consul address if -ha.backend=consul")
+	haConsulToken   = flag.String("ha.consul.token", "", "Consul ACL token if -ha.backend=consul")
+	haRedisAddress  = flag.String("ha.redis.address", "127.0.0.1:6379", "Redis address if -ha.backend=redis")
+	haRedisPassword = flag.String("ha.redis.password", "", "Redis password if -ha.backend=redis")
+)
+
+// fileLocker holds a flock on a file, the lock is released by the OS when the process dies.
+// flock has no expiration, ttl is ignored: the lock is held as long as the file is open,
+// a standby instance takes over only after the active one exits or crashes, not when it hangs.
+// Use consul or redis if a hung instance must be taken over in -ha.leaseTimeout
+type fileLocker struct {
+	dir string
+	f   *os.File
+}
+
+func newFileLocker() (*fileLocker, error) {
+	if *haFileDir == "" {
+		return nil, fmt.Errorf("-ha.file.dir is empty")
+	}
+	fs.MustMkdirIfNotExist(*haFileDir)
+	return &fileLocker{dir: *haFileDir}, nil
+}
+
+func (l *fileLocker) tryLock(_ time.Duration) (bool, error) {
+	if l.f != nil {
+		return true, nil
+	}
+
+	f, err := fs.CreateFlockFile(l.dir)
+	if err != nil {
+		// the lock is held by another instance
+		return false, nil
+	}
+
+	l.f = f
+	return true, nil
+}
+
+func (l *fileLocker) unlock() {
+	if l.f != nil {
+		fs.MustClose(l.f)
+		l.f = nil
+	}
+}
+
+// consulLocker acquires a consul key with a session, the session is invalidated by consul if it isn't renewed in time
+type consulLocker struct {
+	client  *consul_api.Client
+	key     string
+	id      string
+	session string
+}
+
+func newConsulLocker(key, id string) (*consulLocker, error) {
+	conf := consul_api.DefaultConfig()
+	conf.Address = *haConsulAddress
+	conf.Token = *haConsulToken
+
+	client, err := consul_api.NewClient(conf)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create consul client: %w", err)
+	}
+
+	return &consulLocker{client: client, key: key, id: id}, nil
+}
+
+func (l *consulLocker) tryLock(ttl time.Duration) (bool, error) {
+	if l.session != "" {
+		entry, _, err := l.client.Session().Renew(l.session, nil)
+		if err != nil {
+			return false, fmt.Errorf("cannot renew consul session: %w", err)
+		}
+		if entry == nil {
+			// the session is expired, create a new one below
+			l.session = ""
+		}
+	}
+
+	if l.session == "" {
+		session, _, err := l.client.Session().Create(&consul_api.SessionEntry{
+			Name:      "cprobe-" + l.id,
+			TTL:       ttl.String(),
+			Behavior:  consul_api.SessionBehaviorDelete,
+			LockDelay: time.Millisecond,
+		}, nil)
+		if err != nil {
+			return false, fmt.Errorf("cannot create consul session: %w", err)
+		}
+		l.session = session
+	}
+
+	acquired, _, err := l.client.KV().Acquire(&consul_api.KVPair{
+		Key:     l.key,
+		Value:   []byte(l.id),
+		Session: l.session,
+	}, nil)
+	if err != nil {
+		return false, fmt.Errorf("cannot acquire consul key: %w", err)
+	}
+
+	return acquired, nil
+}
+
+func (l *consulLocker) unlock() {
+	if l.session == "" {
+		return
+	}
+	_, _, _ = l.client.KV().Release(&consul_api.KVPair{Key: l.key, Session: l.session}, nil)
+	_, _ = l.client.Session().Destroy(l.session, nil)
+	l.session = ""
+}
+
+// redisLocker holds a redis key created by SET NX PX, only the owner can renew or delete it
+type redisLocker struct {
+	pool *redis.Pool
+	key  string
+	id   string
+}
+
+var (
+	redisRenewScript  = redis.NewScript(1, `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`)
+	redisUnlockScript = redis.NewScript(1, `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`)
+)
+
+func newRedisLocker(key, id string) (*redisLocker, error) {
+	pool := &redis.Pool{
+		MaxIdle:     1,
+		IdleTimeout: time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", *haRedisAddress,
+				redis.DialPassword(*haRedisPassword),
+				redis.DialConnectTimeout(3*time.Second),
+				redis.DialReadTimeout(3*time.Second),
+				redis.DialWriteTimeout(3*time.Second),
+			)
+		},
+	}
+
+	return &redisLocker{pool: pool, key: key, id: id}, nil
+}
+
+func (l *redisLocker) tryLock(ttl time.Duration) (bool, error) {
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	ms := ttl.Milliseconds()
+
+	_, err := redis.String(conn.Do("SET", l.key, l.id, "NX", "PX", ms))
+	if err == nil {
+		return true, nil
+	}
+
+	if !errors.Is(err, redis.ErrNil) {
+		return false, fmt.Errorf("cannot set redis key: %w", err)
+	}
+
+	// the key exists, renew it if it's ours
+	n, err := redis.Int(redisRenewScript.Do(conn, l.key, l.id, ms))
+	if err != nil {
+		return false, fmt.Errorf("cannot renew redis key: %w", err)
+	}
+
+	return n == 1, nil
+}
+
+func (l *redisLocker) unlock() {
+	conn := l.pool.Get()
+	defer conn.Close()
+	_, _ = redisUnlockScript.Do(conn, l.key, l.id)
+}
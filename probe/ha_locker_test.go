@@ -0,0 +1,313 @@
+package probe
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLockers checks that only one of a and b holds the lock, and the other one takes over after unlock
+func testLockers(t *testing.T, a, b haLocker, ttl time.Duration) {
+	t.Helper()
+
+	f := func(l haLocker, name string, expected bool) {
+		t.Helper()
+		held, err := l.tryLock(ttl)
+		if err != nil {
+			t.Fatalf("unexpected error of %s: %s", name, err)
+		}
+		if held != expected {
+			t.Fatalf("unexpected lock state of %s: got %v, want %v", name, held, expected)
+		}
+	}
+
+	f(a, "a", true)
+	f(b, "b", false)
+	// renewal
+	f(a, "a", true)
+	f(b, "b", false)
+
+	a.unlock()
+	f(b, "b", true)
+	f(a, "a", false)
+	b.unlock()
+}
+
+// testLockerExpiry checks that b takes over if a doesn't renew the lock in ttl
+func testLockerExpiry(t *testing.T, a, b haLocker, ttl time.Duration) {
+	t.Helper()
+
+	if held, err := a.tryLock(ttl); err != nil || !held {
+		t.Fatalf("expecting a to hold the lock, got %v, %v", held, err)
+	}
+	time.Sleep(2 * ttl)
+	if held, err := b.tryLock(ttl); err != nil || !held {
+		t.Fatalf("expecting b to take over the expired lock, got %v, %v", held, err)
+	}
+	if held, err := a.tryLock(ttl); err != nil || held {
+		t.Fatalf("expecting a to lose the lock, got %v, %v", held, err)
+	}
+}
+
+func TestFileLocker(t *testing.T) {
+	dir := t.TempDir()
+	a := &fileLocker{dir: dir}
+	b := &fileLocker{dir: dir}
+	defer a.unlock()
+	defer b.unlock()
+
+	// flock conflicts between the open files, even in the same process
+	testLockers(t, a, b, time.Second)
+}
+
+func TestRedisLocker(t *testing.T) {
+	addr := newRedisStub(t)
+	old := *haRedisAddress
+	*haRedisAddress = addr
+	defer func() { *haRedisAddress = old }()
+
+	a, _ := newRedisLocker("cprobe/leader", "a")
+	b, _ := newRedisLocker("cprobe/leader", "b")
+	testLockers(t, a, b, time.Second)
+
+	// the key expires if it isn't renewed
+	c, _ := newRedisLocker("cprobe/leader", "c")
+	d, _ := newRedisLocker("cprobe/leader", "d")
+	testLockerExpiry(t, c, d, 100*time.Millisecond)
+}
+
+func TestConsulLocker(t *testing.T) {
+	addr := newConsulStub(t)
+	old := *haConsulAddress
+	*haConsulAddress = addr
+	defer func() { *haConsulAddress = old }()
+
+	newLocker := func(id string) *consulLocker {
+		t.Helper()
+		l, err := newConsulLocker("cprobe/leader", id)
+		if err != nil {
+			t.Fatalf("cannot create consul locker: %s", err)
+		}
+		return l
+	}
+	testLockers(t, newLocker("a"), newLocker("b"), time.Second)
+
+	// the session expires if it isn't renewed, the key is deleted with it.
+	// The session keeps the ttl it was created with, so the expiry is checked with new lockers
+	testLockerExpiry(t, newLocker("c"), newLocker("d"), 100*time.Millisecond)
+}
+
+// newRedisStub serves SET NX PX and the EVAL of the lock scripts, EVALSHA always replies NOSCRIPT
+func newRedisStub(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	type entry struct {
+		value    string
+		deadline time.Time
+	}
+	var mu sync.Mutex
+	keys := make(map[string]entry)
+	get := func(key string) (entry, bool) {
+		e, ok := keys[key]
+		if ok && time.Now().After(e.deadline) {
+			delete(keys, key)
+			return entry{}, false
+		}
+		return e, ok
+	}
+
+	handle := func(args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch strings.ToUpper(args[0]) {
+		case "SET":
+			// SET key value NX PX ms
+			if _, ok := get(args[1]); ok {
+				return "$-1\r\n"
+			}
+			ms, _ := strconv.Atoi(args[5])
+			keys[args[1]] = entry{value: args[2], deadline: time.Now().Add(time.Duration(ms) * time.Millisecond)}
+			return "+OK\r\n"
+		case "EVALSHA":
+			return "-NOSCRIPT No matching script\r\n"
+		case "EVAL":
+			// EVAL script 1 key id [ms]
+			script, key, id := args[1], args[3], args[4]
+			e, ok := get(key)
+			if !ok || e.value != id {
+				return ":0\r\n"
+			}
+			if strings.Contains(script, "PEXPIRE") {
+				ms, _ := strconv.Atoi(args[5])
+				e.deadline = time.Now().Add(time.Duration(ms) * time.Millisecond)
+				keys[key] = e
+			} else {
+				delete(keys, key)
+			}
+			return ":1\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					args, err := readRESPArray(r)
+					if err != nil {
+						return
+					}
+					if _, err := io.WriteString(conn, handle(args)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// readRESPArray reads a command sent by the client, an array of bulk strings
+func readRESPArray(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected line %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// newConsulStub serves the session and kv endpoints used by consulLocker,
+// the sessions expire after their TTL and delete the keys they hold
+func newConsulStub(t *testing.T) string {
+	t.Helper()
+
+	var mu sync.Mutex
+	var nextID int
+	sessions := make(map[string]time.Time)
+	ttls := make(map[string]time.Duration)
+	owners := make(map[string]string)
+
+	expire := func() {
+		for id, deadline := range sessions {
+			if time.Now().After(deadline) {
+				delete(sessions, id)
+				for key, owner := range owners {
+					if owner == id {
+						delete(owners, key)
+					}
+				}
+			}
+		}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		expire()
+
+		switch path := r.URL.Path; {
+		case path == "/v1/session/create":
+			var se struct{ TTL string }
+			if err := json.NewDecoder(r.Body).Decode(&se); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ttl, err := time.ParseDuration(se.TTL)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			nextID++
+			id := strconv.Itoa(nextID)
+			sessions[id] = time.Now().Add(ttl)
+			ttls[id] = ttl
+			fmt.Fprintf(w, `{"ID":%q}`, id)
+		case strings.HasPrefix(path, "/v1/session/renew/"):
+			id := strings.TrimPrefix(path, "/v1/session/renew/")
+			if _, ok := sessions[id]; !ok {
+				http.Error(w, "session not found", http.StatusNotFound)
+				return
+			}
+			sessions[id] = time.Now().Add(ttls[id])
+			fmt.Fprintf(w, `[{"ID":%q}]`, id)
+		case strings.HasPrefix(path, "/v1/session/destroy/"):
+			id := strings.TrimPrefix(path, "/v1/session/destroy/")
+			delete(sessions, id)
+			for key, owner := range owners {
+				if owner == id {
+					delete(owners, key)
+				}
+			}
+			fmt.Fprint(w, "true")
+		case strings.HasPrefix(path, "/v1/kv/"):
+			key := strings.TrimPrefix(path, "/v1/kv/")
+			q := r.URL.Query()
+			if id := q.Get("acquire"); id != "" {
+				owner, held := owners[key]
+				if _, ok := sessions[id]; !ok || (held && owner != id) {
+					fmt.Fprint(w, "false")
+					return
+				}
+				owners[key] = id
+				fmt.Fprint(w, "true")
+				return
+			}
+			if id := q.Get("release"); id != "" && owners[key] == id {
+				delete(owners, key)
+			}
+			fmt.Fprint(w, "true")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv.Listener.Addr().String()
+}
@@ -0,0 +1,56 @@
+package probe
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type fakeLocker struct {
+	held bool
+	err  error
+}
+
+func (l *fakeLocker) tryLock(time.Duration) (bool, error) {
+	return l.held, l.err
+}
+
+func (l *fakeLocker) unlock() {}
+
+func TestHAElectorRenew(t *testing.T) {
+	defer haLeaderUntil.Store(0)
+
+	l := &fakeLocker{held: true}
+	e := &haElector{locker: l, lease: 300 * time.Millisecond}
+
+	e.renew()
+	if !isLeader() {
+		t.Fatalf("expecting leader after acquiring the lock")
+	}
+
+	// a failed renewal keeps the lock until the lease of the last successful one expires
+	l.held, l.err = false, errors.New("i/o timeout")
+	e.renew()
+	if !isLeader() {
+		t.Fatalf("expecting leader after a single failed renewal")
+	}
+
+	time.Sleep(e.lease)
+	e.renew()
+	if isLeader() {
+		t.Fatalf("expecting standby after the lease expired")
+	}
+
+	l.held, l.err = true, nil
+	e.renew()
+	if !isLeader() {
+		t.Fatalf("expecting leader after acquiring the lock again")
+	}
+
+	// the lock is held by another instance
+	l.held = false
+	e.renew()
+	if isLeader() {
+		t.Fatalf("expecting standby after losing the lock")
+	}
+}
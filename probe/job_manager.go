@@ -0,0 +1,260 @@
+package probe
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/plugins"
+	"github.com/cprobe/cprobe/writer"
+)
+
+// JobManager 管理所有的 JobGoroutine，httpd 的 job 控制接口和 Reload 会并发访问，所以要加锁
+type JobManager struct {
+	mu   sync.RWMutex
+	jobs map[string]map[JobID]*JobGoroutine
+	// 暂停状态单独保存，Reload 重建 JobGoroutine 之后仍然有效
+	paused map[jobKey]struct{}
+}
+
+type jobKey struct {
+	plugin string
+	id     JobID
+}
+
+// JobStatus is the state of a job returned by the job control API
+type JobStatus struct {
+	Plugin              string  `json:"plugin"`
+	Job                 string  `json:"job"`
+	File                string  `json:"file"`
+	Interval            string  `json:"interval"`
+	Paused              bool    `json:"paused"`
+	LastScrape          int64   `json:"last_scrape"`
+	LastDurationSeconds float64 `json:"last_duration_seconds"`
+}
+
+func newJobManager() *JobManager {
+	return &JobManager{
+		jobs:   makeJobs(),
+		paused: make(map[jobKey]struct{}),
+	}
+}
+
+// add registers a new JobGoroutine, it doesn't start the goroutine
+func (m *JobManager) add(pluginName string, jobID JobID, j *JobGoroutine) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pluginJobs, has := m.jobs[pluginName]
+	if !has {
+		// external 插件是启动的时候才注册的
+		if _, ok := plugins.GetPlugin(pluginName); !ok {
+			return fmt.Errorf("unsupported plugin %s", pluginName)
+		}
+		pluginJobs = make(map[JobID]*JobGoroutine)
+		m.jobs[pluginName] = pluginJobs
+	}
+
+	_, paused := m.paused[jobKey{plugin: pluginName, id: jobID}]
+	j.paused.Store(paused)
+	pluginJobs[jobID] = j
+
+	return nil
+}
+
+// reload 删除磁盘上已经没有的 JobGoroutine，新增的 JobGoroutine 启动起来，已有的更新配置
+func (m *JobManager) reload(ctx context.Context, newJobs map[string]map[JobID]*JobGoroutine) {
+	started := m.update(newJobs)
+
+	// 错开新 job 的启动时间，不能持有锁等待，否则 job 控制接口会被卡住
+	for _, j := range started {
+		time.Sleep(time.Millisecond * 20)
+
+		select {
+		case <-j.quitChan:
+			// 等待的时候被并发的 reload 删掉了
+			continue
+		default:
+		}
+
+		go j.Start(ctx)
+	}
+}
+
+// update 把 newJobs 合并到 m.jobs，返回需要启动的新 JobGoroutine
+func (m *JobManager) update(newJobs map[string]map[JobID]*JobGoroutine) []*JobGoroutine {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var started []*JobGoroutine
+
+	// 遍历内存中的老 Jobs，如果磁盘上的新 Jobs 中没有，就删除
+	for pluginName, jobs := range m.jobs {
+		newPluginJobs := newJobs[pluginName]
+
+		for jobID, jobGoroutine := range jobs {
+			_, has := newPluginJobs[jobID]
+			if !has {
+				jobGoroutine.Stop()
+				delete(jobs, jobID)
+				delete(m.paused, jobKey{plugin: pluginName, id: jobID})
+			}
+		}
+	}
+
+	// 遍历磁盘中的新 Jobs，如果内存中老 Jobs 没有，就新增，有就更新
+	for pluginName, jobs := range newJobs {
+		oldPluginJobs, has := m.jobs[pluginName]
+		if !has {
+			oldPluginJobs = make(map[JobID]*JobGoroutine)
+			m.jobs[pluginName] = oldPluginJobs
+		}
+
+		for jobID, jobGoroutine := range jobs {
+			oldJobGoroutine, has := oldPluginJobs[jobID]
+			if !has {
+				_, paused := m.paused[jobKey{plugin: pluginName, id: jobID}]
+				jobGoroutine.paused.Store(paused)
+				oldPluginJobs[jobID] = jobGoroutine
+				started = append(started, jobGoroutine)
+				continue
+			}
+
+			oldJobGoroutine.UpdateConfig(jobGoroutine.scrapeConfig)
+		}
+	}
+
+	return started
+}
+
+// List returns the status of all the jobs sorted by plugin, job name and file
+func (m *JobManager) List() []JobStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var ret []JobStatus
+	for pluginName, jobs := range m.jobs {
+		for jobID, j := range jobs {
+			ret = append(ret, j.status(pluginName, jobID))
+		}
+	}
+
+	sort.Slice(ret, func(i, k int) bool {
+		if ret[i].Plugin != ret[k].Plugin {
+			return ret[i].Plugin < ret[k].Plugin
+		}
+		if ret[i].Job != ret[k].Job {
+			return ret[i].Job < ret[k].Job
+		}
+		return ret[i].File < ret[k].File
+	})
+
+	return ret
+}
+
+// find returns the job named jobName, pluginName and file are optional and used when job names are duplicated
+func (m *JobManager) find(pluginName, jobName, file string) (jobKey, *JobGoroutine, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.findLocked(pluginName, jobName, file)
+}
+
+// findLocked is find for the callers holding m.mu
+func (m *JobManager) findLocked(pluginName, jobName, file string) (jobKey, *JobGoroutine, error) {
+	var (
+		key   jobKey
+		found *JobGoroutine
+	)
+	for p, jobs := range m.jobs {
+		if pluginName != "" && p != pluginName {
+			continue
+		}
+		for jobID, j := range jobs {
+			if jobID.JobName != jobName || (file != "" && jobID.YamlFile != file) {
+				continue
+			}
+			if found != nil {
+				return jobKey{}, nil, fmt.Errorf("job %q is ambiguous, specify plugin and file", jobName)
+			}
+			key, found = jobKey{plugin: p, id: jobID}, j
+		}
+	}
+
+	if found == nil {
+		return jobKey{}, nil, fmt.Errorf("cannot find job %q", jobName)
+	}
+
+	return key, found, nil
+}
+
+// Pause stops the scheduled scrapes of the job until Resume is called, Reload keeps the job paused
+func (m *JobManager) Pause(pluginName, jobName, file string) (JobStatus, error) {
+	return m.setPaused(pluginName, jobName, file, true)
+}
+
+// Resume restarts the scheduled scrapes of a paused job
+func (m *JobManager) Resume(pluginName, jobName, file string) (JobStatus, error) {
+	return m.setPaused(pluginName, jobName, file, false)
+}
+
+func (m *JobManager) setPaused(pluginName, jobName, file string, paused bool) (JobStatus, error) {
+	// 查找和修改在同一把锁里，否则中间 reload 删掉了这个 job，m.paused 里就会留下它
+	m.mu.Lock()
+	key, j, err := m.findLocked(pluginName, jobName, file)
+	if err != nil {
+		m.mu.Unlock()
+		return JobStatus{}, err
+	}
+
+	if paused {
+		m.paused[key] = struct{}{}
+	} else {
+		delete(m.paused, key)
+	}
+	j.paused.Store(paused)
+	m.mu.Unlock()
+
+	return j.status(key.plugin, key.id), nil
+}
+
+// Trigger scrapes the job immediately, only the target with __address__ equal to target if it isn't empty.
+// The series are sent to the writers as usual and returned. Paused jobs can be triggered too.
+func (m *JobManager) Trigger(ctx context.Context, pluginName, jobName, file, target string) ([]prompbmarshal.TimeSeries, error) {
+	_, j, err := m.find(pluginName, jobName, file)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isLeader() {
+		return nil, fmt.Errorf("this instance is a standby, trigger the job on the leader")
+	}
+
+	var (
+		mu  sync.Mutex
+		ret []prompbmarshal.TimeSeries
+	)
+	n := j.scrape(ctx, target, func(tss []prompbmarshal.TimeSeries) {
+		// writer 会在原地修改 labels，先复制一份
+		copied := make([]prompbmarshal.TimeSeries, len(tss))
+		for i := range tss {
+			copied[i] = prompbmarshal.TimeSeries{
+				Labels:  append([]prompbmarshal.Label(nil), tss[i].Labels...),
+				Samples: append([]prompbmarshal.Sample(nil), tss[i].Samples...),
+			}
+		}
+		mu.Lock()
+		ret = append(ret, copied...)
+		mu.Unlock()
+
+		writer.WriteTimeSeries(tss)
+	})
+
+	if n == 0 && target != "" {
+		return nil, fmt.Errorf("cannot find target %q in job %q", target, jobName)
+	}
+
+	return ret, nil
+}
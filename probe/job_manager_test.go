@@ -0,0 +1,58 @@
+package probe
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/promutils"
+	"github.com/cprobe/cprobe/types"
+)
+
+func TestJobManagerReload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newJobManager()
+	newJobs := map[string]map[JobID]*JobGoroutine{types.PluginPrometheus: {}}
+	for i := 0; i < 10; i++ {
+		jobID := JobID{YamlFile: "reload_test.yaml", JobName: fmt.Sprintf("job%d", i)}
+		// paused, so the started jobs never scrape
+		m.paused[jobKey{plugin: types.PluginPrometheus, id: jobID}] = struct{}{}
+		newJobs[types.PluginPrometheus][jobID] = NewJobGoroutine(types.PluginPrometheus, &ScrapeConfig{
+			JobName:        jobID.JobName,
+			ScrapeInterval: promutils.NewDuration(time.Hour),
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.reload(ctx, newJobs)
+		close(done)
+	}()
+
+	// the starts are staggered for about 200ms, the jobs can be controlled meanwhile
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if _, err := m.Resume("", "job9", ""); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("the job manager is locked while the jobs are started: %s", d)
+	}
+	if _, err := m.Pause("", "job9", ""); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	<-done
+
+	if n := len(m.List()); n != 10 {
+		t.Fatalf("unexpected number of jobs: %d", n)
+	}
+
+	// removed jobs forget their paused state
+	m.reload(ctx, nil)
+	if len(m.List()) != 0 || len(m.paused) != 0 {
+		t.Fatalf("unexpected jobs after removing all: %v, paused %v", m.List(), m.paused)
+	}
+}
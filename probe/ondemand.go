@@ -0,0 +1,153 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/lib/promutils"
+	"github.com/cprobe/cprobe/plugins"
+	"github.com/cprobe/cprobe/types"
+)
+
+var (
+	probeConcurrency   = flag.Int("probe.concurrency", 32, "The maximum number of concurrent /probe requests, the others wait until a slot is free or the scrape timeout is reached")
+	probeTimeout       = flag.Duration("probe.timeout", 10*time.Second, "Timeout of /probe requests without the X-Prometheus-Scrape-Timeout-Seconds header")
+	probeTimeoutOffset = flag.Duration("probe.timeoutOffset", 500*time.Millisecond, "Subtracted from X-Prometheus-Scrape-Timeout-Seconds, so the response is sent before Prometheus gives up")
+)
+
+// ErrInvalidProbeParams is returned by Probe if the plugin or the module is invalid
+var ErrInvalidProbeParams = errors.New("invalid probe params")
+
+var (
+	probeLimiterOnce sync.Once
+	probeLimiter     chan struct{}
+)
+
+// 跟 job 的调度无关，flag 解析完之后才能确定并发度
+func getProbeLimiter() chan struct{} {
+	probeLimiterOnce.Do(func() {
+		n := *probeConcurrency
+		if n <= 0 {
+			n = 1
+		}
+		probeLimiter = make(chan struct{}, n)
+	})
+	return probeLimiter
+}
+
+// ProbeTimeout returns the timeout of a /probe request, header is the value of X-Prometheus-Scrape-Timeout-Seconds
+func ProbeTimeout(header string) (time.Duration, error) {
+	if header == "" {
+		return *probeTimeout, nil
+	}
+
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("%w: cannot parse X-Prometheus-Scrape-Timeout-Seconds %q", ErrInvalidProbeParams, header)
+	}
+
+	timeout := time.Duration(seconds*float64(time.Second)) - *probeTimeoutOffset
+	if timeout <= 0 {
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	return timeout, nil
+}
+
+// Probe scrapes target with plugin once, like blackbox_exporter does for /probe.
+// module is a rule file resolved against <configDirectory>/<plugin>, it may be empty if the plugin doesn't need rules.
+// The scrape errors are reported by cprobe_up and cprobe_error, the returned error means the probe didn't run.
+func Probe(ctx context.Context, configDirectory, pluginName, target, module string) ([]prompbmarshal.TimeSeries, error) {
+	if target == "" {
+		return nil, fmt.Errorf("%w: missing target", ErrInvalidProbeParams)
+	}
+
+	plugin, has := plugins.GetPlugin(pluginName)
+	if !has {
+		return nil, fmt.Errorf("%w: unknown plugin %q", ErrInvalidProbeParams, pluginName)
+	}
+
+	baseDir := filepath.Join(configDirectory, pluginName)
+
+	var ruleFiles []string
+	if module != "" {
+		ruleFile, err := probeRuleFile(baseDir, module)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidProbeParams, err)
+		}
+		ruleFiles = append(ruleFiles, ruleFile)
+	}
+
+	tomlBytes, err := readRuleFiles(baseDir, ruleFiles)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidProbeParams, err)
+	}
+
+	config, err := plugin.ParseConfig(baseDir, tomlBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: parse plugin config error: %s", ErrInvalidProbeParams, err)
+	}
+
+	limiter := getProbeLimiter()
+	select {
+	case limiter <- struct{}{}:
+		defer func() { <-limiter }()
+	case <-ctx.Done():
+		return nil, fmt.Errorf("too many concurrent probes, see -probe.concurrency: %w", ctx.Err())
+	}
+
+	j := &JobGoroutine{plugin: pluginName}
+	pt := promutils.NewLabels(1)
+	pt.Add("__address__", target)
+
+	ss := types.NewSamples()
+	now := time.Now()
+
+	err = plugin.Scrape(ctx, target, config, ss)
+	if err != nil {
+		logger.Errorf("failed to probe. plugin: %s, target: %s, error: %s", pluginName, target, err)
+	}
+
+	ss.AddMetric(pluginName, map[string]interface{}{"cprobe_duration_seconds": time.Since(now).Seconds()})
+	if err != nil {
+		ss.AddMetric(pluginName, map[string]interface{}{"cprobe_up": 0.0})
+		ss.AddMetric(pluginName, map[string]interface{}{"cprobe_error": 1.0}, map[string]string{"error": err.Error()})
+	} else {
+		ss.AddMetric(pluginName, map[string]interface{}{"cprobe_up": 1.0})
+		ss.AddMetric(pluginName, map[string]interface{}{"cprobe_error": 0.0}, map[string]string{"error": ""})
+	}
+
+	return j.convertSamples(&ScrapeConfig{}, pt, ss.PopBackAll(), now), nil
+}
+
+// probeRuleFile checks the module of a /probe request and returns it relative to baseDir.
+// Only the files under baseDir are allowed, readRuleFiles fetches urls and reads absolute paths,
+// so a module from the request must not be either of them.
+func probeRuleFile(baseDir, module string) (string, error) {
+	if strings.Contains(module, "://") {
+		return "", fmt.Errorf("module %q must not be a url", module)
+	}
+	if u, err := url.Parse(module); err != nil || u.Scheme != "" {
+		return "", fmt.Errorf("module %q must not be a url", module)
+	}
+
+	if !filepath.IsLocal(module) {
+		return "", fmt.Errorf("module %q must be a relative path under the plugin directory", module)
+	}
+
+	rel, err := filepath.Rel(baseDir, filepath.Join(baseDir, module))
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("module %q must be a relative path under the plugin directory", module)
+	}
+
+	return rel, nil
+}
@@ -0,0 +1,71 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cprobe/cprobe/types"
+)
+
+func TestProbeRuleFile(t *testing.T) {
+	baseDir := filepath.Join("conf.d", "mysql")
+
+	f := func(module, expected string) {
+		t.Helper()
+		ruleFile, err := probeRuleFile(baseDir, module)
+		if expected == "" {
+			if err == nil {
+				t.Fatalf("expecting error for module %q, got %q", module, ruleFile)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for module %q: %s", module, err)
+		}
+		if ruleFile != expected {
+			t.Fatalf("unexpected rule file for module %q: got %q, want %q", module, ruleFile, expected)
+		}
+	}
+
+	f("rule.toml", "rule.toml")
+	f("rule.d/a.toml", filepath.Join("rule.d", "a.toml"))
+	f("rule.d/../b.toml", "b.toml")
+
+	f("http://evil/x.toml", "")
+	f("https://evil/x.toml", "")
+	f("file:///etc/passwd", "")
+	f("/etc/passwd", "")
+	f("../redis/rule.toml", "")
+	f("rule.d/../../redis/rule.toml", "")
+	f("", "")
+}
+
+func TestProbeRejectsRemoteModule(t *testing.T) {
+	var fetched atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched.Store(true)
+	}))
+	defer srv.Close()
+
+	configDirectory := t.TempDir()
+	if err := os.Mkdir(filepath.Join(configDirectory, types.PluginPrometheus), 0o755); err != nil {
+		t.Fatalf("cannot create plugin dir: %s", err)
+	}
+
+	for _, module := range []string{srv.URL + "/rule.toml", "../../rule.toml"} {
+		_, err := Probe(context.Background(), configDirectory, types.PluginPrometheus, "http://127.0.0.1:1/metrics", module)
+		if !errors.Is(err, ErrInvalidProbeParams) {
+			t.Fatalf("expecting ErrInvalidProbeParams for module %q, got %v", module, err)
+		}
+	}
+
+	if fetched.Load() {
+		t.Fatalf("the remote module must not be fetched")
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/cprobe/cprobe/lib/fileutil"
 	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/plugins/external"
 	"github.com/pkg/errors"
 )
 
@@ -43,11 +44,23 @@ func listPlugins(configDirectory string) ([]string, error) {
 
 // Start starts the probe goroutines.
 func Start(ctx context.Context, configDirectory string) error {
+	if err := checkShardFlags(); err != nil {
+		return err
+	}
+
+	if err := startHA(ctx); err != nil {
+		return errors.Wrap(err, "cannot start ha")
+	}
+
 	pluginDirs, err := listPlugins(configDirectory)
 	if err != nil {
 		return err
 	}
 
+	if err = external.Load(configDirectory, pluginDirs); err != nil {
+		return errors.Wrap(err, "cannot load external plugins")
+	}
+
 	if len(pluginDirs) == 0 {
 		return fmt.Errorf("no plugin dirs found under %s", configDirectory)
 	}
@@ -90,11 +103,6 @@ func startEntry(ctx context.Context, pluginName, entryYamlFilePath string) error
 	}
 	PluginCfgs[pluginName] = append(PluginCfgs[pluginName], cfg)
 
-	pluginJobs, has := Jobs[pluginName]
-	if !has {
-		return fmt.Errorf("unsupported plugin %s", pluginName)
-	}
-
 	for i := range cfg.ScrapeConfigs {
 		if cfg.ScrapeConfigs[i] == nil {
 			continue
@@ -102,7 +110,9 @@ func startEntry(ctx context.Context, pluginName, entryYamlFilePath string) error
 
 		jobID := JobID{YamlFile: entryYamlFilePath, JobName: cfg.ScrapeConfigs[i].JobName}
 		jobGoroutine := NewJobGoroutine(pluginName, cfg.ScrapeConfigs[i])
-		pluginJobs[jobID] = jobGoroutine
+		if err = Jobs.add(pluginName, jobID, jobGoroutine); err != nil {
+			return err
+		}
 
 		// 启动 goroutine，稍微 sleep 一下，避免所有 goroutine 同时启动
 		time.Sleep(time.Millisecond * 10)
@@ -120,37 +130,7 @@ func Reload(ctx context.Context, configDirectory string) {
 		return
 	}
 
-	// 遍历内存中的老 Jobs，如果磁盘上的新 Jobs 中没有，就删除
-	for pluginName, jobs := range Jobs {
-		newPluginJobs := newJobs[pluginName]
-
-		for jobID, jobGoroutine := range jobs {
-			_, has := newPluginJobs[jobID]
-			if !has {
-				jobGoroutine.Stop()
-				delete(jobs, jobID)
-			}
-		}
-	}
-
-	// 遍历磁盘中的新 Jobs，如果内存中老 Jobs 没有，就新增，有就更新
-	for pluginName, jobs := range newJobs {
-		oldPluginJobs := Jobs[pluginName]
-
-		for jobID, jobGoroutine := range jobs {
-			oldJobGoroutine, has := oldPluginJobs[jobID]
-			if !has {
-				oldPluginJobs[jobID] = jobGoroutine
-
-				time.Sleep(time.Millisecond * 20)
-				go oldPluginJobs[jobID].Start(ctx)
-
-				continue
-			}
-
-			oldJobGoroutine.UpdateConfig(jobGoroutine.scrapeConfig)
-		}
-	}
+	Jobs.reload(ctx, newJobs)
 }
 
 func readFiles(configDirectory string) (map[string]map[JobID]*JobGoroutine, error) {
@@ -159,6 +139,10 @@ func readFiles(configDirectory string) (map[string]map[JobID]*JobGoroutine, erro
 		return nil, err
 	}
 
+	if err = external.Load(configDirectory, pluginDirs); err != nil {
+		return nil, fmt.Errorf("cannot load external plugins: %s", err)
+	}
+
 	newJobs := makeJobs()
 
 	for i := 0; i < len(pluginDirs); i++ {
@@ -1,12 +1,13 @@
 package probe
 
 import (
-	"github.com/cprobe/cprobe/types"
+	"github.com/cprobe/cprobe/plugins"
 
 	_ "github.com/cprobe/cprobe/plugins/blackbox"
 	_ "github.com/cprobe/cprobe/plugins/consul"
 	_ "github.com/cprobe/cprobe/plugins/dm8"
 	_ "github.com/cprobe/cprobe/plugins/elasticsearch"
+	_ "github.com/cprobe/cprobe/plugins/exec"
 	_ "github.com/cprobe/cprobe/plugins/filebeat"
 	_ "github.com/cprobe/cprobe/plugins/json"
 	_ "github.com/cprobe/cprobe/plugins/kafka"
@@ -23,25 +24,12 @@ import (
 	_ "github.com/cprobe/cprobe/plugins/zookeeper"
 )
 
+// makeJobs 为每个注册的插件准备一个空的 job 列表，包括 conf.d 里声明的 external 插件
 func makeJobs() map[string]map[JobID]*JobGoroutine {
-	return map[string]map[JobID]*JobGoroutine{
-		types.PluginMySQL:         make(map[JobID]*JobGoroutine),
-		types.PluginRedis:         make(map[JobID]*JobGoroutine),
-		types.PluginMongoDB:       make(map[JobID]*JobGoroutine),
-		types.PluginPostgres:      make(map[JobID]*JobGoroutine),
-		types.PluginElasticSearch: make(map[JobID]*JobGoroutine),
-		types.PluginKafka:         make(map[JobID]*JobGoroutine),
-		types.PluginBlackbox:      make(map[JobID]*JobGoroutine),
-		types.PluginJson:          make(map[JobID]*JobGoroutine),
-		types.PluginPrometheus:    make(map[JobID]*JobGoroutine),
-		types.PluginOracleDB:      make(map[JobID]*JobGoroutine),
-		types.PluginWhois:         make(map[JobID]*JobGoroutine),
-		types.PluginTomcat:        make(map[JobID]*JobGoroutine),
-		types.PluginMemcached:     make(map[JobID]*JobGoroutine),
-		types.PluginConsul:        make(map[JobID]*JobGoroutine),
-		types.PluginFilebeat:      make(map[JobID]*JobGoroutine),
-		types.PluginZookeeper:     make(map[JobID]*JobGoroutine),
-		types.PluginNginx:         make(map[JobID]*JobGoroutine),
-		types.PluginDm:            make(map[JobID]*JobGoroutine),
+	names := plugins.Names()
+	jobs := make(map[string]map[JobID]*JobGoroutine, len(names))
+	for _, name := range names {
+		jobs[name] = make(map[JobID]*JobGoroutine)
 	}
+	return jobs
 }
@@ -0,0 +1,52 @@
+package probe
+
+import (
+	"fmt"
+
+	"github.com/cprobe/cprobe/lib/promrelabel"
+	"github.com/cprobe/cprobe/lib/promutils"
+	"gopkg.in/yaml.v2"
+)
+
+// RelabelDebugDefaults returns the labels and the relabel configs of job for the relabel debug pages.
+// For target relabeling the labels are the first discovered target, so the __meta_* labels can be checked.
+func RelabelDebugDefaults(jobName string, isTargetRelabel bool) (string, string, error) {
+	_, j, err := Jobs.find("", jobName, "")
+	if err != nil {
+		return "", "", err
+	}
+
+	sc := j.getScrapeConfig()
+	rcs := sc.MetricRelabelConfigs
+	if isTargetRelabel {
+		rcs = sc.RelabelConfigs
+	}
+
+	var relabelConfigs string
+	if len(rcs) > 0 {
+		bs, err := yaml.Marshal(rcs)
+		if err != nil {
+			return "", "", fmt.Errorf("cannot marshal relabel configs of job %q: %w", jobName, err)
+		}
+		relabelConfigs = string(bs)
+	}
+
+	if !isTargetRelabel {
+		return "", relabelConfigs, nil
+	}
+
+	// 跟 parseTarget 一样，先加上 job 和 external_labels
+	targets := getTargets(sc)
+	if len(targets) == 0 {
+		return "", relabelConfigs, nil
+	}
+	labels := promutils.NewLabels(1 + targets[0].Len())
+	labels.Add("job", jobName)
+	if sc.ConfigRef.Global.ExternalLabels != nil {
+		labels.AddFrom(sc.ConfigRef.Global.ExternalLabels)
+	}
+	labels.AddFrom(targets[0])
+	labels.RemoveDuplicates()
+
+	return promrelabel.LabelsToString(labels.GetLabels()), relabelConfigs, nil
+}
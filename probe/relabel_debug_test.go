@@ -0,0 +1,58 @@
+package probe
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/promrelabel"
+	"github.com/cprobe/cprobe/lib/promutils"
+	"github.com/cprobe/cprobe/types"
+)
+
+func TestRelabelDebugDefaults(t *testing.T) {
+	newScrapeConfig := func(instance string) *ScrapeConfig {
+		return &ScrapeConfig{
+			ConfigRef: &Config{Global: GlobalConfig{ExternalLabels: promutils.NewLabelsFromMap(map[string]string{"region": "bj"})}},
+			JobName:   "relabel_debug_test",
+			StaticConfigs: []StaticConfig{{
+				Targets: []string{instance},
+			}},
+			RelabelConfigs: []promrelabel.RelabelConfig{{Action: "labeldrop", Regex: &promrelabel.MultiLineRegex{S: "region"}}},
+		}
+	}
+
+	jobID := JobID{YamlFile: "relabel_debug_test.yaml", JobName: "relabel_debug_test"}
+	j := &JobGoroutine{plugin: types.PluginPrometheus, scrapeConfig: newScrapeConfig("a:9100")}
+	if err := Jobs.add(types.PluginPrometheus, jobID, j); err != nil {
+		t.Fatalf("cannot add job: %s", err)
+	}
+	defer func() {
+		Jobs.mu.Lock()
+		delete(Jobs.jobs[types.PluginPrometheus], jobID)
+		Jobs.mu.Unlock()
+	}()
+
+	labels, relabelConfigs, err := RelabelDebugDefaults(jobID.JobName, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if labels != `{__address__="a:9100",job="relabel_debug_test",region="bj"}` || relabelConfigs == "" {
+		t.Fatalf("unexpected defaults: %s, %q", labels, relabelConfigs)
+	}
+
+	// the config is replaced by reloads while the debug page reads it, go test -race catches unlocked reads
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			j.UpdateConfig(newScrapeConfig("b:9100"))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if _, _, err := RelabelDebugDefaults(jobID.JobName, true); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	wg.Wait()
+}
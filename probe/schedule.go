@@ -3,54 +3,143 @@ package probe
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/cespare/xxhash/v2"
+	"github.com/cprobe/cprobe/lib/bloomfilter"
 	"github.com/cprobe/cprobe/lib/conv"
 	"github.com/cprobe/cprobe/lib/envtemplate"
 	"github.com/cprobe/cprobe/lib/fs"
 	"github.com/cprobe/cprobe/lib/logger"
 	"github.com/cprobe/cprobe/lib/prompbmarshal"
 	"github.com/cprobe/cprobe/lib/promutils"
+	"github.com/cprobe/cprobe/lib/secret"
 	"github.com/cprobe/cprobe/plugins"
 	"github.com/cprobe/cprobe/types"
+	"github.com/cprobe/cprobe/types/metric"
 	"github.com/cprobe/cprobe/writer"
 	"gopkg.in/yaml.v2"
 )
 
 var (
-	Jobs = makeJobs()
+	Jobs = newJobManager()
 )
 
+// streamFlushSamples 流式解析时每攒够这么多数据就交给调度器一次，没有设置 sample_limit 的时候直接发送
+const streamFlushSamples = 10000
+
 type JobID struct {
 	YamlFile string
 	JobName  string
 }
 
 type JobGoroutine struct {
-	plugin       string
-	scrapeConfig *ScrapeConfig
-	quitChan     chan struct{}
+	plugin        string
+	scrapeConfig  *ScrapeConfig
+	seriesLimiter *seriesLimiter
+	quitChan      chan struct{}
 	sync.RWMutex
+
+	// 暂停的 job 照常调度，但是跳过抓取
+	paused atomic.Bool
+	// 上次抓取开始的时间（毫秒）和耗时（纳秒）
+	lastScrape   atomic.Int64
+	lastDuration atomic.Int64
+
+	// 插件实现了 plugins.ConfigCloner 的时候，rule 文件内容不变就复用解析好的配置
+	sharedConfig atomic.Pointer[sharedConfig]
+}
+
+type sharedConfig struct {
+	// baseDir 和 rule 文件内容的 hash
+	hash     uint64
+	parsedAt time.Time
+	config   any
+	// rule 文件里有 secret 引用，解析出来的配置带着 secret
+	hasSecrets bool
 }
 
 func NewJobGoroutine(plugin string, scrapeConfig *ScrapeConfig) *JobGoroutine {
 	return &JobGoroutine{
-		plugin:       plugin,
-		quitChan:     make(chan struct{}),
-		scrapeConfig: scrapeConfig,
+		plugin:        plugin,
+		quitChan:      make(chan struct{}),
+		scrapeConfig:  scrapeConfig,
+		seriesLimiter: newSeriesLimiter(scrapeConfig.SeriesLimit),
 	}
 }
 
+// seriesLimiter 记录正在使用它的抓取，被替换之后要等这些抓取结束才能 MustStop
+type seriesLimiter struct {
+	*bloomfilter.Limiter
+	inflight sync.WaitGroup
+}
+
+func newSeriesLimiter(seriesLimit int) *seriesLimiter {
+	if seriesLimit <= 0 {
+		return nil
+	}
+	return &seriesLimiter{Limiter: bloomfilter.NewLimiter(seriesLimit, time.Hour)}
+}
+
+func (l *seriesLimiter) release() {
+	if l != nil {
+		l.inflight.Done()
+	}
+}
+
+// retire 在持有 j.Lock 把 limiter 换掉之后调用，之后不会再有抓取拿到它，等正在用的抓取结束再停掉
+func (l *seriesLimiter) retire() {
+	if l == nil {
+		return
+	}
+	go func() {
+		l.inflight.Wait()
+		l.MustStop()
+	}()
+}
+
 func (j *JobGoroutine) UpdateConfig(scrapeConfig *ScrapeConfig) {
 	j.Lock()
 	defer j.Unlock()
+
+	if scrapeConfig.SeriesLimit != j.scrapeConfig.SeriesLimit {
+		j.seriesLimiter.retire()
+		j.seriesLimiter = newSeriesLimiter(scrapeConfig.SeriesLimit)
+	}
+
 	j.scrapeConfig = scrapeConfig
 }
 
+// acquire 返回一次抓取用到的配置和 series limiter，整个抓取过程都用这一份，抓取结束要调用 limiter.release()
+func (j *JobGoroutine) acquire() (*ScrapeConfig, *seriesLimiter) {
+	j.RLock()
+	defer j.RUnlock()
+	if j.seriesLimiter != nil {
+		j.seriesLimiter.inflight.Add(1)
+	}
+	return j.scrapeConfig, j.seriesLimiter
+}
+
+func (j *JobGoroutine) status(pluginName string, jobID JobID) JobStatus {
+	return JobStatus{
+		Plugin:              pluginName,
+		Job:                 jobID.JobName,
+		File:                jobID.YamlFile,
+		Interval:            j.GetInterval().String(),
+		Paused:              j.paused.Load(),
+		LastScrape:          j.lastScrape.Load(),
+		LastDurationSeconds: time.Duration(j.lastDuration.Load()).Seconds(),
+	}
+}
+
 func (j *JobGoroutine) GetInterval() time.Duration {
 	j.RLock()
 	defer j.RUnlock()
@@ -63,6 +152,13 @@ func (j *JobGoroutine) GetJobName() string {
 	return j.scrapeConfig.JobName
 }
 
+// getScrapeConfig returns the current config, it is replaced by UpdateConfig as a whole and never modified
+func (j *JobGoroutine) getScrapeConfig() *ScrapeConfig {
+	j.RLock()
+	defer j.RUnlock()
+	return j.scrapeConfig
+}
+
 func (j *JobGoroutine) GetRuleFiles() []string {
 	j.RLock()
 	defer j.RUnlock()
@@ -78,7 +174,11 @@ func (j *JobGoroutine) Start(ctx context.Context) {
 		select {
 		case <-timer.C:
 			start = time.Now()
-			j.run(ctx)
+			if !j.paused.Load() {
+				j.run(ctx)
+				j.lastScrape.Store(start.UnixMilli())
+				j.lastDuration.Store(int64(time.Since(start)))
+			}
 			next := j.GetInterval() - time.Since(start)
 			if next < 0 {
 				next = 0
@@ -97,67 +197,73 @@ func (j *JobGoroutine) Start(ctx context.Context) {
 // targets 可能很多，要做一下并发度控制，并发度可以在 job 粒度自定义，每个 yaml 的 global 部分也可以有一个全局的并发度配置
 // 通过 wait group 等待所有的 goroutine 抓取完毕，统一做 metric_relabel_configs，然后发送给 writer
 func (j *JobGoroutine) run(ctx context.Context) {
-	jobName := j.GetJobName()
+	j.scrape(ctx, "", writer.WriteTimeSeries)
+}
+
+// scrape 抓取一次 job 的所有 target，address 不为空的时候只抓取 __address__ 等于 address 的那个，
+// 抓取到的数据交给 sink，sink 会被并发调用。返回抓取的 target 数量
+func (j *JobGoroutine) scrape(ctx context.Context, address string, sink func([]prompbmarshal.TimeSeries)) int {
+	// 热加载随时会替换配置，一次抓取从头到尾都用同一份
+	sc, limiter := j.acquire()
+	defer limiter.release()
+
+	jobName := sc.JobName
 
 	// rule 文件都是 toml 格式，可以直接拼在一起，用户要自己保证正确性
 	// json 和 yaml 格式的文件，很难直接拼在一起，所以 rule 选择 toml 格式
-	ruleFiles := j.GetRuleFiles()
+	ruleFiles := sc.ScrapeRuleFiles
 	// if len(ruleFiles) == 0 {
 	// 	logger.Errorf("job(%s) has no rule files", jobName)
 	// 	return
 	// }
 
-	var bytesBuffer bytes.Buffer
-	var err error
-	for _, ruleFile := range ruleFiles {
-		ruleFilePath := fs.GetFilepath(j.scrapeConfig.ConfigRef.BaseDir, ruleFile)
-
-		data := CacheGetBytes(ruleFilePath)
-		if data == nil {
-			data, err = fs.ReadFileOrHTTP(ruleFilePath)
-			if err != nil {
-				logger.Errorf("job(%s) read rule file(%s) error: %s", jobName, ruleFile, err)
-				return
-			}
-
-			data, err = envtemplate.ReplaceBytes(data)
-			if err != nil {
-				logger.Errorf("job(%s) replace env in rule file(%s) error: %s", jobName, ruleFile, err)
-				return
-			}
-
-			CacheSetBytes(ruleFilePath, data, time.Second*5)
-		}
-
-		bytesBuffer.Write(data)
-		bytesBuffer.Write([]byte("\n"))
-		bytesBuffer.Write([]byte("\n"))
+	tomlBytes, err := readRuleFiles(sc.ConfigRef.BaseDir, ruleFiles)
+	if err != nil {
+		logger.Errorf("job(%s) %s", jobName, err)
+		return 0
 	}
 
-	tomlBytes := bytesBuffer.Bytes()
-
 	plugin, has := plugins.GetPlugin(j.plugin)
 	if !has {
 		logger.Errorf("job(%s) unknown plugin: %s", jobName, j.plugin)
-		return
+		return 0
 	}
 
+	loadConfig := j.configLoader(plugin, sc.ConfigRef.BaseDir, tomlBytes)
+
 	// 等待所有 target 抓取完毕的 wait group
 	var wg sync.WaitGroup
 
 	// 控制并发度的 channel，大量的 target 并发抓取的话可能会有问题，比如 icmp 的抓取，一次性启动太多，会导致 icmp 的抓取超时
-	var se = make(chan struct{}, j.scrapeConfig.ScrapeConcurrency)
+	var se = make(chan struct{}, sc.ScrapeConcurrency)
 
 	// 拿到这个 job 相关的 targets
-	targets := j.getTargets()
+	targets := getTargets(sc)
+
+	// standby 实例照常做服务发现，保持发现结果是热的，但是不抓取，等拿到 lock 之后再接管
+	if !isLeader() {
+		return 0
+	}
+
+	scraped := 0
 
 	// 每个 target 分别去抓取数据，注意要控制并发度
 	for _, target := range targets {
-		parsedTarget := j.parseTarget(jobName, target)
+		parsedTarget := parseTarget(sc, target)
 		if parsedTarget == nil {
 			continue
 		}
 
+		// 多个 cprobe 实例分片抓取的时候，只抓取属于自己的 target
+		if !isOwnTarget(parsedTarget, sc.ConfigRef.Global.ExternalLabels) {
+			continue
+		}
+
+		if address != "" && parsedTarget.Get("__address__") != address {
+			continue
+		}
+		scraped++
+
 		se <- struct{}{}
 		wg.Add(1)
 		go func(pt *promutils.Labels) {
@@ -167,26 +273,94 @@ func (j *JobGoroutine) run(ctx context.Context) {
 			}()
 
 			targetAddress := pt.Get("__address__")
-			if j.scrapeConfig.ExternalLabels != nil {
-				pt.AddFrom(j.scrapeConfig.ExternalLabels)
+			if sc.ExternalLabels != nil {
+				pt.AddFrom(sc.ExternalLabels)
 			}
 
 			// 准备一个并发安全的容器，传给 Scrape 方法，Scrape 方法会把抓取到的数据放进去，外层还要做 relabel 然后最终发给 writer
 			ss := types.NewSamples()
 
-			// 每个 target 分别 ParseConfig，对性能有一丢丢影响，好处是插件里就可以放心大胆的更新 config 了，不用担心并发安全问题
-			// 后面再看看是否有更好的提升性能的办法
-			config, err := plugin.ParseConfig(j.scrapeConfig.ConfigRef.BaseDir, tomlBytes)
+			now := time.Now()
+
+			// 流式解析的插件（比如 prometheus 的 stream_parse）会分批把数据交给这里，内存占用不随 target 的数据量增长。
+			// 设置了 job 的 sample_limit 的时候要先攒着，超限时整体作废；插件自己设置了 sample_limit 或者 body_size_limit 的时候
+			// 插件不会分批交出数据。都没有设置的时候直接发送，后面的数据解析失败的话，已经发送的数据不会撤回
+			samplesFlushed, samplesOverLimit := 0, 0
+			var streamed []prompbmarshal.TimeSeries
+			ss.SetFlushHook(streamFlushSamples, func(ms []metric.Metric) {
+				tss := j.convertSamples(sc, pt, ms, now)
+				if limit := sc.SampleLimit; limit > 0 {
+					if len(streamed) > limit {
+						// 已经超限了，只计数不再攒着
+						samplesOverLimit += len(tss)
+						return
+					}
+					streamed = append(streamed, tss...)
+					return
+				}
+				samplesFlushed += len(tss)
+				sink(applySeriesLimit(jobName, limiter, tss))
+			})
+
+			config, err := loadConfig()
 			if err != nil {
 				logger.Errorf("job(%s) parse plugin config error: %s", jobName, err)
 				return
 			}
 
-			now := time.Now()
-			if err = plugin.Scrape(ctx, targetAddress, config, ss); err != nil {
+			// target 标签可以覆盖插件配置，比如 CMDB 里每个实例的账号密码不一样
+			scrapeCtx := plugins.WithTargetLabels(ctx, targetLabels(pt))
+			if params := targetParams(pt); len(params) > 0 {
+				err = plugins.CheckTargetParams(j.plugin, params)
+				if _, raw := plugin.(plugins.RawTargetParams); err == nil && !raw {
+					err = plugins.ApplyTargetParams(config, params)
+				}
+				if err != nil {
+					// 跟抓取失败一样上报 cprobe_up=0，不能让 target 悄无声息地消失
+					err = fmt.Errorf("invalid target params: %w", err)
+				} else {
+					scrapeCtx = plugins.WithTargetParams(scrapeCtx, params)
+				}
+			}
+
+			if err == nil {
+				err = plugin.Scrape(scrapeCtx, targetAddress, config, ss)
+			}
+			if err != nil {
 				logger.Errorf("failed to scrape. job: %s, plugin: %s, target: %s, error: %s", jobName, j.plugin, targetAddress, err)
 			}
 
+			// 插件抓取到的数据
+			scraped := ss.PopBackAll()
+			if errors.Is(err, types.ErrSampleLimitExceeded) || errors.Is(err, types.ErrStreamAborted) {
+				// 插件自己的 sample_limit 超限或者流式解析中途失败，还没发送的数据整体作废
+				scraped = nil
+				streamed = nil
+			}
+
+			ret := append(streamed, j.convertSamples(sc, pt, scraped, now)...)
+			streamed = nil
+			samplesScraped := samplesFlushed + samplesOverLimit + len(ret)
+
+			if limit := sc.SampleLimit; limit > 0 && samplesScraped > limit {
+				samplesDroppedTotal(jobName, "sample_limit").Add(samplesScraped)
+				ss.AddMetric(j.plugin, map[string]interface{}{"cprobe_samples_dropped": samplesScraped}, map[string]string{"reason": "sample_limit"})
+				ret = nil
+				if err == nil {
+					err = fmt.Errorf("%w: %d samples, limit is %d", types.ErrSampleLimitExceeded, samplesScraped, limit)
+					logger.Errorf("failed to scrape. job: %s, plugin: %s, target: %s, error: %s", jobName, j.plugin, targetAddress, err)
+				}
+			}
+
+			if len(ret) > 0 {
+				n := len(ret)
+				ret = applySeriesLimit(jobName, limiter, ret)
+				if dropped := n - len(ret); dropped > 0 {
+					ss.AddMetric(j.plugin, map[string]interface{}{"cprobe_samples_dropped": dropped}, map[string]string{"reason": "series_limit"})
+				}
+			}
+
+			ss.AddMetric(j.plugin, map[string]interface{}{"cprobe_samples_scraped": samplesScraped})
 			ss.AddMetric(j.plugin, map[string]interface{}{"cprobe_duration_seconds": time.Since(now).Seconds()})
 
 			if err != nil {
@@ -199,88 +373,232 @@ func (j *JobGoroutine) run(ctx context.Context) {
 				ss.AddMetric(j.plugin, map[string]interface{}{"cprobe_timestamp": now.Unix()})
 			}
 
-			// 把抓取到的数据做格式转换，转换成 []prompbmarshal.TimeSeries
-			metrics := ss.PopBackAll()
+			// 自监控指标不受 sample_limit 和 series_limit 的限制
+			ret = append(ret, j.convertSamples(sc, pt, ss.PopBackAll(), now)...)
+			sink(ret)
 
-			// 最终转换之后的数据结果集
-			var ret []prompbmarshal.TimeSeries
+		}(parsedTarget)
+	}
 
-			// now := int64(fasttime.UnixTimestamp() * 1000) // s -> ms
-			for i := range metrics {
-				// 统一在这里设置时间
-				if metrics[i].Time() == 0 {
-					metrics[i].SetTime(now.UnixMilli())
-				}
+	wg.Wait()
 
-				// 一个 telegraf metric 有多个 fields，每个 field 都是一个 prometheus metric
-				tags := metrics[i].Tags()
-				fields := metrics[i].Fields()
+	return scraped
+}
 
-				for k, v := range fields {
-					float64v, err := conv.ToFloat64(v)
-					if err != nil {
-						continue
-					}
+// configLoader 返回每个 target 获取插件配置的方法。
+// 插件实现了 plugins.ConfigCloner 的话，同样内容的 rule 文件只解析一次，每个 target 拿一份 clone；
+// 否则每个 target 分别 ParseConfig，插件里就可以放心大胆的更新 config 了，不用担心并发安全问题
+func (j *JobGoroutine) configLoader(plugin plugins.Plugin, baseDir string, tomlBytes []byte) func() (any, error) {
+	cloner, ok := plugin.(plugins.ConfigCloner)
+	if !ok {
+		return func() (any, error) {
+			return plugin.ParseConfig(baseDir, tomlBytes)
+		}
+	}
 
-					item := promutils.NewLabels(len(tags) + pt.Len())
+	config, err := j.getSharedConfig(plugin, baseDir, tomlBytes)
+	return func() (any, error) {
+		if err != nil {
+			return nil, err
+		}
+		return cloner.CloneConfig(config), nil
+	}
+}
 
-					for _, lb := range pt.GetLabels() {
-						if lb.Name == "__address__" {
-							continue
-						}
-						item.Add(lb.Name, lb.Value)
-					}
+// getSharedConfig 按 baseDir 和 rule 文件内容的 hash 缓存解析好的配置，内容不变就一直复用。
+// rule 文件里有 secret 引用的话，缓存时间不超过 -secret.cacheTTL，这样 secret 轮换之后能重新解析
+func (j *JobGoroutine) getSharedConfig(plugin plugins.Plugin, baseDir string, tomlBytes []byte) (any, error) {
+	d := xxhash.New()
+	_, _ = d.WriteString(baseDir)
+	_, _ = d.Write([]byte{0})
+	_, _ = d.Write(tomlBytes)
+	hash := d.Sum64()
+
+	if sc := j.sharedConfig.Load(); sc != nil && sc.hash == hash && (!sc.hasSecrets || time.Since(sc.parsedAt) < secret.CacheTTL()) {
+		return sc.config, nil
+	}
 
-					for tagk, tagv := range tags {
-						item.Add(tagk, tagv)
-					}
+	config, err := plugin.ParseConfig(baseDir, tomlBytes)
+	if err != nil {
+		return nil, err
+	}
 
-					if len(k) == 0 {
-						item.Add("__name__", metrics[i].Name())
-					} else {
-						name := metrics[i].Name()
-						if len(name) == 0 {
-							item.Add("__name__", k)
-						} else {
-							item.Add("__name__", name+"_"+k)
-						}
-					}
+	j.sharedConfig.Store(&sharedConfig{hash: hash, parsedAt: time.Now(), config: config, hasSecrets: secret.HasReferences(tomlBytes)})
+	return config, nil
+}
 
-					item.RemoveDuplicates()
+// readRuleFiles 读取 rule 文件并拼接在一起，文件内容会缓存 5s，避免每次抓取都读文件
+func readRuleFiles(baseDir string, ruleFiles []string) ([]byte, error) {
+	var bytesBuffer bytes.Buffer
+	for _, ruleFile := range ruleFiles {
+		ruleFilePath := fs.GetFilepath(baseDir, ruleFile)
 
-					// metric relabel
-					item.Labels = j.scrapeConfig.ParsedMetricRelabelConfigs.Apply(item.Labels, 0)
-					item.RemoveMetaLabels()
+		data := CacheGetBytes(ruleFilePath)
+		if data == nil {
+			var err error
+			data, err = fs.ReadFileOrHTTP(ruleFilePath)
+			if err != nil {
+				return nil, fmt.Errorf("read rule file(%s) error: %s", ruleFile, err)
+			}
 
-					point := prompbmarshal.Sample{
-						Value:     float64v,
-						Timestamp: now.UnixMilli(),
-					}
+			data, err = envtemplate.ReplaceBytes(data)
+			if err != nil {
+				return nil, fmt.Errorf("replace env in rule file(%s) error: %s", ruleFile, err)
+			}
 
-					ts := prompbmarshal.TimeSeries{
-						Labels:  item.Labels,
-						Samples: []prompbmarshal.Sample{point},
-					}
+			CacheSetBytes(ruleFilePath, data, time.Second*5)
+		}
+
+		bytesBuffer.Write(data)
+		bytesBuffer.Write([]byte("\n"))
+		bytesBuffer.Write([]byte("\n"))
+	}
+
+	return bytesBuffer.Bytes(), nil
+}
+
+// convertSamples 把插件抓取到的数据转换成 []prompbmarshal.TimeSeries，同时附加 target 的标签并做 metric relabel
+func (j *JobGoroutine) convertSamples(sc *ScrapeConfig, pt *promutils.Labels, metrics []metric.Metric, now time.Time) []prompbmarshal.TimeSeries {
+	// 最终转换之后的数据结果集
+	var ret []prompbmarshal.TimeSeries
+
+	for i := range metrics {
+		// 统一在这里设置时间
+		if metrics[i].Time() == 0 {
+			metrics[i].SetTime(now.UnixMilli())
+		}
 
-					ret = append(ret, ts)
+		// 一个 telegraf metric 有多个 fields，每个 field 都是一个 prometheus metric
+		tags := metrics[i].Tags()
+		fields := metrics[i].Fields()
+
+		for k, v := range fields {
+			float64v, err := conv.ToFloat64(v)
+			if err != nil {
+				continue
+			}
+
+			item := promutils.NewLabels(len(tags) + pt.Len())
+
+			for _, lb := range pt.GetLabels() {
+				// 覆盖插件配置的标签里可能有密码，不能带到 series 上
+				if lb.Name == "__address__" || plugins.IsTargetParamLabel(lb.Name) {
+					continue
 				}
+				item.Add(lb.Name, lb.Value)
 			}
 
-			writer.WriteTimeSeries(ret)
+			for tagk, tagv := range tags {
+				item.Add(tagk, tagv)
+			}
 
-		}(parsedTarget)
+			name := metrics[i].Name()
+			metricName := name
+			if len(k) > 0 {
+				if len(name) == 0 {
+					metricName = k
+				} else {
+					metricName = name + "_" + k
+				}
+			}
+			item.Add("__name__", metricName)
+
+			item.RemoveDuplicates()
+
+			// metric relabel
+			item.Labels = sc.ParsedMetricRelabelConfigs.Apply(item.Labels, 0)
+			item.RemoveMetaLabels()
+			if item.Len() == 0 {
+				// dropped by metric_relabel_configs
+				continue
+			}
+
+			// cprobe 内部使用的标签在 relabel 之后再加，metric_relabel_configs 看不到也改不了它们
+			if len(k) > 0 && len(name) > 0 && item.Get("__name__") == metricName {
+				// influx 之类的 writer 需要还原 measurement 和 field，relabel 改了指标名就以新的指标名为准
+				item.Add(types.LabelMeasurement, name)
+				item.Add(types.LabelField, k)
+			}
+			item.Add(types.LabelPlugin, j.plugin)
+			if tp := metrics[i].Type(); tp != metric.Untyped {
+				item.Add(types.LabelType, tp.String())
+			}
+			if help := metrics[i].Help(); help != "" {
+				item.Add(types.LabelHelp, help)
+			}
+			if unit := metrics[i].Unit(); unit != "" {
+				item.Add(types.LabelUnit, unit)
+			}
+			if created := metrics[i].Created(); created > 0 {
+				item.Add(types.LabelCreated, strconv.FormatInt(created, 10))
+			}
+
+			point := prompbmarshal.Sample{
+				Value:     float64v,
+				Timestamp: metrics[i].Time(),
+			}
+
+			ts := prompbmarshal.TimeSeries{
+				Labels:  item.Labels,
+				Samples: []prompbmarshal.Sample{point},
+			}
+
+			ret = append(ret, ts)
+		}
 	}
 
-	wg.Wait()
+	return ret
+}
+
+// applySeriesLimit 丢弃超过 series_limit 的新 series，已经出现过的 series 不受影响
+func applySeriesLimit(jobName string, limiter *seriesLimiter, tss []prompbmarshal.TimeSeries) []prompbmarshal.TimeSeries {
+	if limiter == nil {
+		return tss
+	}
+
+	dst := tss[:0]
+	dropped := 0
+	for i := range tss {
+		if !limiter.Add(hashLabels(tss[i].Labels)) {
+			dropped++
+			continue
+		}
+		dst = append(dst, tss[i])
+	}
+
+	if dropped > 0 {
+		samplesDroppedTotal(jobName, "series_limit").Add(dropped)
+	}
+
+	return dst
 }
 
-func (j *JobGoroutine) parseTarget(job string, target *promutils.Labels) *promutils.Labels {
+func hashLabels(labels []prompbmarshal.Label) uint64 {
+	d := xxhash.New()
+	for _, label := range labels {
+		if label.Name == types.LabelCreated {
+			// the created timestamp changes when the counter is reset, the series stays the same
+			continue
+		}
+		_, _ = d.WriteString(label.Name)
+		_, _ = d.WriteString("\xff")
+		_, _ = d.WriteString(label.Value)
+		_, _ = d.WriteString("\xff")
+	}
+	return d.Sum64()
+}
+
+func samplesDroppedTotal(jobName, reason string) *metrics.Counter {
+	return metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_samples_dropped_total{job=%q,reason=%q}`, jobName, reason))
+}
+
+func parseTarget(sc *ScrapeConfig, target *promutils.Labels) *promutils.Labels {
 	labels := promutils.GetLabels()
 	defer promutils.PutLabels(labels)
 
-	labels.Add("job", job)
-	if j.scrapeConfig.ConfigRef.Global.ExternalLabels != nil {
-		labels.AddFrom(j.scrapeConfig.ConfigRef.Global.ExternalLabels)
+	labels.Add("job", sc.JobName)
+	if sc.ConfigRef.Global.ExternalLabels != nil {
+		labels.AddFrom(sc.ConfigRef.Global.ExternalLabels)
 	}
 
 	instanceBlank := labels.Get("instance") == ""
@@ -294,7 +612,7 @@ func (j *JobGoroutine) parseTarget(job string, target *promutils.Labels) *promut
 	}
 
 	labels.RemoveDuplicates()
-	labels.Labels = j.scrapeConfig.ParsedRelabelConfigs.Apply(labels.Labels, 0)
+	labels.Labels = sc.ParsedRelabelConfigs.Apply(labels.Labels, 0)
 	labels.RemoveMetaLabels()
 
 	if labels.Len() == 0 {
@@ -311,8 +629,50 @@ func (j *JobGoroutine) parseTarget(job string, target *promutils.Labels) *promut
 	return labelsCopy
 }
 
+// Prometheus 给 /probe 风格的 exporter 保留的 URL 参数，blackbox 风格的 relabel 配置会设置它们，不是插件配置
+var reservedTargetParams = map[string]struct{}{
+	"target": {},
+	"module": {},
+}
+
+// targetParams 从 relabel 之后的 target 标签里提取插件配置的覆盖项，key 是 toml key
+func targetParams(pt *promutils.Labels) map[string]string {
+	var params map[string]string
+	for _, lb := range pt.GetLabels() {
+		key, ok := plugins.TargetParamFromLabel(lb.Name)
+		if !ok {
+			continue
+		}
+		if _, reserved := reservedTargetParams[key]; reserved && strings.HasPrefix(lb.Name, plugins.TargetLabelParamPrefix) {
+			continue
+		}
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[key] = lb.Value
+	}
+	return params
+}
+
+// targetLabels 返回 target 上最终会附加到 series 的标签，__ 开头的内部标签不算
+func targetLabels(pt *promutils.Labels) map[string]string {
+	labels := make(map[string]string, pt.Len())
+	for _, lb := range pt.GetLabels() {
+		if strings.HasPrefix(lb.Name, "__") {
+			continue
+		}
+		labels[lb.Name] = lb.Value
+	}
+	return labels
+}
+
 func (j *JobGoroutine) Stop() {
 	close(j.quitChan)
+
+	j.Lock()
+	defer j.Unlock()
+	j.seriesLimiter.retire()
+	j.seriesLimiter = nil
 }
 
 func loadStaticConfigs(path string) ([]StaticConfig, error) {
@@ -331,10 +691,10 @@ func loadStaticConfigs(path string) ([]StaticConfig, error) {
 	return stcs, nil
 }
 
-func (j *JobGoroutine) getTargets() (targets []*promutils.Labels) {
-	baseDir := j.scrapeConfig.ConfigRef.BaseDir
+func getTargets(sc *ScrapeConfig) (targets []*promutils.Labels) {
+	baseDir := sc.ConfigRef.BaseDir
 
-	for _, c := range j.scrapeConfig.StaticConfigs {
+	for _, c := range sc.StaticConfigs {
 		for _, t := range c.Targets {
 			m := promutils.NewLabels(1 + c.Labels.Len())
 			m.AddFrom(c.Labels)
@@ -344,7 +704,7 @@ func (j *JobGoroutine) getTargets() (targets []*promutils.Labels) {
 		}
 	}
 
-	for _, c := range j.scrapeConfig.FileSDConfigs {
+	for _, c := range sc.FileSDConfigs {
 		for _, file := range c.Files {
 			pathPattern := fs.GetFilepath(baseDir, file)
 			paths := []string{pathPattern}
@@ -353,7 +713,7 @@ func (j *JobGoroutine) getTargets() (targets []*promutils.Labels) {
 				paths, err = filepath.Glob(pathPattern)
 				if err != nil {
 					// Do not return this error, since other files may contain valid scrape configs.
-					logger.Errorf("skipping entry %q in `file_sd_config->files` for job_name=%s because of error: %s", file, j.scrapeConfig.JobName, err)
+					logger.Errorf("skipping entry %q in `file_sd_config->files` for job_name=%s because of error: %s", file, sc.JobName, err)
 					continue
 				}
 			}
@@ -361,7 +721,7 @@ func (j *JobGoroutine) getTargets() (targets []*promutils.Labels) {
 				stcs, err := loadStaticConfigs(path)
 				if err != nil {
 					// Do not return this error, since other paths may contain valid scrape configs.
-					logger.Errorf("skipping file %s for job_name=%s at `file_sd_configs` because of error: %s", path, j.scrapeConfig.JobName, err)
+					logger.Errorf("skipping file %s for job_name=%s at `file_sd_configs` because of error: %s", path, sc.JobName, err)
 					continue
 				}
 
@@ -387,10 +747,10 @@ func (j *JobGoroutine) getTargets() (targets []*promutils.Labels) {
 		}
 	}
 
-	for _, c := range j.scrapeConfig.HTTPSDConfigs {
+	for _, c := range sc.HTTPSDConfigs {
 		arr, err := c.GetLabels(baseDir)
 		if err != nil {
-			logger.Errorf("job(%s) http_sd_configs(%s) get targets error: %s", j.scrapeConfig.JobName, c.URL, err)
+			logger.Errorf("job(%s) http_sd_configs(%s) get targets error: %s", sc.JobName, c.URL, err)
 			continue
 		}
 		targets = append(targets, arr...)
@@ -398,91 +758,91 @@ func (j *JobGoroutine) getTargets() (targets []*promutils.Labels) {
 
 	// TODO: 下面的代码是 copilot 自动生成的，尚未验证过，对于 cprobe 而言，核心就是 static、file_sd、http_sd 基本就够用了
 
-	for _, c := range j.scrapeConfig.DNSSDConfigs {
+	for _, c := range sc.DNSSDConfigs {
 		arr, err := c.GetLabels(baseDir)
 		if err != nil {
-			logger.Errorf("job(%s) dns_sd_configs(%s) get targets error: %s", j.scrapeConfig.JobName, c.Names, err)
+			logger.Errorf("job(%s) dns_sd_configs(%s) get targets error: %s", sc.JobName, c.Names, err)
 			continue
 		}
 		targets = append(targets, arr...)
 	}
 
-	for _, c := range j.scrapeConfig.AzureSDConfigs {
+	for _, c := range sc.AzureSDConfigs {
 		arr, err := c.GetLabels(baseDir)
 		if err != nil {
-			logger.Errorf("job(%s) azure_sd_configs(%s) get targets error: %s", j.scrapeConfig.JobName, c.SubscriptionID, err)
+			logger.Errorf("job(%s) azure_sd_configs(%s) get targets error: %s", sc.JobName, c.SubscriptionID, err)
 			continue
 		}
 		targets = append(targets, arr...)
 	}
 
-	for _, c := range j.scrapeConfig.DockerSDConfigs {
+	for _, c := range sc.DockerSDConfigs {
 		arr, err := c.GetLabels(baseDir)
 		if err != nil {
-			logger.Errorf("job(%s) docker_sd_configs(%s) get targets error: %s", j.scrapeConfig.JobName, c.Host, err)
+			logger.Errorf("job(%s) docker_sd_configs(%s) get targets error: %s", sc.JobName, c.Host, err)
 			continue
 		}
 		targets = append(targets, arr...)
 	}
 
-	for _, c := range j.scrapeConfig.DockerSwarmSDConfigs {
+	for _, c := range sc.DockerSwarmSDConfigs {
 		arr, err := c.GetLabels(baseDir)
 		if err != nil {
-			logger.Errorf("job(%s) dockerswarm_sd_configs(%s) get targets error: %s", j.scrapeConfig.JobName, c.Host, err)
+			logger.Errorf("job(%s) dockerswarm_sd_configs(%s) get targets error: %s", sc.JobName, c.Host, err)
 			continue
 		}
 		targets = append(targets, arr...)
 	}
 
-	for _, c := range j.scrapeConfig.EC2SDConfigs {
+	for _, c := range sc.EC2SDConfigs {
 		arr, err := c.GetLabels(baseDir)
 		if err != nil {
-			logger.Errorf("job(%s) ec2_sd_configs(%s) get targets error: %s", j.scrapeConfig.JobName, c.Region, err)
+			logger.Errorf("job(%s) ec2_sd_configs(%s) get targets error: %s", sc.JobName, c.Region, err)
 			continue
 		}
 		targets = append(targets, arr...)
 	}
 
-	for _, c := range j.scrapeConfig.EurekaSDConfigs {
+	for _, c := range sc.EurekaSDConfigs {
 		arr, err := c.GetLabels(baseDir)
 		if err != nil {
-			logger.Errorf("job(%s) eureka_sd_configs(%s) get targets error: %s", j.scrapeConfig.JobName, c.Server, err)
+			logger.Errorf("job(%s) eureka_sd_configs(%s) get targets error: %s", sc.JobName, c.Server, err)
 			continue
 		}
 		targets = append(targets, arr...)
 	}
 
-	for _, c := range j.scrapeConfig.GCESDConfigs {
+	for _, c := range sc.GCESDConfigs {
 		arr, err := c.GetLabels(baseDir)
 		if err != nil {
-			logger.Errorf("job(%s) gce_sd_configs(%s) get targets error: %s", j.scrapeConfig.JobName, c.Project, err)
+			logger.Errorf("job(%s) gce_sd_configs(%s) get targets error: %s", sc.JobName, c.Project, err)
 			continue
 		}
 		targets = append(targets, arr...)
 	}
 
-	for _, c := range j.scrapeConfig.DigitaloceanSDConfigs {
+	for _, c := range sc.DigitaloceanSDConfigs {
 		arr, err := c.GetLabels(baseDir)
 		if err != nil {
-			logger.Errorf("job(%s) digitalocean_sd_configs(%s:%d) get targets error: %s", j.scrapeConfig.JobName, c.Server, c.Port, err)
+			logger.Errorf("job(%s) digitalocean_sd_configs(%s:%d) get targets error: %s", sc.JobName, c.Server, c.Port, err)
 			continue
 		}
 		targets = append(targets, arr...)
 	}
 
-	for _, c := range j.scrapeConfig.OpenStackSDConfigs {
+	for _, c := range sc.OpenStackSDConfigs {
 		arr, err := c.GetLabels(baseDir)
 		if err != nil {
-			logger.Errorf("job(%s) openstack_sd_configs(%s) get targets error: %s", j.scrapeConfig.JobName, c.IdentityEndpoint, err)
+			logger.Errorf("job(%s) openstack_sd_configs(%s) get targets error: %s", sc.JobName, c.IdentityEndpoint, err)
 			continue
 		}
 		targets = append(targets, arr...)
 	}
 
-	for _, c := range j.scrapeConfig.YandexCloudSDConfigs {
+	for _, c := range sc.YandexCloudSDConfigs {
 		arr, err := c.GetLabels(baseDir)
 		if err != nil {
-			logger.Errorf("job(%s) yandexcloud_sd_configs(%s) get targets error: %s", j.scrapeConfig.JobName, c.APIEndpoint, err)
+			logger.Errorf("job(%s) yandexcloud_sd_configs(%s) get targets error: %s", sc.JobName, c.APIEndpoint, err)
 			continue
 		}
 		targets = append(targets, arr...)
@@ -0,0 +1,355 @@
+package probe
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/lib/promrelabel"
+	"github.com/cprobe/cprobe/lib/promutils"
+	"github.com/cprobe/cprobe/plugins"
+	"github.com/cprobe/cprobe/types"
+	"github.com/cprobe/cprobe/types/metric"
+)
+
+// newTestJob registers p as pluginName and returns a job scraping targets with it
+func newTestJob(t *testing.T, pluginName string, p plugins.Plugin, sc *ScrapeConfig, targets ...string) *JobGoroutine {
+	t.Helper()
+
+	plugins.RegisterPlugin(pluginName, p)
+
+	haLeaderUntil.Store(math.MaxInt64)
+	t.Cleanup(func() { haLeaderUntil.Store(0) })
+
+	sc.JobName = pluginName
+	sc.ConfigRef = &Config{BaseDir: t.TempDir()}
+	sc.ScrapeConcurrency = 1
+	sc.StaticConfigs = []StaticConfig{{Targets: targets}}
+
+	j := NewJobGoroutine(pluginName, sc)
+	t.Cleanup(j.Stop)
+	return j
+}
+
+// testSink collects the series of every sink call
+type testSink struct {
+	mu    sync.Mutex
+	calls [][]prompbmarshal.TimeSeries
+}
+
+func (s *testSink) sink(tss []prompbmarshal.TimeSeries) {
+	s.mu.Lock()
+	s.calls = append(s.calls, tss)
+	s.mu.Unlock()
+}
+
+// values returns the values of the series named name in all the calls
+func (s *testSink) values(name string) []float64 {
+	var values []float64
+	for _, tss := range s.calls {
+		for _, ts := range tss {
+			for _, label := range ts.Labels {
+				if label.Name == "__name__" && label.Value == name {
+					values = append(values, ts.Samples[0].Value)
+				}
+			}
+		}
+	}
+	return values
+}
+
+// streamPlugin streams lines samples in the text format, the body is broken after them if broken is set
+type streamPlugin struct {
+	lines   int
+	broken  bool
+	keepAll bool
+}
+
+func (p *streamPlugin) ParseConfig(string, []byte) (any, error) { return p, nil }
+
+func (p *streamPlugin) Scrape(_ context.Context, _ string, _ any, ss *types.Samples) error {
+	var sb strings.Builder
+	for i := 0; i < p.lines; i++ {
+		fmt.Fprintf(&sb, "stream_test{i=\"%d\"} 1\n", i)
+	}
+	if p.broken {
+		sb.WriteString("not prometheus text {\n")
+	}
+	return ss.AddMetricsStream(strings.NewReader(sb.String()), &types.StreamParseOptions{KeepAll: p.keepAll})
+}
+
+func TestTargetParams(t *testing.T) {
+	pt := promutils.NewLabels(5)
+	pt.Add("__address__", "127.0.0.1:3306")
+	pt.Add("__cprobe_user", "alice")
+	pt.Add("__param_target", "127.0.0.1:3306")
+	pt.Add("__param_module", "rule.toml")
+	pt.Add("__param_database", "db1")
+
+	params := targetParams(pt)
+	expected := map[string]string{"user": "alice", "database": "db1"}
+	if !reflect.DeepEqual(params, expected) {
+		t.Fatalf("unexpected params: got %v, want %v", params, expected)
+	}
+
+	pt = promutils.NewLabels(1)
+	pt.Add("__param_target", "127.0.0.1:3306")
+	if params = targetParams(pt); params != nil {
+		t.Fatalf("expecting nil params, got %v", params)
+	}
+}
+
+func TestConvertSamplesInternalLabels(t *testing.T) {
+	// the internal labels are invisible to metric_relabel_configs
+	pcs, err := promrelabel.ParseRelabelConfigsData([]byte(`
+- action: drop
+  source_labels: [__plugin__]
+  regex: mysql
+- action: labeldrop
+  regex: "__(type|measurement|field)__"
+- action: replace
+  source_labels: [__name__]
+  regex: mysql_threads
+  target_label: __name__
+  replacement: mysql_threads_running
+`))
+	if err != nil {
+		t.Fatalf("cannot parse relabel configs: %s", err)
+	}
+
+	j := &JobGoroutine{plugin: types.PluginMySQL}
+	sc := &ScrapeConfig{ParsedMetricRelabelConfigs: pcs}
+
+	pt := promutils.NewLabels(1)
+	pt.Add("instance", "a:3306")
+	ms := []metric.Metric{
+		metric.New("mysql", map[string]string{"db": "x"}, map[string]interface{}{"up": 1}, 0, metric.Gauge),
+		metric.New("mysql", nil, map[string]interface{}{"threads": 12}, 0),
+	}
+	ms[0].SetMetadata("Whether mysql is up.", "")
+	ms[0].SetCreated(900)
+
+	tss := j.convertSamples(sc, pt, ms, time.Now())
+	if len(tss) != 2 {
+		t.Fatalf("unexpected number of series: %d", len(tss))
+	}
+
+	got := make(map[string]map[string]string)
+	for _, ts := range tss {
+		labels := make(map[string]string)
+		for _, label := range ts.Labels {
+			labels[label.Name] = label.Value
+		}
+		got[labels["__name__"]] = labels
+	}
+
+	expected := map[string]map[string]string{
+		"mysql_up": {
+			"__name__": "mysql_up", "instance": "a:3306", "db": "x",
+			types.LabelMeasurement: "mysql", types.LabelField: "up", types.LabelPlugin: "mysql", types.LabelType: "gauge",
+			types.LabelHelp: "Whether mysql is up.", types.LabelCreated: "900",
+		},
+		// renamed by relabeling, so the measurement and the field are gone
+		"mysql_threads_running": {
+			"__name__": "mysql_threads_running", "instance": "a:3306", types.LabelPlugin: "mysql",
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected series:\ngot  %v\nwant %v", got, expected)
+	}
+}
+
+func TestScrapeStream(t *testing.T) {
+	f := func(name string, p *streamPlugin, sampleLimit int, expectedSinks, expectedSamples int, expectedUp float64) {
+		t.Helper()
+
+		j := newTestJob(t, name, p, &ScrapeConfig{SampleLimit: sampleLimit}, "a:9100")
+		var s testSink
+		j.scrape(context.Background(), "", s.sink)
+
+		if len(s.calls) != expectedSinks {
+			t.Fatalf("%s: unexpected number of sink calls: got %d, want %d", name, len(s.calls), expectedSinks)
+		}
+		if n := len(s.values("stream_test")); n != expectedSamples {
+			t.Fatalf("%s: unexpected number of samples: got %d, want %d", name, n, expectedSamples)
+		}
+		if up := s.values(name + "_cprobe_up"); len(up) != 1 || up[0] != expectedUp {
+			t.Fatalf("%s: unexpected cprobe_up: %v", name, up)
+		}
+	}
+
+	// sent in chunks if there is no limit
+	f("stream_test_chunks", &streamPlugin{lines: 2*streamFlushSamples + 10}, 0, 3, 2*streamFlushSamples+10, 1)
+	// the chunks sent before a parse error are kept, the rest is dropped
+	f("stream_test_broken", &streamPlugin{lines: 2*streamFlushSamples + 10, broken: true}, 0, 3, 2*streamFlushSamples, 0)
+
+	// all or nothing with the sample_limit of the job
+	f("stream_test_job_limit", &streamPlugin{lines: 2*streamFlushSamples + 10}, 3*streamFlushSamples, 1, 2*streamFlushSamples+10, 1)
+	f("stream_test_job_limit_exceeded", &streamPlugin{lines: 2*streamFlushSamples + 10}, streamFlushSamples, 1, 0, 0)
+
+	// all or nothing if the plugin keeps the samples, e.g. body_size_limit is set
+	f("stream_test_keep_all", &streamPlugin{lines: 2*streamFlushSamples + 10, keepAll: true}, 0, 1, 2*streamFlushSamples+10, 1)
+	f("stream_test_keep_all_broken", &streamPlugin{lines: 2*streamFlushSamples + 10, keepAll: true, broken: true}, 0, 1, 0, 0)
+}
+
+// countPlugin adds n samples with distinct labels, Scrape waits for block to be closed if it is set
+type countPlugin struct {
+	n       int
+	block   chan struct{}
+	started chan struct{}
+}
+
+func (p *countPlugin) ParseConfig(string, []byte) (any, error) { return p, nil }
+
+func (p *countPlugin) Scrape(_ context.Context, _ string, _ any, ss *types.Samples) error {
+	if p.block != nil {
+		close(p.started)
+		<-p.block
+	}
+	for i := 0; i < p.n; i++ {
+		ss.AddMetric("count_test", map[string]interface{}{"value": 1}, map[string]string{"i": fmt.Sprint(i)})
+	}
+	return nil
+}
+
+func TestScrapeLimits(t *testing.T) {
+	f := func(name string, samples, sampleLimit, seriesLimit int, expectedSamples int, expectedUp float64, expectedDropped map[string]float64) {
+		t.Helper()
+
+		j := newTestJob(t, name, &countPlugin{n: samples}, &ScrapeConfig{SampleLimit: sampleLimit, SeriesLimit: seriesLimit}, "a:9100")
+
+		// series_limit keeps the same series across the scrapes, so the second scrape is the same as the first one
+		for run := 1; run <= 2; run++ {
+			var s testSink
+			j.scrape(context.Background(), "", s.sink)
+
+			if n := len(s.values("count_test_value")); n != expectedSamples {
+				t.Fatalf("%s: unexpected number of samples: got %d, want %d", name, n, expectedSamples)
+			}
+			if up := s.values(name + "_cprobe_up"); len(up) != 1 || up[0] != expectedUp {
+				t.Fatalf("%s: unexpected cprobe_up: %v", name, up)
+			}
+			if scraped := s.values(name + "_cprobe_samples_scraped"); len(scraped) != 1 || scraped[0] != float64(samples) {
+				t.Fatalf("%s: unexpected cprobe_samples_scraped: %v", name, scraped)
+			}
+
+			dropped := make(map[string]float64)
+			for _, tss := range s.calls {
+				for _, ts := range tss {
+					if promrelabel.GetLabelByName(ts.Labels, "__name__").Value == name+"_cprobe_samples_dropped" {
+						dropped[promrelabel.GetLabelByName(ts.Labels, "reason").Value] = ts.Samples[0].Value
+					}
+				}
+			}
+			if !reflect.DeepEqual(dropped, expectedDropped) {
+				t.Fatalf("%s: unexpected cprobe_samples_dropped: got %v, want %v", name, dropped, expectedDropped)
+			}
+
+			for reason, n := range expectedDropped {
+				if total := samplesDroppedTotal(name, reason).Get(); total != uint64(n)*uint64(run) {
+					t.Fatalf("%s: unexpected cprobe_samples_dropped_total{reason=%q}: got %d, want %d", name, reason, total, uint64(n)*uint64(run))
+				}
+			}
+		}
+	}
+
+	f("limits_test_none", 10, 0, 0, 10, 1, map[string]float64{})
+	f("limits_test_sample_limit_ok", 10, 10, 0, 10, 1, map[string]float64{})
+	// the whole scrape is rejected
+	f("limits_test_sample_limit_exceeded", 11, 10, 0, 0, 0, map[string]float64{"sample_limit": 11})
+	f("limits_test_series_limit_ok", 10, 0, 10, 10, 1, map[string]float64{})
+	// only the new series over the limit are dropped, the scrape is fine
+	f("limits_test_series_limit_exceeded", 10, 0, 4, 4, 1, map[string]float64{"series_limit": 6})
+	// series_limit isn't checked for the rejected scrapes
+	f("limits_test_both_exceeded", 11, 10, 4, 0, 0, map[string]float64{"sample_limit": 11})
+}
+
+func TestScrapeSeriesLimiterUpdate(t *testing.T) {
+	p := &countPlugin{n: 5, block: make(chan struct{}), started: make(chan struct{})}
+	j := newTestJob(t, "limiter_update_test", p, &ScrapeConfig{SeriesLimit: 2}, "a:9100")
+
+	var s testSink
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		j.scrape(context.Background(), "", s.sink)
+	}()
+
+	// the in-flight scrape keeps its config and limiter
+	<-p.started
+	sc := *j.getScrapeConfig()
+	sc.SeriesLimit = 100
+	j.UpdateConfig(&sc)
+	close(p.block)
+	<-done
+
+	if n := len(s.values("count_test_value")); n != 2 {
+		t.Fatalf("unexpected number of samples of the in-flight scrape: got %d, want 2", n)
+	}
+
+	p.block = nil
+	s = testSink{}
+	j.scrape(context.Background(), "", s.sink)
+	if n := len(s.values("count_test_value")); n != 5 {
+		t.Fatalf("unexpected number of samples after the update: got %d, want 5", n)
+	}
+}
+
+// clonePlugin counts the ParseConfig calls, its config can be shared by the targets
+type clonePlugin struct {
+	parsed atomic.Int32
+}
+
+func (p *clonePlugin) ParseConfig(string, []byte) (any, error) {
+	p.parsed.Add(1)
+	return &struct{}{}, nil
+}
+
+func (p *clonePlugin) CloneConfig(cfg any) any { return &struct{}{} }
+
+func (p *clonePlugin) Scrape(context.Context, string, any, *types.Samples) error { return nil }
+
+func TestScrapeSharedConfig(t *testing.T) {
+	f := func(name, rule string, cacheTTL string, expectedParsed int32) {
+		t.Helper()
+
+		old := flag.Lookup("secret.cacheTTL").Value.String()
+		if err := flag.Set("secret.cacheTTL", cacheTTL); err != nil {
+			t.Fatalf("cannot set -secret.cacheTTL: %s", err)
+		}
+		defer func() { _ = flag.Set("secret.cacheTTL", old) }()
+
+		p := &clonePlugin{}
+		j := newTestJob(t, name, p, &ScrapeConfig{ScrapeRuleFiles: []string{"rule.toml"}}, "a:9100", "b:9100", "c:9100")
+		if err := os.WriteFile(filepath.Join(j.getScrapeConfig().ConfigRef.BaseDir, "rule.toml"), []byte(rule), 0o600); err != nil {
+			t.Fatalf("cannot write rule file: %s", err)
+		}
+
+		for run := 0; run < 3; run++ {
+			if n := j.scrape(context.Background(), "", func([]prompbmarshal.TimeSeries) {}); n != 3 {
+				t.Fatalf("%s: unexpected number of scraped targets: %d", name, n)
+			}
+		}
+		if n := p.parsed.Load(); n != expectedParsed {
+			t.Fatalf("%s: unexpected number of ParseConfig calls: got %d, want %d", name, n, expectedParsed)
+		}
+	}
+
+	// parsed once for all the targets and scrapes
+	f("shared_config_test_plain", `user = "root"`, "5m", 1)
+	// the config without secret references doesn't depend on -secret.cacheTTL
+	f("shared_config_test_plain_no_cache", `user = "root"`, "0s", 1)
+	f("shared_config_test_secret", `password = "${vault:secret/mysql#password}"`, "5m", 1)
+	// the secrets aren't cached, so the config holding them is parsed for every scrape, still once for all the targets
+	f("shared_config_test_secret_no_cache", `password = "${vault:secret/mysql#password}"`, "0s", 3)
+}
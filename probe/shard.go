@@ -0,0 +1,90 @@
+package probe
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+var (
+	shardCount             = flag.Int("shard.count", 1, "The number of cprobe instances sharing the targets. Every instance scrapes only its share of targets if it is bigger than 1")
+	shardIndex             = flag.Int("shard.index", 0, "The index of this cprobe instance among -shard.count instances, starting from 0")
+	shardReplicationFactor = flag.Int("shard.replicationFactor", 1, "The number of cprobe instances scraping every target. Set it to 2 or bigger for HA, "+
+		"remote storage should be able to deduplicate the data in this case")
+)
+
+func checkShardFlags() error {
+	if *shardCount < 1 {
+		return fmt.Errorf("-shard.count must be bigger than 0, got %d", *shardCount)
+	}
+
+	if *shardIndex < 0 || *shardIndex >= *shardCount {
+		return fmt.Errorf("-shard.index must be in the range [0, %d), got %d", *shardCount, *shardIndex)
+	}
+
+	if *shardReplicationFactor < 1 || *shardReplicationFactor > *shardCount {
+		return fmt.Errorf("-shard.replicationFactor must be in the range [1, %d], got %d", *shardCount, *shardReplicationFactor)
+	}
+
+	return nil
+}
+
+// isOwnTarget 根据 relabel 之后的 target 标签判断这个 target 是否归当前实例抓取。
+// parseTarget 合并进来的 global external_labels 每个实例可能不一样（比如 replica），这些标签不参与 hash，
+// 否则各个实例对同一个 target 算出来的 hash 不一样，分片就对不上了
+func isOwnTarget(target, externalLabels *promutils.Labels) bool {
+	if *shardCount <= 1 {
+		return true
+	}
+
+	return isOwnShard(hashTargetLabels(target, externalLabels), *shardCount, *shardIndex, *shardReplicationFactor)
+}
+
+func hashTargetLabels(target, externalLabels *promutils.Labels) uint64 {
+	if externalLabels.Len() == 0 {
+		return hashLabels(target.GetLabels())
+	}
+
+	labels := make([]prompbmarshal.Label, 0, target.Len())
+	for _, label := range target.GetLabels() {
+		if externalLabels.Get(label.Name) != "" {
+			continue
+		}
+		labels = append(labels, label)
+	}
+	return hashLabels(labels)
+}
+
+// isOwnShard 用 rendezvous hashing 分配 target：每个实例对 target 打分，target 归属于分数最高的 replicationFactor 个实例。
+// 实例数变化的时候只有大约 1/count 的 target 换实例，取模的做法几乎所有 target 都要换
+func isOwnShard(h uint64, count, index, replicationFactor int) bool {
+	own := shardScore(h, index)
+
+	// 分数比自己高的实例不到 replicationFactor 个，就归自己
+	higher := 0
+	for i := 0; i < count; i++ {
+		if i == index {
+			continue
+		}
+		score := shardScore(h, i)
+		if score > own || (score == own && i < index) {
+			higher++
+			if higher >= replicationFactor {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func shardScore(h uint64, index int) uint64 {
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[:8], h)
+	binary.LittleEndian.PutUint64(buf[8:], uint64(index))
+	return xxhash.Sum64(buf[:])
+}
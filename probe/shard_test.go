@@ -0,0 +1,83 @@
+package probe
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+// shardOwners returns the instances scraping the target of hash h
+func shardOwners(h uint64, count, replicationFactor int) []int {
+	var owners []int
+	for i := 0; i < count; i++ {
+		if isOwnShard(h, count, i, replicationFactor) {
+			owners = append(owners, i)
+		}
+	}
+	return owners
+}
+
+func TestShardDistribution(t *testing.T) {
+	const targets = 10000
+
+	// the targets are spread evenly, every one is scraped by replicationFactor instances
+	for _, rf := range []int{1, 2} {
+		perInstance := make([]int, 5)
+		for h := uint64(0); h < targets; h++ {
+			owners := shardOwners(h, 5, rf)
+			if len(owners) != rf {
+				t.Fatalf("target %d is scraped by %v, want %d instances", h, owners, rf)
+			}
+			for _, i := range owners {
+				perInstance[i]++
+			}
+		}
+		expected := float64(targets*rf) / 5
+		for i, n := range perInstance {
+			if math.Abs(float64(n)-expected) > expected*0.1 {
+				t.Fatalf("instance %d scrapes %d targets with replicationFactor %d, want about %.0f", i, n, rf, expected)
+			}
+		}
+	}
+
+	// adding an instance moves about 1/6 of the targets, all of them to the new instance
+	moved := 0
+	for h := uint64(0); h < targets; h++ {
+		before := shardOwners(h, 5, 1)[0]
+		after := shardOwners(h, 6, 1)[0]
+		if before == after {
+			continue
+		}
+		if after != 5 {
+			t.Fatalf("target %d moved from instance %d to %d instead of the new instance", h, before, after)
+		}
+		moved++
+	}
+	if expected := float64(targets) / 6; math.Abs(float64(moved)-expected) > expected*0.15 {
+		t.Fatalf("%d targets moved, want about %.0f", moved, expected)
+	}
+}
+
+func TestShardIgnoresExternalLabels(t *testing.T) {
+	// two replicas with different global external_labels, parseTarget merged them into the targets
+	replica := func(name string) (*ScrapeConfig, *promutils.Labels) {
+		externalLabels := promutils.NewLabelsFromMap(map[string]string{"replica": name})
+		return &ScrapeConfig{JobName: "shard_test", ConfigRef: &Config{Global: GlobalConfig{ExternalLabels: externalLabels}}}, externalLabels
+	}
+	scA, externalA := replica("a")
+	scB, externalB := replica("b")
+
+	for i := 0; i < 100; i++ {
+		target := promutils.NewLabelsFromMap(map[string]string{"__address__": fmt.Sprintf("10.0.0.%d:9100", i)})
+		ptA := parseTarget(scA, target)
+		ptB := parseTarget(scB, target)
+		if ptA.Get("replica") != "a" || ptB.Get("replica") != "b" {
+			t.Fatalf("expecting the external labels in the targets, got %s and %s", ptA, ptB)
+		}
+		if hA, hB := hashTargetLabels(ptA, externalA), hashTargetLabels(ptB, externalB); hA != hB {
+			t.Fatalf("target %s: the replicas disagree on the hash: %d vs %d", target, hA, hB)
+		}
+	}
+}
@@ -19,4 +19,28 @@ const (
 	PluginZookeeper     = "zookeeper"
 	PluginNginx         = "nginx"
 	PluginDm            = "dm8"
+	PluginExec          = "exec"
+)
+
+const (
+	// LabelMeasurement and LabelField keep the measurement/field model of a sample,
+	// writers speaking line protocol use them to rebuild the lines, the others drop them.
+	LabelMeasurement = "__measurement__"
+	LabelField       = "__field__"
+
+	// LabelType keeps the Prometheus type of a sample, e.g. counter, for writers like OTLP.
+	// It is absent for untyped samples.
+	LabelType = "__type__"
+
+	// LabelHelp, LabelUnit and LabelCreated keep the metadata of a sample for remote write 2.0,
+	// LabelCreated is the created timestamp in milliseconds. They are absent if unknown.
+	LabelHelp    = "__help__"
+	LabelUnit    = "__unit__"
+	LabelCreated = "__created__"
+
+	// LabelPlugin is the plugin which produced the sample, e.g. mysql.
+	LabelPlugin = "__plugin__"
+
+	// LabelTenant routes a sample to a tenant of multi-tenant storages, it is usually set by relabeling.
+	LabelTenant = "__tenant__"
 )
@@ -0,0 +1,250 @@
+package types
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/cprobe/cprobe/types/metric"
+)
+
+const maxInfluxLineSize = 1024 * 1024
+
+// InfluxLine is a line of Influx line protocol, the tags and fields keep the order in the line
+type InfluxLine struct {
+	Measurement string
+	Tags        []InfluxTag
+	// Fields are the numeric and boolean fields, string fields can't be stored as samples and are dropped
+	Fields      []InfluxField
+	TimestampMs int64
+}
+
+type InfluxTag struct {
+	Key   string
+	Value string
+}
+
+type InfluxField struct {
+	Key   string
+	Value float64
+}
+
+// ParseInfluxLines parses Influx line protocol, precision is the unit of the timestamps, e.g. ns, ms or s,
+// empty means ns. Lines without timestamp get nowMillis.
+func ParseInfluxLines(s, precision string, nowMillis int64) ([]InfluxLine, error) {
+	toMillis, err := influxPrecision(precision)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []InfluxLine
+
+	sc := bufio.NewScanner(strings.NewReader(s))
+	sc.Buffer(make([]byte, 0, 64*1024), maxInfluxLineSize)
+	lineNum := 0
+	for sc.Scan() {
+		lineNum++
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		head, fieldsStr, tsStr, err := splitInfluxLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse line %d: %w", lineNum, err)
+		}
+
+		parts := splitInfluxUnescaped(head, ',', false)
+		il := InfluxLine{
+			Measurement: unescapeInflux(parts[0]),
+			Tags:        make([]InfluxTag, 0, len(parts)-1),
+			TimestampMs: nowMillis,
+		}
+		if il.Measurement == "" {
+			return nil, fmt.Errorf("cannot parse line %d: missing measurement", lineNum)
+		}
+
+		for _, part := range parts[1:] {
+			kv := splitInfluxUnescaped(part, '=', false)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("cannot parse line %d: invalid tag %q", lineNum, part)
+			}
+			il.Tags = append(il.Tags, InfluxTag{Key: unescapeInflux(kv[0]), Value: unescapeInflux(kv[1])})
+		}
+
+		if tsStr != "" {
+			n, err := strconv.ParseInt(tsStr, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse line %d: invalid timestamp %q", lineNum, tsStr)
+			}
+			il.TimestampMs = toMillis(n)
+		}
+
+		for _, field := range splitInfluxUnescaped(fieldsStr, ',', true) {
+			kv := splitInfluxUnescaped(field, '=', false)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("cannot parse line %d: invalid field %q", lineNum, field)
+			}
+
+			value, ok, err := parseInfluxFieldValue(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse line %d: %w", lineNum, err)
+			}
+			if !ok {
+				continue
+			}
+			il.Fields = append(il.Fields, InfluxField{Key: unescapeInflux(kv[0]), Value: value})
+		}
+
+		lines = append(lines, il)
+	}
+
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read body: %w", err)
+	}
+
+	return lines, nil
+}
+
+// AddInfluxLines adds the samples parsed from Influx line protocol, named <measurement>_<field> like AddMetric does.
+// Lines without timestamp get the scrape time.
+func (s *Samples) AddInfluxLines(body, precision string) error {
+	lines, err := ParseInfluxLines(body, precision, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		if len(line.Fields) == 0 {
+			continue
+		}
+
+		tags := make(map[string]string, len(line.Tags))
+		for _, tag := range line.Tags {
+			tags[tag.Key] = tag.Value
+		}
+		fields := make(map[string]interface{}, len(line.Fields))
+		for _, field := range line.Fields {
+			fields[field.Key] = field.Value
+		}
+
+		s.PushFront(metric.New(line.Measurement, tags, fields, line.TimestampMs))
+	}
+
+	return nil
+}
+
+func influxPrecision(precision string) (func(int64) int64, error) {
+	switch precision {
+	case "", "n", "ns":
+		return func(n int64) int64 { return n / 1e6 }, nil
+	case "u", "us", "µ":
+		return func(n int64) int64 { return n / 1e3 }, nil
+	case "ms":
+		return func(n int64) int64 { return n }, nil
+	case "s":
+		return func(n int64) int64 { return n * 1e3 }, nil
+	case "m":
+		return func(n int64) int64 { return n * 60e3 }, nil
+	case "h":
+		return func(n int64) int64 { return n * 3600e3 }, nil
+	default:
+		return nil, fmt.Errorf("unsupported precision %q", precision)
+	}
+}
+
+// splitInfluxLine splits a line into `measurement,tags`, `fields` and `timestamp`
+func splitInfluxLine(line string) (string, string, string, error) {
+	n := indexInfluxUnescaped(line, ' ', false)
+	if n < 0 {
+		return "", "", "", fmt.Errorf("missing fields in %q", line)
+	}
+	head := line[:n]
+	tail := strings.TrimLeft(line[n+1:], " ")
+
+	n = indexInfluxUnescaped(tail, ' ', true)
+	if n < 0 {
+		return head, tail, "", nil
+	}
+	return head, tail[:n], strings.TrimSpace(tail[n+1:]), nil
+}
+
+// indexInfluxUnescaped returns the index of the first sep which isn't escaped, and isn't quoted if quoted is true
+func indexInfluxUnescaped(s string, sep byte, quoted bool) int {
+	inQuote := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\':
+			i++
+		case c == '"' && quoted:
+			inQuote = !inQuote
+		case c == sep && !inQuote:
+			return i
+		}
+	}
+	return -1
+}
+
+// splitInfluxUnescaped splits s by sep, quoted is true for the field set where string values may contain sep
+func splitInfluxUnescaped(s string, sep byte, quoted bool) []string {
+	var parts []string
+	for {
+		n := indexInfluxUnescaped(s, sep, quoted)
+		if n < 0 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:n])
+		s = s[n+1:]
+		if sep == '=' {
+			// the value may contain `=`
+			return append(parts, s)
+		}
+	}
+}
+
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// parseInfluxFieldValue returns false for string fields
+func parseInfluxFieldValue(s string) (float64, bool, error) {
+	if s == "" {
+		return 0, false, fmt.Errorf("missing field value")
+	}
+
+	switch {
+	case s[0] == '"':
+		return 0, false, nil
+	case s == "t" || s == "T" || s == "true" || s == "True" || s == "TRUE":
+		return 1, true, nil
+	case s == "f" || s == "F" || s == "false" || s == "False" || s == "FALSE":
+		return 0, true, nil
+	}
+
+	last := s[len(s)-1]
+	if last == 'i' || last == 'u' {
+		s = s[:len(s)-1]
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid field value %q", s)
+	}
+	if math.IsNaN(v) {
+		return 0, false, nil
+	}
+	return v, true, nil
+}
@@ -13,6 +13,11 @@ type metric struct {
 	tm     int64
 
 	tp ValueType
+
+	// metadata of the metric family, optional
+	help    string
+	unit    string
+	created int64
 }
 
 func New(
@@ -122,6 +127,18 @@ func (m *metric) Type() ValueType {
 	return m.tp
 }
 
+func (m *metric) Help() string {
+	return m.help
+}
+
+func (m *metric) Unit() string {
+	return m.unit
+}
+
+func (m *metric) Created() int64 {
+	return m.created
+}
+
 func (m *metric) SetName(name string) {
 	m.name = name
 }
@@ -238,6 +255,15 @@ func (m *metric) SetTime(t int64) {
 	m.tm = t
 }
 
+func (m *metric) SetMetadata(help, unit string) {
+	m.help = help
+	m.unit = unit
+}
+
+func (m *metric) SetCreated(t int64) {
+	m.created = t
+}
+
 func (m *metric) Copy() Metric {
 	m2 := &metric{
 		name:   m.name,
@@ -245,6 +271,10 @@ func (m *metric) Copy() Metric {
 		fields: make([]*Field, len(m.fields)),
 		tm:     m.tm,
 		tp:     m.tp,
+
+		help:    m.help,
+		unit:    m.unit,
+		created: m.created,
 	}
 
 	for i, tag := range m.tags {
@@ -13,6 +13,38 @@ const (
 	Histogram
 )
 
+// String returns the lower-case Prometheus name of the type, e.g. counter.
+func (t ValueType) String() string {
+	switch t {
+	case Counter:
+		return "counter"
+	case Gauge:
+		return "gauge"
+	case Summary:
+		return "summary"
+	case Histogram:
+		return "histogram"
+	default:
+		return "untyped"
+	}
+}
+
+// ParseValueType is the reverse of ValueType.String, unknown names are Untyped.
+func ParseValueType(s string) ValueType {
+	switch s {
+	case "counter":
+		return Counter
+	case "gauge":
+		return Gauge
+	case "summary":
+		return Summary
+	case "histogram":
+		return Histogram
+	default:
+		return Untyped
+	}
+}
+
 // Tag represents a single tag key and value.
 type Tag struct {
 	Key   string
@@ -58,6 +90,13 @@ type Metric interface {
 	// might interpret, aggregate the values. Used by prometheus and statsd.
 	Type() ValueType
 
+	// Help and Unit return the metadata of the metric family, they are empty if unknown.
+	Help() string
+	Unit() string
+
+	// Created returns the created timestamp mills of a counter, summary or histogram, 0 if unknown.
+	Created() int64
+
 	// SetName sets the metric name.
 	SetName(name string)
 
@@ -102,6 +141,12 @@ type Metric interface {
 	// SetTime sets the timestamp mills of the Metric.
 	SetTime(t int64)
 
+	// SetMetadata sets the help and the unit of the metric family.
+	SetMetadata(help, unit string)
+
+	// SetCreated sets the created timestamp mills.
+	SetCreated(t int64)
+
 	// HashID returns an unique identifier for the series.
 	HashID() uint64
 
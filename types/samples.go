@@ -15,10 +15,15 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type Samples struct {
 	slist *listx.SafeList[metric.Metric]
+
+	// optional hook for streaming parsers, see SetFlushHook
+	flushSize int
+	flushFn   func([]metric.Metric)
 }
 
 func NewSamples() *Samples {
@@ -49,18 +54,21 @@ func (s *Samples) AddPromMetric(m prometheus.Metric) error {
 		tags[v.GetName()] = v.GetValue()
 	}
 
+	// prometheus.Desc doesn't expose the help
+	meta := familyMeta{created: createdMillis(pb)}
+
 	if pb.Gauge != nil {
-		s.AddMetric(desc.Name(), map[string]interface{}{
+		s.addTypedMetric(desc.Name(), map[string]interface{}{
 			"": pb.Gauge.GetValue(),
-		}, tags)
+		}, metric.Gauge, tags)
 	} else if pb.Counter != nil {
-		s.AddMetric(desc.Name(), map[string]interface{}{
+		s.addMetricWithMeta(desc.Name(), map[string]interface{}{
 			"": pb.Counter.GetValue(),
-		}, tags)
+		}, metric.Counter, meta, tags)
 	} else if pb.Summary != nil {
-		s.handleSummary(pb, desc.Name(), tags)
+		s.handleSummary(pb, desc.Name(), meta, tags)
 	} else if pb.Histogram != nil {
-		s.handleHistogram(pb, desc.Name(), tags)
+		s.handleHistogram(pb, desc.Name(), meta, tags)
 	} else {
 		s.AddMetric(desc.Name(), map[string]interface{}{
 			"": pb.Untyped.GetValue(),
@@ -70,45 +78,45 @@ func (s *Samples) AddPromMetric(m prometheus.Metric) error {
 	return nil
 }
 
-func (s *Samples) handleSummary(pb *dto.Metric, metricName string, tags map[string]string) {
+func (s *Samples) handleSummary(pb *dto.Metric, metricName string, meta familyMeta, tags map[string]string) {
 	count := pb.GetSummary().GetSampleCount()
 	sum := pb.GetSummary().GetSampleSum()
 
-	s.AddMetric(metricName, map[string]interface{}{
+	s.addMetricWithMeta(metricName, map[string]interface{}{
 		"count": count,
 		"sum":   sum,
-	}, tags)
+	}, metric.Summary, meta, tags)
 
 	for _, q := range pb.GetSummary().Quantile {
-		s.AddMetric(metricName, map[string]interface{}{
+		s.addMetricWithMeta(metricName, map[string]interface{}{
 			"quantile": q.GetValue(),
-		}, tags, map[string]string{
+		}, metric.Summary, meta, tags, map[string]string{
 			"quantile": fmt.Sprint(q.GetQuantile()),
 		})
 	}
 }
 
-func (s *Samples) handleHistogram(pb *dto.Metric, metricName string, tags map[string]string) {
+func (s *Samples) handleHistogram(pb *dto.Metric, metricName string, meta familyMeta, tags map[string]string) {
 	count := pb.GetHistogram().GetSampleCount()
 	sum := pb.GetHistogram().GetSampleSum()
 
-	s.AddMetric(metricName, map[string]interface{}{
+	s.addMetricWithMeta(metricName, map[string]interface{}{
 		"count": count,
 		"sum":   sum,
-	}, tags)
+	}, metric.Histogram, meta, tags)
 
-	s.AddMetric(metricName, map[string]interface{}{
+	s.addMetricWithMeta(metricName, map[string]interface{}{
 		"bucket": count,
-	}, tags, map[string]string{
+	}, metric.Histogram, meta, tags, map[string]string{
 		"le": "+Inf",
 	})
 
 	for _, b := range pb.GetHistogram().Bucket {
 		le := fmt.Sprint(b.GetUpperBound())
 		value := float64(b.GetCumulativeCount())
-		s.AddMetric(metricName, map[string]interface{}{
+		s.addMetricWithMeta(metricName, map[string]interface{}{
 			"bucket": value,
-		}, tags, map[string]string{
+		}, metric.Histogram, meta, tags, map[string]string{
 			"le": le,
 		})
 	}
@@ -144,13 +152,14 @@ func (s *Samples) AddMetricFamilies(mfs []*dto.MetricFamily) {
 				tags[lb.GetName()] = lb.GetValue()
 			}
 
+			meta := familyMeta{help: mf.GetHelp(), created: createdMillis(m)}
 			if mf.GetType() == dto.MetricType_SUMMARY {
-				s.handleSummary(m, metricName, tags)
+				s.handleSummary(m, metricName, meta, tags)
 			} else if mf.GetType() == dto.MetricType_HISTOGRAM {
-				s.handleHistogram(m, metricName, tags)
+				s.handleHistogram(m, metricName, meta, tags)
 			} else {
 				fields := getNameAndValue(m, metricName)
-				s.AddMetric("", fields, tags)
+				s.addMetricWithMeta("", fields, metricType(mf.GetType()), meta, tags)
 			}
 		}
 	}
@@ -221,6 +230,22 @@ func (s *Samples) addMetricsBody(buf []byte) error {
 }
 
 func (s *Samples) AddMetric(mesurement string, fields map[string]interface{}, tagss ...map[string]string) {
+	s.addTypedMetric(mesurement, fields, metric.Untyped, tagss...)
+}
+
+// addTypedMetric keeps the Prometheus type of the sample, writers like OTLP need it
+func (s *Samples) addTypedMetric(mesurement string, fields map[string]interface{}, tp metric.ValueType, tagss ...map[string]string) {
+	s.addMetricWithMeta(mesurement, fields, tp, familyMeta{}, tagss...)
+}
+
+// familyMeta is the metadata of a metric family which remote write 2.0 sends along with the samples
+type familyMeta struct {
+	help    string
+	unit    string
+	created int64
+}
+
+func (s *Samples) addMetricWithMeta(mesurement string, fields map[string]interface{}, tp metric.ValueType, meta familyMeta, tagss ...map[string]string) {
 	tags := make(map[string]string)
 	for i := range tagss {
 		for k, v := range tagss[i] {
@@ -228,10 +253,46 @@ func (s *Samples) AddMetric(mesurement string, fields map[string]interface{}, ta
 		}
 	}
 
-	m := metric.New(mesurement, tags, fields, 0)
+	m := metric.New(mesurement, tags, fields, 0, tp)
+	if meta.help != "" || meta.unit != "" {
+		m.SetMetadata(meta.help, meta.unit)
+	}
+	m.SetCreated(meta.created)
 	s.slist.PushFront(m)
 }
 
+// createdMillis returns the created timestamp of a counter, summary or histogram, 0 if it is unset
+func createdMillis(m *dto.Metric) int64 {
+	var ts *timestamppb.Timestamp
+	switch {
+	case m.GetCounter() != nil:
+		ts = m.GetCounter().GetCreatedTimestamp()
+	case m.GetSummary() != nil:
+		ts = m.GetSummary().GetCreatedTimestamp()
+	case m.GetHistogram() != nil:
+		ts = m.GetHistogram().GetCreatedTimestamp()
+	}
+	if ts == nil || !ts.IsValid() {
+		return 0
+	}
+	return ts.AsTime().UnixMilli()
+}
+
+func metricType(t dto.MetricType) metric.ValueType {
+	switch t {
+	case dto.MetricType_COUNTER:
+		return metric.Counter
+	case dto.MetricType_GAUGE:
+		return metric.Gauge
+	case dto.MetricType_SUMMARY:
+		return metric.Summary
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		return metric.Histogram
+	default:
+		return metric.Untyped
+	}
+}
+
 func (s *Samples) PushFront(m metric.Metric) {
 	s.slist.PushFront(m)
 }
@@ -251,3 +312,19 @@ func (s *Samples) PopBackAll() []metric.Metric {
 func (s *Samples) Len() int {
 	return s.slist.Len()
 }
+
+// SetFlushHook makes streaming parsers hand the collected samples to fn
+// every time there are at least n of them, so big scrapes don't pile up in memory.
+// The samples handed to fn may be written before the scrape ends, the parsers don't call it
+// if the scrape must be rejected as a whole, see StreamParseOptions.KeepAll.
+func (s *Samples) SetFlushHook(n int, fn func([]metric.Metric)) {
+	s.flushSize = n
+	s.flushFn = fn
+}
+
+func (s *Samples) maybeFlush() {
+	if s.flushFn == nil || s.slist.Len() < s.flushSize {
+		return
+	}
+	s.flushFn(s.slist.PopBackAll())
+}
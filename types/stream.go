@@ -0,0 +1,319 @@
+package types
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cprobe/cprobe/types/metric"
+)
+
+const maxStreamLineSize = 16 * 1024 * 1024
+
+// ErrSampleLimitExceeded is returned when a scrape produces more samples than allowed.
+// The scheduler drops all the samples of such a scrape and marks it as failed.
+var ErrSampleLimitExceeded = errors.New("sample_limit exceeded")
+
+// ErrStreamAborted is returned when a streamed body can't be read or parsed to the end, e.g. body_size_limit is exceeded.
+// The scheduler drops the samples of such a scrape which are not flushed yet, see StreamParseOptions.KeepAll.
+var ErrStreamAborted = errors.New("stream parsing aborted")
+
+// StreamParseOptions controls how AddMetricsStream handles the parsed samples.
+type StreamParseOptions struct {
+	// HonorTimestamps keeps the timestamps from the body, otherwise the scrape time is used.
+	HonorTimestamps bool
+
+	// ConflictLabels are renamed to exported_<name> if they are present in the body,
+	// the same as Prometheus does when honor_labels is false.
+	ConflictLabels []string
+
+	// SampleLimit fails the parsing with ErrSampleLimitExceeded if the body contains more samples.
+	SampleLimit int
+
+	// KeepAll keeps the samples until the parsing ends, e.g. if body_size_limit is set,
+	// so a failed scrape doesn't leave partial data behind. It is implied by SampleLimit.
+	// Otherwise the samples are flushed in chunks via the hook registered by SetFlushHook.
+	KeepAll bool
+}
+
+// AddMetricsStream reads Prometheus text exposition format from r line by line.
+// Unlike AddMetricsBody it doesn't build dto.MetricFamily trees, so the memory usage
+// doesn't depend on the size of the body, e.g. for /federate responses.
+func (s *Samples) AddMetricsStream(r io.Reader, opts *StreamParseOptions) error {
+	if opts == nil {
+		opts = &StreamParseOptions{}
+	}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), maxStreamLineSize)
+
+	lineNum := 0
+	samples := 0
+	// the family declared by the last `# HELP`, `# TYPE` or `# UNIT` lines, samples of a family are contiguous
+	var family, help, unit string
+	familyType := metric.Untyped
+
+	// samples of a counter, summary or histogram are held until the next label set,
+	// so the `_created` sample following them can set their created timestamp
+	var group []metric.Metric
+	var groupKey string
+	pushGroup := func() {
+		s.slist.PushFrontN(group)
+		group = nil
+	}
+
+	for sc.Scan() {
+		lineNum++
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == '#' {
+			if kind, name, value, ok := parseMetaLine(line); ok {
+				if name != family {
+					family, familyType, help, unit = name, metric.Untyped, "", ""
+				}
+				switch kind {
+				case "TYPE":
+					familyType = parseFamilyType(value)
+				case "HELP":
+					help = helpReplacer.Replace(value)
+				case "UNIT":
+					unit = value
+				}
+			}
+			continue
+		}
+
+		name, tags, value, ts, err := parseTextLine(line)
+		if err != nil {
+			return fmt.Errorf("%w: cannot parse line %d: %s", ErrStreamAborted, lineNum, err)
+		}
+
+		if math.IsNaN(value) {
+			// stale markers and NaN values are useless for remote storages
+			continue
+		}
+
+		for _, ln := range opts.ConflictLabels {
+			if v, ok := tags[ln]; ok {
+				delete(tags, ln)
+				tags["exported_"+ln] = v
+			}
+		}
+
+		if !opts.HonorTimestamps {
+			ts = 0
+		}
+
+		samples++
+		if opts.SampleLimit > 0 && samples > opts.SampleLimit {
+			return fmt.Errorf("%w: more than %d samples", ErrSampleLimitExceeded, opts.SampleLimit)
+		}
+
+		tp := metric.Untyped
+		inFamily := false
+		if family != "" && strings.HasPrefix(name, family) {
+			switch strings.TrimPrefix(name, family) {
+			case "", "_bucket", "_sum", "_count", "_total":
+				tp = familyType
+				inFamily = true
+			}
+		}
+
+		m := metric.New("", tags, map[string]interface{}{name: value}, ts, tp)
+		if inFamily && (help != "" || unit != "") {
+			m.SetMetadata(help, unit)
+		}
+
+		// `foo_created` is in seconds, it belongs to the counter foo_total or the summary or histogram foo.
+		// It is kept as a sample as well, so nothing changes for the writers which don't know created timestamps
+		if base, ok := strings.CutSuffix(name, "_created"); ok && len(group) > 0 && groupKey == streamGroupKey(base, tags) {
+			for _, gm := range group {
+				gm.SetCreated(int64(value * 1000))
+			}
+		}
+
+		key := ""
+		switch tp {
+		case metric.Counter, metric.Summary, metric.Histogram:
+			key = streamGroupKey(strings.TrimSuffix(family, "_total"), tags)
+		}
+		if key == "" || key != groupKey {
+			pushGroup()
+			groupKey = key
+		}
+		if key != "" {
+			group = append(group, m)
+		} else {
+			s.slist.PushFront(m)
+		}
+
+		if opts.SampleLimit <= 0 && !opts.KeepAll {
+			s.maybeFlush()
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("%w: cannot read body: %s", ErrStreamAborted, err)
+	}
+
+	pushGroup()
+	return nil
+}
+
+// streamGroupKey identifies a label set of the family base, le and quantile are ignored,
+// so all the samples of a histogram or summary have the same key
+func streamGroupKey(base string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		if k != "le" && k != "quantile" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(base)
+	for _, k := range keys {
+		sb.WriteByte(0)
+		sb.WriteString(k)
+		sb.WriteByte(0)
+		sb.WriteString(tags[k])
+	}
+	return sb.String()
+}
+
+var helpReplacer = strings.NewReplacer(`\\`, `\`, `\n`, "\n")
+
+// parseMetaLine parses `# TYPE name counter`, `# HELP name text` and `# UNIT name unit`.
+func parseMetaLine(line string) (string, string, string, bool) {
+	kind, rest, ok := strings.Cut(strings.TrimLeft(line[1:], " \t"), " ")
+	if !ok {
+		return "", "", "", false
+	}
+	switch kind {
+	case "TYPE", "HELP", "UNIT":
+	default:
+		return "", "", "", false
+	}
+
+	name, value, _ := strings.Cut(strings.TrimLeft(rest, " \t"), " ")
+	if name == "" {
+		return "", "", "", false
+	}
+	return kind, name, strings.TrimSpace(value), true
+}
+
+// parseFamilyType parses the type in `# TYPE name counter`.
+func parseFamilyType(s string) metric.ValueType {
+	switch s {
+	case "counter":
+		return metric.Counter
+	case "gauge":
+		return metric.Gauge
+	case "summary":
+		return metric.Summary
+	case "histogram", "gaugehistogram":
+		return metric.Histogram
+	default:
+		return metric.Untyped
+	}
+}
+
+// parseTextLine parses a single sample line such as `name{k="v"} 1.5 1700000000000`.
+func parseTextLine(line string) (string, map[string]string, float64, int64, error) {
+	n := strings.IndexAny(line, "{ \t")
+	if n <= 0 {
+		return "", nil, 0, 0, fmt.Errorf("missing value in %q", line)
+	}
+
+	name := line[:n]
+	tail := line[n:]
+
+	tags := make(map[string]string)
+	if tail[0] == '{' {
+		var err error
+		tail, err = parseTextLabels(tail[1:], tags)
+		if err != nil {
+			return "", nil, 0, 0, fmt.Errorf("cannot parse labels in %q: %w", line, err)
+		}
+	}
+
+	fields := strings.Fields(tail)
+	if len(fields) == 0 || len(fields) > 2 {
+		return "", nil, 0, 0, fmt.Errorf("unexpected value and timestamp in %q", line)
+	}
+
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", nil, 0, 0, fmt.Errorf("cannot parse value in %q: %w", line, err)
+	}
+
+	var ts int64
+	if len(fields) == 2 {
+		ts, err = strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return "", nil, 0, 0, fmt.Errorf("cannot parse timestamp in %q: %w", line, err)
+		}
+	}
+
+	return name, tags, value, ts, nil
+}
+
+// parseTextLabels parses `k1="v1",k2="v2"}` into tags and returns the tail after `}`.
+func parseTextLabels(s string, tags map[string]string) (string, error) {
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if len(s) == 0 {
+			return "", fmt.Errorf("missing `}`")
+		}
+		if s[0] == '}' {
+			return s[1:], nil
+		}
+
+		n := strings.IndexByte(s, '=')
+		if n <= 0 {
+			return "", fmt.Errorf("missing `=` after label name")
+		}
+		key := strings.TrimSpace(s[:n])
+		s = strings.TrimLeft(s[n+1:], " \t")
+		if len(s) == 0 || s[0] != '"' {
+			return "", fmt.Errorf("missing opening quote for label %q", key)
+		}
+		s = s[1:]
+
+		var sb strings.Builder
+		closed := false
+		i := 0
+		for ; i < len(s); i++ {
+			c := s[i]
+			if c == '"' {
+				closed = true
+				break
+			}
+			if c == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					sb.WriteByte('\n')
+				default:
+					sb.WriteByte(s[i])
+				}
+				continue
+			}
+			sb.WriteByte(c)
+		}
+		if !closed {
+			return "", fmt.Errorf("missing closing quote for label %q", key)
+		}
+
+		tags[key] = sb.String()
+		s = s[i+1:]
+	}
+}
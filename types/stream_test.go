@@ -0,0 +1,165 @@
+package types
+
+import (
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cprobe/cprobe/types/metric"
+)
+
+func TestParseTextLine(t *testing.T) {
+	f := func(line, name string, tags map[string]string, value float64, ts int64) {
+		t.Helper()
+		n, tg, v, tm, err := parseTextLine(line)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", line, err)
+		}
+		if n != name || v != value || tm != ts || !reflect.DeepEqual(tg, tags) {
+			t.Fatalf("unexpected result for %q: %s %v %v %d", line, n, tg, v, tm)
+		}
+	}
+
+	f(`up 1`, "up", map[string]string{}, 1, 0)
+	f(`up{} 0 1700000000000`, "up", map[string]string{}, 0, 1700000000000)
+	f(`http_requests_total{code="200",path="/a b"} 10.5`, "http_requests_total", map[string]string{"code": "200", "path": "/a b"}, 10.5, 0)
+	f(`x{a="q\"u\\o\nte", b = "2", } +Inf`, "x", map[string]string{"a": "q\"u\\o\nte", "b": "2"}, math.Inf(1), 0)
+
+	for _, line := range []string{`up`, `up{a="1" 1`, `up{a=1} 1`, `up abc`, `up 1 2 3`, `up 1 x`} {
+		if _, _, _, _, err := parseTextLine(line); err == nil {
+			t.Fatalf("expecting error for %q", line)
+		}
+	}
+}
+
+func TestAddMetricsStream(t *testing.T) {
+	body := `# HELP up whatever
+# TYPE up gauge
+up{job="node",instance="a:9100"} 1 1700000000000
+up{job="node",instance="b:9100"} NaN
+
+go_goroutines 12
+`
+	ss := NewSamples()
+	opts := &StreamParseOptions{ConflictLabels: []string{"job", "instance"}}
+	if err := ss.AddMetricsStream(strings.NewReader(body), opts); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ms := ss.PopBackAll()
+	if len(ms) != 2 {
+		t.Fatalf("unexpected number of samples: %d", len(ms))
+	}
+	if ms[0].Tags()["exported_job"] != "node" || ms[0].HasTag("job") || ms[0].Time() != 0 {
+		t.Fatalf("unexpected sample: %s", ms[0])
+	}
+	if ms[0].Type() != metric.Gauge || ms[1].Type() != metric.Untyped {
+		t.Fatalf("unexpected types: %s, %s", ms[0].Type(), ms[1].Type())
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("response body exceeds body_size_limit")
+}
+
+func TestAddMetricsStreamAborted(t *testing.T) {
+	f := func(r io.Reader) {
+		t.Helper()
+		ss := NewSamples()
+		if err := ss.AddMetricsStream(r, &StreamParseOptions{}); !errors.Is(err, ErrStreamAborted) {
+			t.Fatalf("expecting ErrStreamAborted, got %v", err)
+		}
+	}
+
+	f(strings.NewReader("up 1\nnot prometheus text {\n"))
+	f(io.MultiReader(strings.NewReader("up 1\n"), failingReader{}))
+}
+
+func TestAddMetricsStreamFlush(t *testing.T) {
+	body := strings.Repeat("up 1\n", 25)
+
+	f := func(opts *StreamParseOptions, expectedFlushes int) {
+		t.Helper()
+		ss := NewSamples()
+		flushes, samples := 0, 0
+		ss.SetFlushHook(10, func(ms []metric.Metric) {
+			flushes++
+			samples += len(ms)
+		})
+		if err := ss.AddMetricsStream(strings.NewReader(body), opts); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if flushes != expectedFlushes || samples+ss.Len() != 25 {
+			t.Fatalf("unexpected flushes %d with %d samples, %d left", flushes, samples, ss.Len())
+		}
+	}
+
+	f(&StreamParseOptions{}, 2)
+	f(&StreamParseOptions{KeepAll: true}, 0)
+	f(&StreamParseOptions{SampleLimit: 100}, 0)
+}
+
+func TestAddMetricsStreamMetadata(t *testing.T) {
+	body := `# HELP requests Requests\nhandled.
+# TYPE requests counter
+# UNIT requests requests
+requests_total{path="a"} 3
+requests_created{path="a"} 1700000000.5
+requests_total{path="b"} 4
+# HELP latency Latency.
+# TYPE latency histogram
+latency_bucket{le="1"} 1
+latency_bucket{le="+Inf"} 2
+latency_count 2
+latency_sum 1.5
+# HELP latency_created Created.
+# TYPE latency_created gauge
+latency_created 1700000001
+# TYPE temperature gauge
+temperature 20
+`
+	ss := NewSamples()
+	if err := ss.AddMetricsStream(strings.NewReader(body), nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	type meta struct {
+		help, unit string
+		created    int64
+	}
+	got := make(map[string]meta)
+	for _, m := range ss.PopBackAll() {
+		for name := range m.Fields() {
+			key := name
+			if path, ok := m.GetTag("path"); ok {
+				key += "/" + path
+			}
+			if le, ok := m.GetTag("le"); ok {
+				key += "/" + le
+			}
+			got[key] = meta{m.Help(), m.Unit(), m.Created()}
+		}
+	}
+
+	expected := map[string]meta{
+		"requests_total/a": {"Requests\nhandled.", "requests", 1700000000500},
+		// kept as a sample, the created timestamp of the series is set from it
+		"requests_created/a": {},
+		// there is no requests_created for b
+		"requests_total/b":    {"Requests\nhandled.", "requests", 0},
+		"latency_bucket/1":    {"Latency.", "", 1700000001000},
+		"latency_bucket/+Inf": {"Latency.", "", 1700000001000},
+		"latency_count":       {"Latency.", "", 1700000001000},
+		"latency_sum":         {"Latency.", "", 1700000001000},
+		"latency_created":     {"Created.", "", 0},
+		"temperature":         {},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected metadata:\ngot  %v\nwant %v", got, expected)
+	}
+}
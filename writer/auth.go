@@ -0,0 +1,79 @@
+package writer
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/cprobe/cprobe/lib/awsapi"
+	"github.com/cprobe/cprobe/lib/promauth"
+	"github.com/cprobe/cprobe/lib/secret"
+)
+
+// AWSSigV4Config signs the requests for AWS managed Prometheus and the like.
+// The credentials fall back to AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and the instance role if empty.
+type AWSSigV4Config struct {
+	Region    string        `yaml:"region,omitempty"`
+	AccessKey string        `yaml:"access_key,omitempty"`
+	SecretKey secret.Secret `yaml:"secret_key,omitempty"`
+	RoleARN   string        `yaml:"role_arn,omitempty"`
+	// aps by default
+	Service string `yaml:"service,omitempty"`
+}
+
+const amzContentSha256Header = "X-Amz-Content-Sha256"
+
+func (w *Writer) parseAuth() error {
+	if w.Authorization == nil && w.BearerTokenFile == "" && w.OAuth2 == nil && w.AWSSigV4 == nil {
+		return nil
+	}
+
+	if w.BasicAuthUser != "" {
+		return fmt.Errorf("basic_auth_user cannot be used together with authorization, bearer_token_file, oauth2 or aws_sigv4")
+	}
+
+	if w.Authorization != nil || w.BearerTokenFile != "" || w.OAuth2 != nil {
+		if w.AWSSigV4 != nil {
+			return fmt.Errorf("aws_sigv4 cannot be used together with authorization, bearer_token_file or oauth2")
+		}
+
+		opts := &promauth.Options{
+			BaseDir:         w.baseDir,
+			Authorization:   w.Authorization,
+			BearerTokenFile: w.BearerTokenFile,
+			OAuth2:          w.OAuth2,
+		}
+		ac, err := opts.NewConfig()
+		if err != nil {
+			return fmt.Errorf("cannot initialize auth config: %w", err)
+		}
+		w.authConfig = ac
+	}
+
+	if sc := w.AWSSigV4; sc != nil {
+		awsCfg, err := awsapi.NewConfig("", "", sc.Region, sc.RoleARN, sc.AccessKey, sc.SecretKey.Value(), sc.Service)
+		if err != nil {
+			return fmt.Errorf("cannot initialize aws_sigv4 config: %w", err)
+		}
+		w.awsConfig = awsCfg
+	}
+
+	return nil
+}
+
+// authorize sets the auth headers right before req is sent, so rotated tokens and credentials are picked up
+// and the signature isn't expired by retries
+func (w *Writer) authorize(req *http.Request) error {
+	if w.authConfig != nil {
+		if err := w.authConfig.SetHeaders(req, true); err != nil {
+			return err
+		}
+	}
+
+	if w.awsConfig != nil {
+		if err := w.awsConfig.SignRequest(req, req.Header.Get(amzContentSha256Header)); err != nil {
+			return fmt.Errorf("cannot sign request: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package writer
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/promauth"
+)
+
+// authorizeHeader returns the Authorization header set by w.authorize
+func authorizeHeader(t *testing.T, w *Writer) string {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, "http://localhost/api/v1/write", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := w.authorize(req); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return req.Header.Get("Authorization")
+}
+
+// checkTokenRotation rewrites the token file at path and waits for the next requests to carry the new token,
+// the auth header is cached for a second or two
+func checkTokenRotation(t *testing.T, w *Writer, path, prefix string) {
+	t.Helper()
+
+	if got := authorizeHeader(t, w); got != prefix+"secret1" {
+		t.Fatalf("unexpected Authorization header: %q", got)
+	}
+
+	if err := os.WriteFile(path, []byte("secret2\n"), 0o600); err != nil {
+		t.Fatalf("cannot rewrite token file: %s", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := authorizeHeader(t, w)
+		if got == prefix+"secret2" {
+			return
+		}
+		if got != prefix+"secret1" {
+			t.Fatalf("unexpected Authorization header: %q", got)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the rotated token isn't picked up, Authorization header is still %q", got)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestAuthorizeBearerTokenFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+	if err := os.WriteFile(path, []byte("secret1\n"), 0o600); err != nil {
+		t.Fatalf("cannot write token file: %s", err)
+	}
+
+	w := &Writer{BearerTokenFile: "token", baseDir: dir}
+	if err := w.parseAuth(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	checkTokenRotation(t, w, path, "Bearer ")
+
+	w = &Writer{BearerTokenFile: "token", BasicAuthUser: "foo", baseDir: dir}
+	if err := w.parseAuth(); err == nil {
+		t.Fatalf("expecting error for basic auth with bearer_token_file")
+	}
+}
+
+func TestAuthorizeCredentialsFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "credentials")
+	if err := os.WriteFile(path, []byte("secret1\n"), 0o600); err != nil {
+		t.Fatalf("cannot write credentials file: %s", err)
+	}
+
+	w := &Writer{Authorization: &promauth.Authorization{Type: "Token", CredentialsFile: "credentials"}, baseDir: dir}
+	if err := w.parseAuth(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	checkTokenRotation(t, w, path, "Token ")
+}
@@ -0,0 +1,196 @@
+package writer
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+)
+
+// accumulator 把多个 target 的数据攒成一批再发送，避免每个 target 一个小请求
+type accumulator struct {
+	mu      sync.Mutex
+	tenants map[string]*pendingBatch
+}
+
+type pendingBatch struct {
+	tss     []prompbmarshal.TimeSeries
+	samples int
+	bytes   int
+	// group of the last series, see seriesGroup
+	lastGroup string
+}
+
+func newAccumulator() *accumulator {
+	return &accumulator{tenants: make(map[string]*pendingBatch)}
+}
+
+// estimateSeriesSize approximates the marshaled size of ts, it is used to keep requests under max_bytes
+func estimateSeriesSize(ts *prompbmarshal.TimeSeries) int {
+	n := 4
+	for _, label := range ts.Labels {
+		n += len(label.Name) + len(label.Value) + 6
+	}
+	return n + len(ts.Samples)*20
+}
+
+// add appends tss of tenant and flushes the batches which reached the limits
+func (w *Writer) add(tss []prompbmarshal.TimeSeries, tenant string) {
+	if w.acc == nil {
+		w.flush(tss, tenant)
+		return
+	}
+
+	group := w.seriesGroup()
+	var groups []string
+	if group != nil {
+		tss, groups = sortByGroup(tss, group)
+	}
+
+	var full [][]prompbmarshal.TimeSeries
+
+	w.acc.mu.Lock()
+	pb, ok := w.acc.tenants[tenant]
+	if !ok {
+		pb = &pendingBatch{}
+		w.acc.tenants[tenant] = pb
+	}
+	for i := range tss {
+		g := ""
+		if groups != nil {
+			g = groups[i]
+		}
+		size := estimateSeriesSize(&tss[i])
+		sameGroup := g != "" && g == pb.lastGroup
+		if len(pb.tss) > 0 && !sameGroup && (pb.samples+len(tss[i].Samples) > w.MaxSamplesPerRequest || pb.bytes+size > w.MaxBytes) {
+			full = append(full, pb.tss)
+			*pb = pendingBatch{}
+		}
+		pb.tss = append(pb.tss, tss[i])
+		pb.samples += len(tss[i].Samples)
+		pb.bytes += size
+		pb.lastGroup = g
+	}
+	w.acc.mu.Unlock()
+
+	for _, batch := range full {
+		w.flush(batch, tenant)
+	}
+}
+
+// flushPending sends all the accumulated series
+func (w *Writer) flushPending() {
+	pending := make(map[string][]prompbmarshal.TimeSeries)
+
+	w.acc.mu.Lock()
+	for tenant, pb := range w.acc.tenants {
+		if len(pb.tss) > 0 {
+			pending[tenant] = pb.tss
+		}
+		delete(w.acc.tenants, tenant)
+	}
+	w.acc.mu.Unlock()
+
+	for tenant, tss := range pending {
+		w.flush(tss, tenant)
+	}
+}
+
+func (w *Writer) startFlusher() {
+	ticker := time.NewTicker(time.Duration(w.FlushIntervalMillis) * time.Millisecond)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		w.flushPending()
+	}
+}
+
+// seriesGroup returns the function grouping the series which must be sent in the same request, nil if there are none.
+// The series of an OTLP histogram or summary data point are merged into a single point by the writer
+func (w *Writer) seriesGroup() func(*prompbmarshal.TimeSeries) string {
+	if w.Type == WriterTypeOTLP {
+		return otlpSeriesGroup
+	}
+	return nil
+}
+
+// sortByGroup moves the series of the same non-empty group next to the first one of them, the order is kept otherwise.
+// It returns the groups of the sorted series
+func sortByGroup(tss []prompbmarshal.TimeSeries, group func(*prompbmarshal.TimeSeries) string) ([]prompbmarshal.TimeSeries, []string) {
+	groups := make([]string, len(tss))
+	// position of the first series of the group
+	first := make(map[string]int)
+	order := make([]int, len(tss))
+	for i := range tss {
+		g := group(&tss[i])
+		groups[i] = g
+		order[i] = i
+		if g == "" {
+			continue
+		}
+		if j, ok := first[g]; ok {
+			order[i] = j
+		} else {
+			first[g] = i
+		}
+	}
+
+	idx := make([]int, len(tss))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return order[idx[a]] < order[idx[b]] })
+
+	sorted := make([]prompbmarshal.TimeSeries, len(tss))
+	sortedGroups := make([]string, len(tss))
+	for i, j := range idx {
+		sorted[i] = tss[j]
+		sortedGroups[i] = groups[j]
+	}
+	return sorted, sortedGroups
+}
+
+// splitBatch splits tss into chunks of at most maxSamples samples and about maxBytes bytes.
+// The series of the same group are kept in a chunk even if it exceeds the limits, group may be nil
+func splitBatch(tss []prompbmarshal.TimeSeries, maxSamples, maxBytes int, group func(*prompbmarshal.TimeSeries) string) [][]prompbmarshal.TimeSeries {
+	var groups []string
+	if group != nil {
+		tss, groups = sortByGroup(tss, group)
+	}
+
+	var chunks [][]prompbmarshal.TimeSeries
+
+	start, samples, bytes := 0, 0, 0
+	for i := range tss {
+		size := estimateSeriesSize(&tss[i])
+		sameGroup := i > start && groups != nil && groups[i] != "" && groups[i] == groups[i-1]
+		if i > start && !sameGroup && (samples+len(tss[i].Samples) > maxSamples || bytes+size > maxBytes) {
+			chunks = append(chunks, tss[start:i])
+			start, samples, bytes = i, 0, 0
+		}
+		samples += len(tss[i].Samples)
+		bytes += size
+	}
+	if start < len(tss) {
+		chunks = append(chunks, tss[start:])
+	}
+
+	return chunks
+}
+
+// flush encodes tss in requests which don't exceed max_samples_per_request and max_bytes
+func (w *Writer) flush(tss []prompbmarshal.TimeSeries, tenant string) {
+	for _, chunk := range splitBatch(tss, w.MaxSamplesPerRequest, w.MaxBytes, w.seriesGroup()) {
+		switch w.Type {
+		case WriterTypeInflux:
+			w.writeInflux(chunk, tenant)
+		case WriterTypeKafka:
+			w.writeKafka(chunk, tenant)
+		case WriterTypeOTLP:
+			w.writeOTLP(chunk, tenant)
+		default:
+			w.writeRemoteWrite(chunk, tenant)
+		}
+	}
+}
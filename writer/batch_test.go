@@ -0,0 +1,86 @@
+package writer
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/types"
+)
+
+func TestSplitBatch(t *testing.T) {
+	tss := make([]prompbmarshal.TimeSeries, 10)
+	for i := range tss {
+		tss[i] = prompbmarshal.TimeSeries{
+			Labels:  []prompbmarshal.Label{{Name: "__name__", Value: "up"}},
+			Samples: []prompbmarshal.Sample{{Value: 1}, {Value: 2}},
+		}
+	}
+	size := estimateSeriesSize(&tss[0])
+
+	f := func(maxSamples, maxBytes int, wantLens ...int) {
+		t.Helper()
+		chunks := splitBatch(tss, maxSamples, maxBytes, nil)
+		if len(chunks) != len(wantLens) {
+			t.Fatalf("unexpected number of chunks: %d, want: %d", len(chunks), len(wantLens))
+		}
+		for i, chunk := range chunks {
+			if len(chunk) != wantLens[i] {
+				t.Fatalf("unexpected length of chunk #%d: %d, want: %d", i, len(chunk), wantLens[i])
+			}
+		}
+	}
+
+	f(100, 1<<20, 10)
+	f(8, 1<<20, 4, 4, 2)
+	f(100, size*3, 3, 3, 3, 1)
+	// a series bigger than the limits is sent alone
+	f(1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1)
+}
+
+func TestSplitBatchGroups(t *testing.T) {
+	newTS := func(name, tp, instance string) prompbmarshal.TimeSeries {
+		return prompbmarshal.TimeSeries{
+			Labels: []prompbmarshal.Label{
+				{Name: "__name__", Value: name},
+				{Name: types.LabelType, Value: tp},
+				{Name: "instance", Value: instance},
+			},
+			Samples: []prompbmarshal.Sample{{Value: 1, Timestamp: 1000}},
+		}
+	}
+
+	// the series of the two histogram points are interleaved
+	tss := []prompbmarshal.TimeSeries{
+		newTS("up", "gauge", "a"),
+		newTS("latency_bucket", "histogram", "a"),
+		newTS("latency_bucket", "histogram", "b"),
+		newTS("latency_sum", "histogram", "a"),
+		newTS("latency_sum", "histogram", "b"),
+		newTS("latency_count", "histogram", "a"),
+		newTS("latency_count", "histogram", "b"),
+		newTS("up", "gauge", "b"),
+	}
+
+	name := func(ts prompbmarshal.TimeSeries) string {
+		return ts.Labels[0].Value + "/" + ts.Labels[2].Value
+	}
+
+	var got [][]string
+	for _, chunk := range splitBatch(tss, 2, 1<<20, otlpSeriesGroup) {
+		var names []string
+		for _, ts := range chunk {
+			names = append(names, name(ts))
+		}
+		got = append(got, names)
+	}
+
+	expected := [][]string{
+		{"up/a", "latency_bucket/a", "latency_sum/a", "latency_count/a"},
+		{"latency_bucket/b", "latency_sum/b", "latency_count/b"},
+		{"up/b"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected chunks:\ngot  %v\nwant %v", got, expected)
+	}
+}
@@ -0,0 +1,220 @@
+package writer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/lib/secret"
+	"github.com/cprobe/cprobe/types"
+)
+
+// InfluxConfig is the `influx` section of a writer with `type: influx`.
+//
+// InfluxDB v1 uses basic_auth_user and basic_auth_pass of the writer, v2 uses token.
+type InfluxConfig struct {
+	// v1
+	Database        string `yaml:"database"`
+	RetentionPolicy string `yaml:"retention_policy"`
+
+	// v2
+	Org    string        `yaml:"org"`
+	Bucket string        `yaml:"bucket"`
+	Token  secret.Secret `yaml:"token"`
+
+	// gzip or identity
+	ContentEncoding string `yaml:"content_encoding"`
+	// max lines per request
+	BatchSize int `yaml:"batch_size"`
+}
+
+func (ic *InfluxConfig) parse(w *Writer) error {
+	if ic.BatchSize <= 0 {
+		ic.BatchSize = 5000
+	}
+
+	switch ic.ContentEncoding {
+	case "":
+		ic.ContentEncoding = "identity"
+	case "gzip", "identity":
+	default:
+		return fmt.Errorf("unsupported influx content_encoding %q, must be gzip or identity", ic.ContentEncoding)
+	}
+
+	u, err := url.Parse(w.URL.Value())
+	if err != nil {
+		return fmt.Errorf("cannot parse writer url %q: %w", w.URL, err)
+	}
+
+	q := u.Query()
+	setIfAbsent := func(key, value string) {
+		if value != "" && q.Get(key) == "" {
+			q.Set(key, value)
+		}
+	}
+	setIfAbsent("db", ic.Database)
+	setIfAbsent("rp", ic.RetentionPolicy)
+	setIfAbsent("org", ic.Org)
+	setIfAbsent("bucket", ic.Bucket)
+	// cprobe always writes timestamps in milliseconds
+	q.Set("precision", "ms")
+	u.RawQuery = q.Encode()
+
+	w.URL = secret.URL(u.String())
+
+	return nil
+}
+
+func (w *Writer) writeInflux(tss []prompbmarshal.TimeSeries, tenant string) {
+	lines := marshalInfluxLines(tss)
+
+	for start := 0; start < len(lines); start += w.Influx.BatchSize {
+		end := start + w.Influx.BatchSize
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		var body bytes.Buffer
+		for _, line := range lines[start:end] {
+			body.WriteString(line)
+			body.WriteByte('\n')
+		}
+
+		bs := body.Bytes()
+		if w.Influx.ContentEncoding == "gzip" {
+			var zbuf bytes.Buffer
+			zw := gzip.NewWriter(&zbuf)
+			if _, err := zw.Write(bs); err != nil {
+				logger.Warnf("cannot gzip influx lines: %s", err)
+				return
+			}
+			if err := zw.Close(); err != nil {
+				logger.Warnf("cannot gzip influx lines: %s", err)
+				return
+			}
+			bs = zbuf.Bytes()
+		}
+
+		httpReq, err := w.NewRequest(bs, tenant)
+		if err != nil {
+			logger.Warnf("cannot create http request: %s", err)
+			return
+		}
+
+		w.RequestQueue.PushFront(httpReq)
+	}
+}
+
+type influxLine struct {
+	head   string
+	ts     int64
+	fields []string
+}
+
+// marshalInfluxLines converts series to line protocol. Series of the same measurement, tags and timestamp
+// are merged into a single line with multiple fields, the same as the metric model of the plugins.
+//
+// The measurement and the field come from types.LabelMeasurement and types.LabelField,
+// otherwise __name__ is used as the measurement and `value` as the field.
+func marshalInfluxLines(tss []prompbmarshal.TimeSeries) []string {
+	var lines []*influxLine
+	index := make(map[string]*influxLine)
+
+	for i := range tss {
+		ts := &tss[i]
+		if len(ts.Samples) == 0 {
+			continue
+		}
+
+		var measurement, field, name string
+		tags := make([]prompbmarshal.Label, 0, len(ts.Labels))
+		for _, label := range ts.Labels {
+			switch label.Name {
+			case types.LabelMeasurement:
+				measurement = label.Value
+			case types.LabelField:
+				field = label.Value
+			case "__name__":
+				name = label.Value
+			default:
+				if label.Value != "" && !strings.HasPrefix(label.Name, "__") {
+					tags = append(tags, label)
+				}
+			}
+		}
+
+		if measurement == "" || field == "" {
+			measurement = name
+			field = "value"
+		}
+
+		if measurement == "" {
+			continue
+		}
+
+		sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+
+		var sb strings.Builder
+		sb.WriteString(escapeInflux(measurement, ", "))
+		for _, tag := range tags {
+			sb.WriteByte(',')
+			sb.WriteString(escapeInflux(tag.Name, ",= "))
+			sb.WriteByte('=')
+			sb.WriteString(escapeInflux(tag.Value, ",= "))
+		}
+		head := sb.String()
+
+		for _, sample := range ts.Samples {
+			if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+				// line protocol doesn't support them
+				continue
+			}
+
+			fieldStr := escapeInflux(field, ",= ") + "=" + strconv.FormatFloat(sample.Value, 'g', -1, 64)
+
+			key := head + " " + strconv.FormatInt(sample.Timestamp, 10)
+			line, ok := index[key]
+			if !ok {
+				line = &influxLine{head: head, ts: sample.Timestamp}
+				index[key] = line
+				lines = append(lines, line)
+			}
+			line.fields = append(line.fields, fieldStr)
+		}
+	}
+
+	ret := make([]string, 0, len(lines))
+	for _, line := range lines {
+		ret = append(ret, line.head+" "+strings.Join(line.fields, ",")+" "+strconv.FormatInt(line.ts, 10))
+	}
+
+	return ret
+}
+
+// escapeInflux escapes chars and backslashes in s. Line protocol can't escape newlines
+// in measurements, tag keys, tag values and field keys, so they become escaped spaces
+func escapeInflux(s, chars string) string {
+	if !strings.ContainsAny(s, chars+"\\\r\n") {
+		return s
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\r' || c == '\n' {
+			c = ' '
+		}
+		if c == '\\' || strings.IndexByte(chars, c) >= 0 {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
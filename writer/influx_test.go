@@ -0,0 +1,40 @@
+package writer
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/types"
+)
+
+func TestMarshalInfluxLines(t *testing.T) {
+	newTS := func(value float64, ts int64, kvs ...string) prompbmarshal.TimeSeries {
+		var labels []prompbmarshal.Label
+		for i := 0; i < len(kvs); i += 2 {
+			labels = append(labels, prompbmarshal.Label{Name: kvs[i], Value: kvs[i+1]})
+		}
+		return prompbmarshal.TimeSeries{
+			Labels:  labels,
+			Samples: []prompbmarshal.Sample{{Value: value, Timestamp: ts}},
+		}
+	}
+
+	tss := []prompbmarshal.TimeSeries{
+		newTS(1, 1000, "__name__", "mysql_up", types.LabelMeasurement, "mysql", types.LabelField, "up", "instance", "a:3306"),
+		newTS(12.5, 1000, "__name__", "mysql_threads", types.LabelMeasurement, "mysql", types.LabelField, "threads", "instance", "a:3306"),
+		newTS(3, 2000, "__name__", "http_requests_total", "path", "/a b,c", "code", "200"),
+		newTS(0, 2000, "__name__", "", "job", "x"),
+		newTS(4, 3000, "__name__", "errors_total", "message", "line1\r\nline2", "multi\nline", "a"),
+	}
+
+	got := marshalInfluxLines(tss)
+	want := []string{
+		`mysql,instance=a:3306 up=1,threads=12.5 1000`,
+		`http_requests_total,code=200,path=/a\ b\,c value=3 2000`,
+		`errors_total,message=line1\ \ line2,multi\ line=a value=4 3000`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected lines\ngot:  %q\nwant: %q", got, want)
+	}
+}
@@ -4,9 +4,8 @@ import (
 	"fmt"
 	"strings"
 
-	"github.com/cprobe/cprobe/lib/logger"
 	"github.com/cprobe/cprobe/lib/prompbmarshal"
-	"github.com/golang/snappy"
+	"github.com/cprobe/cprobe/types"
 )
 
 func WriteTimeSeries(tss []prompbmarshal.TimeSeries) {
@@ -14,11 +13,22 @@ func WriteTimeSeries(tss []prompbmarshal.TimeSeries) {
 		return
 	}
 
+	if *pullEnable {
+		getPullStore().add(tss)
+	}
+
 	if *writerDisable {
+		if *pullEnable {
+			// the series are pulled from /federate, don't flood stdout
+			return
+		}
 		for i := range tss {
 			point := tss[i]
 			var sb strings.Builder
 			for j := range point.Labels {
+				if isMetaLabel(point.Labels[j].Name) {
+					continue
+				}
 				sb.WriteString(point.Labels[j].Name)
 				sb.WriteString("=")
 				sb.WriteString(point.Labels[j].Value)
@@ -38,37 +48,55 @@ func WriteTimeSeries(tss []prompbmarshal.TimeSeries) {
 		new(relabelCtx).appendExtraLabels(tss, WriterConfig.Global.ExtraLabels.Labels)
 	}
 
-	if len(WriterConfig.Writers) == 1 {
-		WriterConfig.Writers[0].writeTimeSeries(tss)
-		return
+	for i, w := range WriterConfig.Writers {
+		// the last writer can take tss as is, the others modify labels of their own copies
+		selected := w.selectTimeSeries(tss, i < len(WriterConfig.Writers)-1)
+		if len(selected) > 0 {
+			w.writeTimeSeries(selected)
+		}
 	}
+}
 
-	for i := range WriterConfig.Writers {
-		if i == len(WriterConfig.Writers)-1 {
-			// last one
-			WriterConfig.Writers[i].writeTimeSeries(tss)
-		} else {
-			newVectors := make([]prompbmarshal.TimeSeries, len(tss))
-			for j := range tss {
-				newVectors[j] = prompbmarshal.TimeSeries{
-					Labels:  make([]prompbmarshal.Label, 0, len(tss[j].Labels)),
-					Samples: tss[j].Samples,
-				}
-				newVectors[j].Labels = append(newVectors[j].Labels, tss[j].Labels...)
-			}
-			WriterConfig.Writers[i].writeTimeSeries(newVectors)
+// selectTimeSeries returns the series matching w.Match, the labels are copied if copyLabels is true
+func (w *Writer) selectTimeSeries(tss []prompbmarshal.TimeSeries, copyLabels bool) []prompbmarshal.TimeSeries {
+	if w.Match == nil && !copyLabels {
+		return tss
+	}
+
+	selected := make([]prompbmarshal.TimeSeries, 0, len(tss))
+	for j := range tss {
+		if w.Match != nil && !w.Match.Match(tss[j].Labels) {
+			continue
 		}
+
+		ts := tss[j]
+		if copyLabels {
+			ts.Labels = append(make([]prompbmarshal.Label, 0, len(ts.Labels)), ts.Labels...)
+		}
+		selected = append(selected, ts)
 	}
+
+	return selected
 }
 
 func (w *Writer) writeTimeSeries(tss []prompbmarshal.TimeSeries) {
+	tss = w.relabel(tss)
+
+	// 多租户的时候每个租户分别攒批发送
+	for _, batch := range splitByTenant(tss) {
+		w.add(batch.tss, batch.tenant)
+	}
+}
+
+// relabel appends the extra labels of w, then applies the global relabel_configs and the relabel_configs of w
+func (w *Writer) relabel(tss []prompbmarshal.TimeSeries) []prompbmarshal.TimeSeries {
 	// append writer extra labels
 	if w.ExtraLabels != nil && len(w.ExtraLabels.Labels) > 0 {
 		new(relabelCtx).appendExtraLabels(tss, w.ExtraLabels.Labels)
 	}
 
 	// relabel
-	if WriterConfig.Global.ParsedRelabelConfigs.Len() > 0 {
+	if WriterConfig.Global != nil && WriterConfig.Global.ParsedRelabelConfigs.Len() > 0 {
 		tss = new(relabelCtx).applyRelabeling(tss, WriterConfig.Global.ParsedRelabelConfigs)
 	}
 
@@ -76,21 +104,64 @@ func (w *Writer) writeTimeSeries(tss []prompbmarshal.TimeSeries) {
 		tss = new(relabelCtx).applyRelabeling(tss, w.ParsedRelabelConfigs)
 	}
 
-	req := prompbmarshal.WriteRequest{
-		Timeseries: tss,
-	}
+	return tss
+}
 
-	bs, err := req.Marshal()
-	if err != nil {
-		logger.Warnf("cannot marshal WriteRequest: %s", err)
-		return
+type tenantBatch struct {
+	tenant string
+	tss    []prompbmarshal.TimeSeries
+}
+
+// splitByTenant groups tss by types.LabelTenant and removes the label
+func splitByTenant(tss []prompbmarshal.TimeSeries) []tenantBatch {
+	var batches []tenantBatch
+	index := make(map[string]int)
+
+	for i := range tss {
+		ts := tss[i]
+
+		var tenant string
+		for j, label := range ts.Labels {
+			if label.Name == types.LabelTenant {
+				tenant = label.Value
+				ts.Labels = append(ts.Labels[:j:j], ts.Labels[j+1:]...)
+				break
+			}
+		}
+
+		n, ok := index[tenant]
+		if !ok {
+			n = len(batches)
+			index[tenant] = n
+			batches = append(batches, tenantBatch{tenant: tenant})
+		}
+		batches[n].tss = append(batches[n].tss, ts)
 	}
 
-	httpReq, err := w.NewRequest(snappy.Encode(nil, bs))
-	if err != nil {
-		logger.Warnf("cannot create http request: %s", err)
-		return
+	return batches
+}
+
+// dropMetaLabels removes the labels only used inside cprobe, such as types.LabelMeasurement
+func dropMetaLabels(tss []prompbmarshal.TimeSeries) []prompbmarshal.TimeSeries {
+	for i := range tss {
+		labels := tss[i].Labels
+		dst := labels[:0]
+		for _, label := range labels {
+			if isMetaLabel(label.Name) {
+				continue
+			}
+			dst = append(dst, label)
+		}
+		tss[i].Labels = dst
 	}
+	return tss
+}
 
-	w.RequestQueue.PushFront(httpReq)
+// isMetaLabel reports whether name is one of the labels only used inside cprobe
+func isMetaLabel(name string) bool {
+	switch name {
+	case types.LabelMeasurement, types.LabelField, types.LabelType, types.LabelPlugin, types.LabelHelp, types.LabelUnit, types.LabelCreated:
+		return true
+	}
+	return false
 }
@@ -0,0 +1,46 @@
+package writer
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/lib/promrelabel"
+	"github.com/cprobe/cprobe/lib/promutils"
+)
+
+func TestWriterRelabelOrder(t *testing.T) {
+	global, err := promrelabel.ParseRelabelConfigsData([]byte(`
+- action: replace
+  source_labels: [dc]
+  target_label: region
+`))
+	if err != nil {
+		t.Fatalf("cannot parse relabel configs: %s", err)
+	}
+	writerRelabel, err := promrelabel.ParseRelabelConfigsData([]byte(`
+- action: labeldrop
+  regex: dc
+`))
+	if err != nil {
+		t.Fatalf("cannot parse relabel configs: %s", err)
+	}
+
+	defer func(c *WriterYaml) { WriterConfig = c }(WriterConfig)
+	WriterConfig = &WriterYaml{Global: &Global{ParsedRelabelConfigs: global}}
+
+	// the global relabel_configs see the extra_labels of the writer
+	w := &Writer{
+		ExtraLabels:          promutils.NewLabelsFromMap(map[string]string{"dc": "bj"}),
+		ParsedRelabelConfigs: writerRelabel,
+	}
+	tss := w.relabel([]prompbmarshal.TimeSeries{{
+		Labels:  []prompbmarshal.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompbmarshal.Sample{{Value: 1, Timestamp: 1000}},
+	}})
+
+	expected := []prompbmarshal.Label{{Name: "__name__", Value: "up"}, {Name: "region", Value: "bj"}}
+	if len(tss) != 1 || !reflect.DeepEqual(tss[0].Labels, expected) {
+		t.Fatalf("unexpected series: %v", tss)
+	}
+}
@@ -0,0 +1,385 @@
+package writer
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/lib/secret"
+	"github.com/cprobe/cprobe/plugins/kafka/exporter"
+	"github.com/golang/snappy"
+)
+
+const (
+	KafkaFormatRemoteWrite = "remotewrite"
+	KafkaFormatJSON        = "json"
+	KafkaFormatInflux      = "influx"
+)
+
+const (
+	// the default of sarama and of message.max.bytes of the brokers
+	defaultKafkaMaxMessageBytes = 1000000
+	// room for the key, the headers and the record overhead of a message
+	kafkaMessageOverhead = 256
+	// how long to wait for the producer to take a message, the rest of the batch is dropped after that
+	kafkaSendTimeout = 5 * time.Second
+)
+
+// KafkaConfig is the `kafka` section of a writer with `type: kafka`.
+// TLS is configured with the tls_* fields of the writer.
+type KafkaConfig struct {
+	Brokers      []string `yaml:"brokers"`
+	Topic        string   `yaml:"topic"`
+	KafkaVersion string   `yaml:"kafka_version"`
+	// remotewrite (snappy compressed protobuf WriteRequest, the same as the body of remote write 1.0),
+	// json (one message per series) or influx (line protocol)
+	Format string `yaml:"format"`
+	// series with the same values of these labels go to the same partition
+	PartitionKeyLabels []string `yaml:"partition_key_labels"`
+	// none, gzip, snappy, lz4 or zstd
+	Compression  string `yaml:"compression"`
+	RequiredAcks int16  `yaml:"required_acks"`
+	// must not be larger than message.max.bytes of the brokers, max_bytes of the writer is capped by it
+	MaxMessageBytes int `yaml:"max_message_bytes"`
+
+	SaslEnabled   bool          `yaml:"sasl_enabled"`
+	SASLHandshake *bool         `yaml:"sasl_handshake"`
+	SaslUsername  string        `yaml:"sasl_username"`
+	SaslPassword  secret.Secret `yaml:"sasl_password"`
+	// plain, scram-sha256 or scram-sha512
+	SaslMechanism string `yaml:"sasl_mechanism"`
+
+	TLSEnabled bool `yaml:"tls_enabled"`
+
+	producer  sarama.AsyncProducer
+	sentTotal *metrics.Counter
+	errTotal  *metrics.Counter
+}
+
+func (kc *KafkaConfig) parse(w *Writer) error {
+	if len(kc.Brokers) == 0 {
+		return fmt.Errorf("kafka brokers are empty")
+	}
+
+	if kc.Topic == "" {
+		return fmt.Errorf("kafka topic is empty")
+	}
+
+	switch kc.Format {
+	case "":
+		kc.Format = KafkaFormatRemoteWrite
+	case KafkaFormatRemoteWrite, KafkaFormatJSON, KafkaFormatInflux:
+	default:
+		return fmt.Errorf("unsupported kafka format %q", kc.Format)
+	}
+
+	config := sarama.NewConfig()
+	config.ClientID = "cprobe"
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	config.Producer.RequiredAcks = sarama.WaitForLocal
+	if kc.RequiredAcks != 0 {
+		config.Producer.RequiredAcks = sarama.RequiredAcks(kc.RequiredAcks)
+	}
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+
+	if kc.MaxMessageBytes <= 0 {
+		kc.MaxMessageBytes = defaultKafkaMaxMessageBytes
+	}
+	config.Producer.MaxMessageBytes = kc.MaxMessageBytes
+	// 攒批的大小不能超过单条消息的上限，否则 producer 会直接拒绝
+	if limit := kc.MaxMessageBytes - kafkaMessageOverhead; w.MaxBytes > limit {
+		w.MaxBytes = limit
+	}
+
+	if kc.KafkaVersion != "" {
+		version, err := sarama.ParseKafkaVersion(kc.KafkaVersion)
+		if err != nil {
+			return fmt.Errorf("invalid kafka_version %q: %w", kc.KafkaVersion, err)
+		}
+		config.Version = version
+	}
+
+	switch kc.Compression {
+	case "", "none":
+		config.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		config.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		config.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		config.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		config.Producer.Compression = sarama.CompressionZSTD
+	default:
+		return fmt.Errorf("unsupported kafka compression %q", kc.Compression)
+	}
+
+	if kc.SaslEnabled {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = kc.SaslUsername
+		config.Net.SASL.Password = kc.SaslPassword.Value()
+		config.Net.SASL.Handshake = kc.SASLHandshake == nil || *kc.SASLHandshake
+
+		switch strings.ToLower(kc.SaslMechanism) {
+		case "", "plain":
+			config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		case "scram-sha256":
+			config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &exporter.XDGSCRAMClient{HashGeneratorFcn: exporter.SHA256}
+			}
+		case "scram-sha512":
+			config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &exporter.XDGSCRAMClient{HashGeneratorFcn: exporter.SHA512}
+			}
+		default:
+			return fmt.Errorf("unsupported sasl_mechanism %q, must be plain, scram-sha256 or scram-sha512", kc.SaslMechanism)
+		}
+	}
+
+	if kc.TLSEnabled {
+		tlsConfig, err := w.ClientConfig.TLSConfig()
+		if err != nil {
+			return err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	producer, err := sarama.NewAsyncProducer(kc.Brokers, config)
+	if err != nil {
+		return fmt.Errorf("cannot create kafka producer: %w", err)
+	}
+	kc.producer = producer
+
+	kc.sentTotal = metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_writer_kafka_messages_total{topic=%q,status="success"}`, kc.Topic))
+	kc.errTotal = metrics.GetOrCreateCounter(fmt.Sprintf(`cprobe_writer_kafka_messages_total{topic=%q,status="error"}`, kc.Topic))
+
+	go func() {
+		for range producer.Successes() {
+			kc.sentTotal.Inc()
+		}
+	}()
+
+	go func() {
+		for err := range producer.Errors() {
+			kc.errTotal.Inc()
+			logger.Errorf("cannot deliver message to kafka topic %q: %s", kc.Topic, err.Err)
+		}
+	}()
+
+	return nil
+}
+
+type kafkaMessage struct {
+	key   string
+	value []byte
+}
+
+// writeKafka sends tss of tenant, the tenant goes to the tenant_header header of the messages if it isn't empty
+func (w *Writer) writeKafka(tss []prompbmarshal.TimeSeries, tenant string) {
+	kc := w.Kafka
+
+	if tenant == "" {
+		tenant = w.DefaultTenant
+	}
+	var headers []sarama.RecordHeader
+	if tenant != "" {
+		headers = []sarama.RecordHeader{{Key: []byte(w.TenantHeader), Value: []byte(tenant)}}
+	}
+
+	msgs := kc.marshal(tss)
+	for i, msg := range msgs {
+		if !kc.send(msg.key, msg.value, headers) {
+			kc.errTotal.Add(len(msgs) - i)
+			logger.Errorf("kafka producer of topic %q is stuck for %s, dropped %d messages", kc.Topic, kafkaSendTimeout, len(msgs)-i)
+			return
+		}
+	}
+}
+
+// marshal converts tss to messages in kc.Format
+func (kc *KafkaConfig) marshal(tss []prompbmarshal.TimeSeries) []kafkaMessage {
+	var msgs []kafkaMessage
+
+	if kc.Format == KafkaFormatJSON {
+		for i := range tss {
+			bs, err := json.Marshal(newKafkaJSONSeries(&tss[i]))
+			if err != nil {
+				logger.Warnf("cannot marshal series to json: %s", err)
+				continue
+			}
+			msgs = append(msgs, kafkaMessage{key: kc.partitionKey(tss[i].Labels), value: bs})
+		}
+		return msgs
+	}
+
+	// series with the same partition key are sent in a single message
+	var keys []string
+	groups := make(map[string][]prompbmarshal.TimeSeries)
+	for i := range tss {
+		key := kc.partitionKey(tss[i].Labels)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], tss[i])
+	}
+
+	for _, key := range keys {
+		msgs = kc.appendGroup(msgs, key, groups[key])
+	}
+
+	return msgs
+}
+
+// appendGroup marshals the series of the same partition key, the group is split if the message is too large
+func (kc *KafkaConfig) appendGroup(msgs []kafkaMessage, key string, group []prompbmarshal.TimeSeries) []kafkaMessage {
+	var bs []byte
+	switch kc.Format {
+	case KafkaFormatInflux:
+		bs = []byte(strings.Join(marshalInfluxLines(group), "\n"))
+	default:
+		req := prompbmarshal.WriteRequest{
+			Timeseries: dropMetaLabels(group),
+		}
+		raw, err := req.Marshal()
+		if err != nil {
+			logger.Warnf("cannot marshal WriteRequest: %s", err)
+			return msgs
+		}
+		bs = snappy.Encode(nil, raw)
+	}
+
+	if len(bs) == 0 {
+		return msgs
+	}
+
+	// max_bytes of the writer is an estimate, the encoded message can still be larger
+	if len(group) > 1 && len(key)+len(bs)+kafkaMessageOverhead > kc.MaxMessageBytes {
+		msgs = kc.appendGroup(msgs, key, group[:len(group)/2])
+		return kc.appendGroup(msgs, key, group[len(group)/2:])
+	}
+
+	return append(msgs, kafkaMessage{key: key, value: bs})
+}
+
+// send hands a message to the producer, it returns false if the producer doesn't take it in kafkaSendTimeout
+func (kc *KafkaConfig) send(key string, value []byte, headers []sarama.RecordHeader) bool {
+	msg := &sarama.ProducerMessage{
+		Topic:   kc.Topic,
+		Value:   sarama.ByteEncoder(value),
+		Headers: headers,
+	}
+	if key != "" {
+		msg.Key = sarama.StringEncoder(key)
+	}
+
+	t := time.NewTimer(kafkaSendTimeout)
+	defer t.Stop()
+
+	select {
+	case kc.producer.Input() <- msg:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+func (kc *KafkaConfig) partitionKey(labels []prompbmarshal.Label) string {
+	if len(kc.PartitionKeyLabels) == 0 {
+		return ""
+	}
+
+	values := make([]string, 0, len(kc.PartitionKeyLabels))
+	for _, name := range kc.PartitionKeyLabels {
+		var value string
+		for _, label := range labels {
+			if label.Name == name {
+				value = label.Value
+				break
+			}
+		}
+		values = append(values, value)
+	}
+
+	return strings.Join(values, ",")
+}
+
+type kafkaJSONSeries struct {
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels"`
+	Timestamp int64             `json:"timestamp"`
+	Value     kafkaJSONValue    `json:"value"`
+}
+
+// kafkaJSONValue is a number, NaN and ±Inf are strings "NaN", "+Inf" and "-Inf" like in the Prometheus JSON APIs,
+// JSON numbers can't represent them
+type kafkaJSONValue float64
+
+func (v kafkaJSONValue) MarshalJSON() ([]byte, error) {
+	f := float64(v)
+	switch {
+	case math.IsNaN(f):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(f, 1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(f, -1):
+		return []byte(`"-Inf"`), nil
+	}
+	return json.Marshal(f)
+}
+
+func (v *kafkaJSONValue) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		*v = kafkaJSONValue(f)
+		return nil
+	}
+
+	var f float64
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	*v = kafkaJSONValue(f)
+	return nil
+}
+
+func newKafkaJSONSeries(ts *prompbmarshal.TimeSeries) *kafkaJSONSeries {
+	s := &kafkaJSONSeries{
+		Labels: make(map[string]string, len(ts.Labels)),
+	}
+
+	for _, label := range ts.Labels {
+		if label.Name == "__name__" {
+			s.Name = label.Value
+			continue
+		}
+		if strings.HasPrefix(label.Name, "__") {
+			continue
+		}
+		s.Labels[label.Name] = label.Value
+	}
+
+	if len(ts.Samples) > 0 {
+		s.Timestamp = ts.Samples[0].Timestamp
+		s.Value = kafkaJSONValue(ts.Samples[0].Value)
+	}
+
+	return s
+}
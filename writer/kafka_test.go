@@ -0,0 +1,180 @@
+package writer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/prompb"
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/types"
+	"github.com/golang/snappy"
+)
+
+func newKafkaTS(value float64, kvs ...string) prompbmarshal.TimeSeries {
+	var labels []prompbmarshal.Label
+	for i := 0; i < len(kvs); i += 2 {
+		labels = append(labels, prompbmarshal.Label{Name: kvs[i], Value: kvs[i+1]})
+	}
+	return prompbmarshal.TimeSeries{
+		Labels:  labels,
+		Samples: []prompbmarshal.Sample{{Value: value, Timestamp: 1000}},
+	}
+}
+
+func TestKafkaPartitionKey(t *testing.T) {
+	labels := newKafkaTS(1, "__name__", "up", "instance", "a:9100", "region", "bj").Labels
+
+	f := func(keyLabels []string, expected string) {
+		t.Helper()
+		kc := &KafkaConfig{PartitionKeyLabels: keyLabels}
+		if key := kc.partitionKey(labels); key != expected {
+			t.Fatalf("unexpected partition key for %v: got %q, want %q", keyLabels, key, expected)
+		}
+	}
+
+	f(nil, "")
+	f([]string{"instance"}, "a:9100")
+	f([]string{"region", "instance"}, "bj,a:9100")
+	// missing labels keep their place
+	f([]string{"zone", "instance"}, ",a:9100")
+}
+
+func TestKafkaMarshalJSON(t *testing.T) {
+	kc := &KafkaConfig{Format: KafkaFormatJSON, PartitionKeyLabels: []string{"instance"}, MaxMessageBytes: defaultKafkaMaxMessageBytes}
+	msgs := kc.marshal([]prompbmarshal.TimeSeries{
+		newKafkaTS(1, "__name__", "mysql_up", types.LabelPlugin, "mysql", "instance", "a:3306"),
+		newKafkaTS(2.5, "__name__", "redis_up", "instance", "b:6379"),
+	})
+	if len(msgs) != 2 {
+		t.Fatalf("unexpected number of messages: %d", len(msgs))
+	}
+
+	var s kafkaJSONSeries
+	if err := json.Unmarshal(msgs[0].value, &s); err != nil {
+		t.Fatalf("cannot unmarshal message: %s", err)
+	}
+	expected := kafkaJSONSeries{Name: "mysql_up", Labels: map[string]string{"instance": "a:3306"}, Timestamp: 1000, Value: 1}
+	if !reflect.DeepEqual(s, expected) || msgs[0].key != "a:3306" {
+		t.Fatalf("unexpected message %q: %s", msgs[0].key, msgs[0].value)
+	}
+	if msgs[1].key != "b:6379" {
+		t.Fatalf("unexpected key: %q", msgs[1].key)
+	}
+}
+
+func TestKafkaMarshalJSONSpecialValues(t *testing.T) {
+	kc := &KafkaConfig{Format: KafkaFormatJSON, MaxMessageBytes: defaultKafkaMaxMessageBytes}
+	f := func(value float64, expected string) {
+		t.Helper()
+
+		msgs := kc.marshal([]prompbmarshal.TimeSeries{newKafkaTS(value, "__name__", "up")})
+		if len(msgs) != 1 {
+			t.Fatalf("unexpected number of messages for %v: %d", value, len(msgs))
+		}
+		if !strings.Contains(string(msgs[0].value), `"value":`+expected) {
+			t.Fatalf("unexpected message for %v: %s", value, msgs[0].value)
+		}
+
+		var s kafkaJSONSeries
+		if err := json.Unmarshal(msgs[0].value, &s); err != nil {
+			t.Fatalf("cannot unmarshal message: %s", err)
+		}
+		got := float64(s.Value)
+		if got != value && !(math.IsNaN(got) && math.IsNaN(value)) {
+			t.Fatalf("unexpected value: got %v, want %v", got, value)
+		}
+	}
+
+	f(1.5, `1.5`)
+	f(math.NaN(), `"NaN"`)
+	f(math.Inf(1), `"+Inf"`)
+	f(math.Inf(-1), `"-Inf"`)
+}
+
+func TestKafkaMarshalRemoteWrite(t *testing.T) {
+	kc := &KafkaConfig{Format: KafkaFormatRemoteWrite, PartitionKeyLabels: []string{"instance"}, MaxMessageBytes: defaultKafkaMaxMessageBytes}
+	msgs := kc.marshal([]prompbmarshal.TimeSeries{
+		newKafkaTS(1, "__name__", "mysql_up", types.LabelPlugin, "mysql", types.LabelType, "gauge", "instance", "a"),
+		newKafkaTS(2, "__name__", "redis_up", "instance", "b"),
+		newKafkaTS(3, "__name__", "mysql_threads", "instance", "a"),
+	})
+
+	// grouped by the partition key
+	got := make(map[string][]string)
+	for _, msg := range msgs {
+		got[msg.key] = append(got[msg.key], decodeKafkaRemoteWrite(t, msg.value)...)
+	}
+	expected := map[string][]string{
+		"a": {`__name__=mysql_up,instance=a 1`, `__name__=mysql_threads,instance=a 3`},
+		"b": {`__name__=redis_up,instance=b 2`},
+	}
+	if len(msgs) != 2 || !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected messages:\ngot  %v\nwant %v", got, expected)
+	}
+}
+
+func TestKafkaMarshalSplit(t *testing.T) {
+	var tss []prompbmarshal.TimeSeries
+	for i := 0; i < 100; i++ {
+		// hashes don't compress, snappy can't shrink the messages under the limit
+		sum := sha256.Sum256([]byte(strconv.Itoa(i)))
+		tss = append(tss, newKafkaTS(float64(i), "__name__", "up", "instance", hex.EncodeToString(sum[:])+hex.EncodeToString(sum[:16])))
+	}
+
+	// a message takes about 130 bytes per series, and can't be larger than 2000 bytes
+	kc := &KafkaConfig{Format: KafkaFormatRemoteWrite, MaxMessageBytes: 2000}
+	msgs := kc.marshal(tss)
+	if len(msgs) < 2 {
+		t.Fatalf("expecting the batch to be split, got %d messages", len(msgs))
+	}
+
+	n := 0
+	for _, msg := range msgs {
+		if len(msg.value)+kafkaMessageOverhead > kc.MaxMessageBytes {
+			t.Fatalf("the message is too large: %d bytes", len(msg.value))
+		}
+		n += len(decodeKafkaRemoteWrite(t, msg.value))
+	}
+	if n != len(tss) {
+		t.Fatalf("unexpected number of series: got %d, want %d", n, len(tss))
+	}
+}
+
+// decodeKafkaRemoteWrite returns the series of a snappy compressed WriteRequest
+func decodeKafkaRemoteWrite(t *testing.T, bs []byte) []string {
+	t.Helper()
+
+	raw, err := snappy.Decode(nil, bs)
+	if err != nil {
+		t.Fatalf("cannot decode snappy: %s", err)
+	}
+	return decodeRemoteWrite(t, raw)
+}
+
+// decodeRemoteWrite returns the series of a WriteRequest as `name=value,... sample`
+func decodeRemoteWrite(t *testing.T, bs []byte) []string {
+	t.Helper()
+
+	var req prompb.WriteRequest
+	if err := req.Unmarshal(bs); err != nil {
+		t.Fatalf("cannot unmarshal WriteRequest: %s", err)
+	}
+
+	var series []string
+	for _, ts := range req.Timeseries {
+		var labels []string
+		for _, label := range ts.Labels {
+			labels = append(labels, string(label.Name)+"="+string(label.Value))
+		}
+		for _, s := range ts.Samples {
+			series = append(series, strings.Join(labels, ",")+" "+strconv.FormatFloat(s.Value, 'g', -1, 64))
+		}
+	}
+	return series
+}
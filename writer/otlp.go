@@ -0,0 +1,680 @@
+package writer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cprobe/cprobe/lib/buildinfo"
+	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/types"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	OTLPEncodingProtobuf = "protobuf"
+	OTLPEncodingJSON     = "json"
+)
+
+// OTLPConfig is the `otlp` section of a writer with `type: otlp`.
+// The url is the OTLP/HTTP metrics endpoint, e.g. http://otel-collector:4318/v1/metrics
+type OTLPConfig struct {
+	// protobuf or json
+	Encoding string `yaml:"encoding"`
+	// gzip or none
+	Compression string `yaml:"compression"`
+}
+
+func (oc *OTLPConfig) parse() error {
+	switch oc.Encoding {
+	case "":
+		oc.Encoding = OTLPEncodingProtobuf
+	case OTLPEncodingProtobuf, OTLPEncodingJSON:
+	default:
+		return fmt.Errorf("unsupported otlp encoding %q, must be protobuf or json", oc.Encoding)
+	}
+
+	switch oc.Compression {
+	case "":
+		oc.Compression = "none"
+	case "gzip", "none":
+	default:
+		return fmt.Errorf("unsupported otlp compression %q, must be gzip or none", oc.Compression)
+	}
+
+	return nil
+}
+
+func (w *Writer) writeOTLP(tss []prompbmarshal.TimeSeries, tenant string) {
+	// global extra labels describe the cprobe instance, so they become resource attributes
+	var resource []prompbmarshal.Label
+	if WriterConfig.Global != nil && WriterConfig.Global.ExtraLabels != nil {
+		resource = WriterConfig.Global.ExtraLabels.Labels
+	}
+
+	req := buildOTLPRequest(tss, resource)
+	if len(req.ResourceMetrics[0].ScopeMetrics[0].Metrics) == 0 {
+		return
+	}
+
+	var bs []byte
+	if w.OTLP.Encoding == OTLPEncodingJSON {
+		var err error
+		bs, err = json.Marshal(req)
+		if err != nil {
+			logger.Warnf("cannot marshal otlp request to json: %s", err)
+			return
+		}
+	} else {
+		bs = req.marshalProtobuf(nil)
+	}
+
+	if w.OTLP.Compression == "gzip" {
+		var zbuf bytes.Buffer
+		zw := gzip.NewWriter(&zbuf)
+		if _, err := zw.Write(bs); err != nil {
+			logger.Warnf("cannot gzip otlp request: %s", err)
+			return
+		}
+		if err := zw.Close(); err != nil {
+			logger.Warnf("cannot gzip otlp request: %s", err)
+			return
+		}
+		bs = zbuf.Bytes()
+	}
+
+	httpReq, err := w.NewRequest(bs, tenant)
+	if err != nil {
+		logger.Warnf("cannot create http request: %s", err)
+		return
+	}
+
+	w.RequestQueue.PushFront(httpReq)
+}
+
+// The structs below mirror opentelemetry-proto metrics/v1, the json tags follow the OTLP/JSON mapping.
+
+const otlpTemporalityCumulative = 2
+
+// otlpProcessStartNano is the start time of the cumulative points whose created timestamp is unknown,
+// the counters of the targets started before cprobe in the worst case, so it is a lower bound of the real start
+var otlpProcessStartNano = uint64(time.Now().UnixNano())
+
+type otlpRequest struct {
+	ResourceMetrics []*otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource        `json:"resource"`
+	ScopeMetrics []*otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope     `json:"scope"`
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpMetric struct {
+	Name      string         `json:"name"`
+	Gauge     *otlpGauge     `json:"gauge,omitempty"`
+	Sum       *otlpSum       `json:"sum,omitempty"`
+	Histogram *otlpHistogram `json:"histogram,omitempty"`
+	Summary   *otlpSummary   `json:"summary,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []*otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []*otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                    `json:"aggregationTemporality"`
+	IsMonotonic            bool                   `json:"isMonotonic"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []*otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                       `json:"aggregationTemporality"`
+}
+
+type otlpSummary struct {
+	DataPoints []*otlpSummaryDataPoint `json:"dataPoints"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+	// only set for sums, gauges don't have a start time
+	StartTimeUnixNano uint64  `json:"startTimeUnixNano,string,omitempty"`
+	TimeUnixNano      uint64  `json:"timeUnixNano,string"`
+	AsDouble          float64 `json:"asDouble"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano uint64         `json:"startTimeUnixNano,string"`
+	TimeUnixNano      uint64         `json:"timeUnixNano,string"`
+	Count             uint64         `json:"count,string"`
+	Sum               float64        `json:"sum"`
+	BucketCounts      []string       `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+
+	// cumulative counts by upper bound, converted to BucketCounts by finish
+	buckets  map[float64]float64
+	hasCount bool
+}
+
+type otlpSummaryDataPoint struct {
+	Attributes        []otlpKeyValue        `json:"attributes,omitempty"`
+	StartTimeUnixNano uint64                `json:"startTimeUnixNano,string"`
+	TimeUnixNano      uint64                `json:"timeUnixNano,string"`
+	Count             uint64                `json:"count,string"`
+	Sum               float64               `json:"sum"`
+	QuantileValues    []otlpValueAtQuantile `json:"quantileValues"`
+}
+
+type otlpValueAtQuantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// otlpBuilder groups series into OTLP metrics, the series of a histogram or a summary are merged into data points
+type otlpBuilder struct {
+	metrics   []*otlpMetric
+	byName    map[string]*otlpMetric
+	histogram map[string]*otlpHistogramDataPoint
+	summary   map[string]*otlpSummaryDataPoint
+}
+
+// buildOTLPRequest converts series to an OTLP export request.
+//
+// The kind of a metric comes from types.LabelType. Series without it are sums if their name ends with _total,
+// gauges otherwise. Labels listed in resource become resource attributes instead of data point attributes.
+// Cumulative points start at types.LabelCreated if the plugin knows it, at the start of cprobe otherwise.
+func buildOTLPRequest(tss []prompbmarshal.TimeSeries, resource []prompbmarshal.Label) *otlpRequest {
+	b := &otlpBuilder{
+		byName:    make(map[string]*otlpMetric),
+		histogram: make(map[string]*otlpHistogramDataPoint),
+		summary:   make(map[string]*otlpSummaryDataPoint),
+	}
+
+	isResource := make(map[string]bool, len(resource))
+	for _, label := range resource {
+		isResource[label.Name] = true
+	}
+
+	for i := range tss {
+		ts := &tss[i]
+
+		var name, tp, le, quantile string
+		startNano := otlpProcessStartNano
+		attrs := make([]otlpKeyValue, 0, len(ts.Labels))
+		for _, label := range ts.Labels {
+			switch {
+			case label.Name == "__name__":
+				name = label.Value
+			case label.Name == types.LabelType:
+				tp = label.Value
+			case label.Name == types.LabelCreated:
+				if created, err := strconv.ParseInt(label.Value, 10, 64); err == nil && created > 0 {
+					startNano = uint64(created) * 1e6
+				}
+			case strings.HasPrefix(label.Name, "__") || isResource[label.Name] || label.Value == "":
+			case label.Name == "le" && tp == "histogram":
+				le = label.Value
+			case label.Name == "quantile" && tp == "summary":
+				quantile = label.Value
+			default:
+				attrs = append(attrs, otlpKeyValue{Key: label.Name, Value: otlpAnyValue{StringValue: label.Value}})
+			}
+		}
+
+		if name == "" {
+			continue
+		}
+
+		// le and quantile can come before __type__, pick them up again
+		if (tp == "histogram" && le == "") || (tp == "summary" && quantile == "") {
+			attrs, le, quantile = extractOTLPBucketLabels(attrs, tp)
+		}
+
+		sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+
+		for _, sample := range ts.Samples {
+			if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+				continue
+			}
+			tsNano := uint64(sample.Timestamp) * 1e6
+
+			// the start time can't be after the point
+			start := startNano
+			if start > tsNano {
+				start = tsNano
+			}
+
+			switch tp {
+			case "histogram":
+				b.addHistogram(name, le, attrs, start, tsNano, sample.Value)
+			case "summary":
+				b.addSummary(name, quantile, attrs, start, tsNano, sample.Value)
+			case "counter":
+				b.addNumber(name, true, attrs, start, tsNano, sample.Value)
+			case "gauge":
+				b.addNumber(name, false, attrs, start, tsNano, sample.Value)
+			default:
+				b.addNumber(name, strings.HasSuffix(name, "_total"), attrs, start, tsNano, sample.Value)
+			}
+		}
+	}
+
+	for _, m := range b.metrics {
+		if m.Histogram != nil {
+			for _, dp := range m.Histogram.DataPoints {
+				dp.finish()
+			}
+		}
+	}
+
+	rm := &otlpResourceMetrics{
+		ScopeMetrics: []*otlpScopeMetrics{{
+			Scope:   otlpScope{Name: "cprobe", Version: buildinfo.Version},
+			Metrics: b.metrics,
+		}},
+	}
+	for _, label := range resource {
+		rm.Resource.Attributes = append(rm.Resource.Attributes, otlpKeyValue{Key: label.Name, Value: otlpAnyValue{StringValue: label.Value}})
+	}
+
+	return &otlpRequest{ResourceMetrics: []*otlpResourceMetrics{rm}}
+}
+
+func extractOTLPBucketLabels(attrs []otlpKeyValue, tp string) ([]otlpKeyValue, string, string) {
+	var le, quantile string
+	dst := attrs[:0]
+	for _, kv := range attrs {
+		switch {
+		case tp == "histogram" && kv.Key == "le":
+			le = kv.Value.StringValue
+		case tp == "summary" && kv.Key == "quantile":
+			quantile = kv.Value.StringValue
+		default:
+			dst = append(dst, kv)
+		}
+	}
+	return dst, le, quantile
+}
+
+func (b *otlpBuilder) getMetric(name, kind string) *otlpMetric {
+	key := kind + "/" + name
+	if m, ok := b.byName[key]; ok {
+		return m
+	}
+
+	m := &otlpMetric{Name: name}
+	switch kind {
+	case "gauge":
+		m.Gauge = &otlpGauge{}
+	case "sum":
+		m.Sum = &otlpSum{AggregationTemporality: otlpTemporalityCumulative, IsMonotonic: true}
+	case "histogram":
+		m.Histogram = &otlpHistogram{AggregationTemporality: otlpTemporalityCumulative}
+	case "summary":
+		m.Summary = &otlpSummary{}
+	}
+
+	b.byName[key] = m
+	b.metrics = append(b.metrics, m)
+	return m
+}
+
+func (b *otlpBuilder) addNumber(name string, monotonic bool, attrs []otlpKeyValue, startNano, tsNano uint64, value float64) {
+	dp := &otlpNumberDataPoint{Attributes: attrs, TimeUnixNano: tsNano, AsDouble: value}
+	if monotonic {
+		dp.StartTimeUnixNano = startNano
+		m := b.getMetric(name, "sum")
+		m.Sum.DataPoints = append(m.Sum.DataPoints, dp)
+	} else {
+		m := b.getMetric(name, "gauge")
+		m.Gauge.DataPoints = append(m.Gauge.DataPoints, dp)
+	}
+}
+
+func (b *otlpBuilder) addHistogram(name, le string, attrs []otlpKeyValue, startNano, tsNano uint64, value float64) {
+	base, suffix := trimMetricSuffix(name, "_bucket", "_sum", "_count")
+	if suffix == "" || (suffix == "_bucket" && le == "") {
+		b.addNumber(name, false, attrs, startNano, tsNano, value)
+		return
+	}
+
+	key := otlpPointKey(base, attrs, tsNano)
+	dp, ok := b.histogram[key]
+	if !ok {
+		dp = &otlpHistogramDataPoint{Attributes: attrs, StartTimeUnixNano: startNano, TimeUnixNano: tsNano, buckets: make(map[float64]float64)}
+		b.histogram[key] = dp
+		m := b.getMetric(base, "histogram")
+		m.Histogram.DataPoints = append(m.Histogram.DataPoints, dp)
+	}
+
+	switch suffix {
+	case "_sum":
+		dp.Sum = value
+	case "_count":
+		dp.Count = uint64(value)
+		dp.hasCount = true
+	default:
+		bound, err := strconv.ParseFloat(le, 64)
+		if err != nil {
+			return
+		}
+		dp.buckets[bound] = value
+	}
+}
+
+// finish turns cumulative Prometheus buckets into OTLP bucket counts
+func (dp *otlpHistogramDataPoint) finish() {
+	inf, hasInf := dp.buckets[math.Inf(1)]
+	if !dp.hasCount && hasInf {
+		dp.Count = uint64(inf)
+	}
+
+	dp.ExplicitBounds = dp.ExplicitBounds[:0]
+	for bound := range dp.buckets {
+		if !math.IsInf(bound, 1) {
+			dp.ExplicitBounds = append(dp.ExplicitBounds, bound)
+		}
+	}
+	sort.Float64s(dp.ExplicitBounds)
+
+	dp.BucketCounts = make([]string, 0, len(dp.ExplicitBounds)+1)
+	var prev uint64
+	for _, bound := range dp.ExplicitBounds {
+		cum := uint64(dp.buckets[bound])
+		if cum < prev {
+			cum = prev
+		}
+		dp.BucketCounts = append(dp.BucketCounts, strconv.FormatUint(cum-prev, 10))
+		prev = cum
+	}
+	if dp.Count < prev {
+		dp.Count = prev
+	}
+	dp.BucketCounts = append(dp.BucketCounts, strconv.FormatUint(dp.Count-prev, 10))
+}
+
+func (b *otlpBuilder) addSummary(name, quantile string, attrs []otlpKeyValue, startNano, tsNano uint64, value float64) {
+	base, suffix := trimMetricSuffix(name, "_sum", "_count", "_quantile")
+	if suffix == "" && quantile == "" {
+		b.addNumber(name, false, attrs, startNano, tsNano, value)
+		return
+	}
+
+	key := otlpPointKey(base, attrs, tsNano)
+	dp, ok := b.summary[key]
+	if !ok {
+		dp = &otlpSummaryDataPoint{Attributes: attrs, StartTimeUnixNano: startNano, TimeUnixNano: tsNano}
+		b.summary[key] = dp
+		m := b.getMetric(base, "summary")
+		m.Summary.DataPoints = append(m.Summary.DataPoints, dp)
+	}
+
+	switch suffix {
+	case "_sum":
+		dp.Sum = value
+	case "_count":
+		dp.Count = uint64(value)
+	default:
+		q, err := strconv.ParseFloat(quantile, 64)
+		if err != nil {
+			return
+		}
+		dp.QuantileValues = append(dp.QuantileValues, otlpValueAtQuantile{Quantile: q, Value: value})
+	}
+}
+
+func trimMetricSuffix(name string, suffixes ...string) (string, string) {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix), suffix
+		}
+	}
+	return name, ""
+}
+
+// otlpSeriesGroup returns the key of the histogram or summary data point ts belongs to, the series of a data point
+// must be sent in the same request. It is empty for the other series
+func otlpSeriesGroup(ts *prompbmarshal.TimeSeries) string {
+	var name, tp string
+	for _, label := range ts.Labels {
+		switch label.Name {
+		case "__name__":
+			name = label.Value
+		case types.LabelType:
+			tp = label.Value
+		}
+	}
+
+	var base string
+	switch tp {
+	case "histogram":
+		base, _ = trimMetricSuffix(name, "_bucket", "_sum", "_count")
+	case "summary":
+		base, _ = trimMetricSuffix(name, "_sum", "_count", "_quantile")
+	default:
+		return ""
+	}
+
+	// the same attributes as buildOTLPRequest, the order of the labels isn't stable
+	attrs := make([]otlpKeyValue, 0, len(ts.Labels))
+	for _, label := range ts.Labels {
+		if strings.HasPrefix(label.Name, "__") || label.Name == "le" || label.Name == "quantile" || label.Value == "" {
+			continue
+		}
+		attrs = append(attrs, otlpKeyValue{Key: label.Name, Value: otlpAnyValue{StringValue: label.Value}})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+
+	var tsNano uint64
+	if len(ts.Samples) > 0 {
+		tsNano = uint64(ts.Samples[0].Timestamp) * 1e6
+	}
+	return otlpPointKey(base, attrs, tsNano)
+}
+
+func otlpPointKey(name string, attrs []otlpKeyValue, tsNano uint64) string {
+	var sb strings.Builder
+	sb.WriteString(name)
+	for _, kv := range attrs {
+		sb.WriteByte(0xff)
+		sb.WriteString(kv.Key)
+		sb.WriteByte('=')
+		sb.WriteString(kv.Value.StringValue)
+	}
+	sb.WriteByte(0xff)
+	sb.WriteString(strconv.FormatUint(tsNano, 10))
+	return sb.String()
+}
+
+// protobuf encoding, field numbers are from opentelemetry-proto
+
+func appendOTLPMessage(b []byte, num protowire.Number, fn func([]byte) []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, fn(nil))
+}
+
+func appendOTLPString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendOTLPFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+func appendOTLPDouble(b []byte, num protowire.Number, v float64) []byte {
+	return appendOTLPFixed64(b, num, math.Float64bits(v))
+}
+
+func appendOTLPAttributes(b []byte, num protowire.Number, attrs []otlpKeyValue) []byte {
+	for _, kv := range attrs {
+		kv := kv
+		b = appendOTLPMessage(b, num, func(b []byte) []byte {
+			b = appendOTLPString(b, 1, kv.Key)
+			return appendOTLPMessage(b, 2, func(b []byte) []byte {
+				// AnyValue.string_value, always present even if empty
+				b = protowire.AppendTag(b, 1, protowire.BytesType)
+				return protowire.AppendString(b, kv.Value.StringValue)
+			})
+		})
+	}
+	return b
+}
+
+func (r *otlpRequest) marshalProtobuf(b []byte) []byte {
+	for _, rm := range r.ResourceMetrics {
+		b = appendOTLPMessage(b, 1, rm.marshalProtobuf)
+	}
+	return b
+}
+
+func (rm *otlpResourceMetrics) marshalProtobuf(b []byte) []byte {
+	b = appendOTLPMessage(b, 1, func(b []byte) []byte {
+		return appendOTLPAttributes(b, 1, rm.Resource.Attributes)
+	})
+	for _, sm := range rm.ScopeMetrics {
+		b = appendOTLPMessage(b, 2, sm.marshalProtobuf)
+	}
+	return b
+}
+
+func (sm *otlpScopeMetrics) marshalProtobuf(b []byte) []byte {
+	b = appendOTLPMessage(b, 1, func(b []byte) []byte {
+		b = appendOTLPString(b, 1, sm.Scope.Name)
+		return appendOTLPString(b, 2, sm.Scope.Version)
+	})
+	for _, m := range sm.Metrics {
+		b = appendOTLPMessage(b, 2, m.marshalProtobuf)
+	}
+	return b
+}
+
+func (m *otlpMetric) marshalProtobuf(b []byte) []byte {
+	b = appendOTLPString(b, 1, m.Name)
+
+	switch {
+	case m.Gauge != nil:
+		b = appendOTLPMessage(b, 5, func(b []byte) []byte {
+			for _, dp := range m.Gauge.DataPoints {
+				b = appendOTLPMessage(b, 1, dp.marshalProtobuf)
+			}
+			return b
+		})
+	case m.Sum != nil:
+		b = appendOTLPMessage(b, 7, func(b []byte) []byte {
+			for _, dp := range m.Sum.DataPoints {
+				b = appendOTLPMessage(b, 1, dp.marshalProtobuf)
+			}
+			b = protowire.AppendTag(b, 2, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(m.Sum.AggregationTemporality))
+			if m.Sum.IsMonotonic {
+				b = protowire.AppendTag(b, 3, protowire.VarintType)
+				b = protowire.AppendVarint(b, 1)
+			}
+			return b
+		})
+	case m.Histogram != nil:
+		b = appendOTLPMessage(b, 9, func(b []byte) []byte {
+			for _, dp := range m.Histogram.DataPoints {
+				b = appendOTLPMessage(b, 1, dp.marshalProtobuf)
+			}
+			b = protowire.AppendTag(b, 2, protowire.VarintType)
+			return protowire.AppendVarint(b, uint64(m.Histogram.AggregationTemporality))
+		})
+	case m.Summary != nil:
+		b = appendOTLPMessage(b, 11, func(b []byte) []byte {
+			for _, dp := range m.Summary.DataPoints {
+				b = appendOTLPMessage(b, 1, dp.marshalProtobuf)
+			}
+			return b
+		})
+	}
+
+	return b
+}
+
+func (dp *otlpNumberDataPoint) marshalProtobuf(b []byte) []byte {
+	if dp.StartTimeUnixNano > 0 {
+		b = appendOTLPFixed64(b, 2, dp.StartTimeUnixNano)
+	}
+	b = appendOTLPFixed64(b, 3, dp.TimeUnixNano)
+	b = appendOTLPDouble(b, 4, dp.AsDouble)
+	return appendOTLPAttributes(b, 7, dp.Attributes)
+}
+
+func (dp *otlpHistogramDataPoint) marshalProtobuf(b []byte) []byte {
+	b = appendOTLPFixed64(b, 2, dp.StartTimeUnixNano)
+	b = appendOTLPFixed64(b, 3, dp.TimeUnixNano)
+	b = appendOTLPFixed64(b, 4, dp.Count)
+	b = appendOTLPDouble(b, 5, dp.Sum)
+
+	// packed repeated fields
+	b = appendOTLPMessage(b, 6, func(b []byte) []byte {
+		for _, s := range dp.BucketCounts {
+			n, _ := strconv.ParseUint(s, 10, 64)
+			b = protowire.AppendFixed64(b, n)
+		}
+		return b
+	})
+	if len(dp.ExplicitBounds) > 0 {
+		b = appendOTLPMessage(b, 7, func(b []byte) []byte {
+			for _, bound := range dp.ExplicitBounds {
+				b = protowire.AppendFixed64(b, math.Float64bits(bound))
+			}
+			return b
+		})
+	}
+
+	return appendOTLPAttributes(b, 9, dp.Attributes)
+}
+
+func (dp *otlpSummaryDataPoint) marshalProtobuf(b []byte) []byte {
+	b = appendOTLPFixed64(b, 2, dp.StartTimeUnixNano)
+	b = appendOTLPFixed64(b, 3, dp.TimeUnixNano)
+	b = appendOTLPFixed64(b, 4, dp.Count)
+	b = appendOTLPDouble(b, 5, dp.Sum)
+	for _, q := range dp.QuantileValues {
+		q := q
+		b = appendOTLPMessage(b, 6, func(b []byte) []byte {
+			b = appendOTLPDouble(b, 1, q.Quantile)
+			return appendOTLPDouble(b, 2, q.Value)
+		})
+	}
+	return appendOTLPAttributes(b, 7, dp.Attributes)
+}
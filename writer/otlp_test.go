@@ -0,0 +1,97 @@
+package writer
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/types"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestBuildOTLPRequest(t *testing.T) {
+	newTS := func(value float64, kvs ...string) prompbmarshal.TimeSeries {
+		var labels []prompbmarshal.Label
+		for i := 0; i < len(kvs); i += 2 {
+			labels = append(labels, prompbmarshal.Label{Name: kvs[i], Value: kvs[i+1]})
+		}
+		return prompbmarshal.TimeSeries{
+			Labels:  labels,
+			Samples: []prompbmarshal.Sample{{Value: value, Timestamp: 1000}},
+		}
+	}
+
+	tss := []prompbmarshal.TimeSeries{
+		newTS(1, "__name__", "up", types.LabelType, "gauge", "instance", "a", "region", "bj"),
+		newTS(7, "__name__", "requests_total", "instance", "a", "region", "bj", types.LabelCreated, "500"),
+		newTS(2, "__name__", "latency_bucket", "le", "0.1", types.LabelType, "histogram", "instance", "a"),
+		newTS(5, "__name__", "latency_bucket", "le", "1", types.LabelType, "histogram", "instance", "a"),
+		newTS(6, "__name__", "latency_bucket", "le", "+Inf", types.LabelType, "histogram", "instance", "a"),
+		newTS(6, "__name__", "latency_count", types.LabelType, "histogram", "instance", "a"),
+		newTS(3.5, "__name__", "latency_sum", types.LabelType, "histogram", "instance", "a"),
+	}
+
+	req := buildOTLPRequest(tss, []prompbmarshal.Label{{Name: "region", Value: "bj"}})
+	rm := req.ResourceMetrics[0]
+
+	if len(rm.Resource.Attributes) != 1 || rm.Resource.Attributes[0].Key != "region" {
+		t.Fatalf("unexpected resource attributes: %v", rm.Resource.Attributes)
+	}
+
+	metrics := rm.ScopeMetrics[0].Metrics
+	if len(metrics) != 3 {
+		t.Fatalf("unexpected number of metrics: %d", len(metrics))
+	}
+
+	gauge := metrics[0]
+	if gauge.Name != "up" || gauge.Gauge == nil || len(gauge.Gauge.DataPoints) != 1 {
+		t.Fatalf("unexpected gauge: %+v", gauge)
+	}
+	wantAttrs := []otlpKeyValue{{Key: "instance", Value: otlpAnyValue{StringValue: "a"}}}
+	if dp := gauge.Gauge.DataPoints[0]; !reflect.DeepEqual(dp.Attributes, wantAttrs) || dp.TimeUnixNano != 1e9 {
+		t.Fatalf("unexpected gauge data point: %+v", dp)
+	}
+
+	sum := metrics[1]
+	if sum.Name != "requests_total" || sum.Sum == nil || !sum.Sum.IsMonotonic {
+		t.Fatalf("unexpected sum: %+v", sum)
+	}
+	// cumulative points start at the created timestamp
+	if dp := sum.Sum.DataPoints[0]; dp.StartTimeUnixNano != 5e8 || len(dp.Attributes) != 1 {
+		t.Fatalf("unexpected sum data point: %+v", dp)
+	}
+	// gauges have no start time
+	if dp := gauge.Gauge.DataPoints[0]; dp.StartTimeUnixNano != 0 {
+		t.Fatalf("unexpected start time of gauge: %d", dp.StartTimeUnixNano)
+	}
+
+	hist := metrics[2]
+	if hist.Name != "latency" || hist.Histogram == nil || len(hist.Histogram.DataPoints) != 1 {
+		t.Fatalf("unexpected histogram: %+v", hist)
+	}
+	dp := hist.Histogram.DataPoints[0]
+	// the created timestamp is unknown, cprobe started after the point, so the point starts at itself
+	if dp.StartTimeUnixNano != 1e9 {
+		t.Fatalf("unexpected start time of histogram: %d", dp.StartTimeUnixNano)
+	}
+	if dp.Count != 6 || dp.Sum != 3.5 ||
+		!reflect.DeepEqual(dp.ExplicitBounds, []float64{0.1, 1}) ||
+		!reflect.DeepEqual(dp.BucketCounts, []string{"2", "3", "1"}) {
+		t.Fatalf("unexpected histogram data point: %+v", dp)
+	}
+
+	// the protobuf body must be well-formed
+	b := req.marshalProtobuf(nil)
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 || num != 1 || typ != protowire.BytesType {
+			t.Fatalf("unexpected field %d of type %d", num, typ)
+		}
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			t.Fatalf("cannot parse resource_metrics: %s", protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+}
@@ -0,0 +1,379 @@
+package writer
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/cprobe/cprobe/lib/fasttime"
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/lib/promrelabel"
+	"github.com/cprobe/cprobe/types"
+)
+
+var (
+	pullEnable = flag.Bool("pull.enable", false, "Keep the latest value of every series in memory and expose them at /federate and /metrics/<plugin>, so Prometheus can pull them. Works with -no-writer too")
+	pullTTL    = flag.Duration("pull.ttl", 5*time.Minute, "Series that are not updated during this time are removed from the pull store")
+)
+
+// PullEnabled returns true if the latest values are kept for pulling
+func PullEnabled() bool {
+	return *pullEnable
+}
+
+type pullSeries struct {
+	labels    []prompbmarshal.Label
+	value     float64
+	timestamp int64
+	updatedAt uint64
+}
+
+// pullStore keeps the latest sample of every series
+type pullStore struct {
+	mu     sync.RWMutex
+	series map[string]*pullSeries
+}
+
+var (
+	pullStoreOnce sync.Once
+	lastValues    *pullStore
+)
+
+func getPullStore() *pullStore {
+	pullStoreOnce.Do(func() {
+		lastValues = &pullStore{series: make(map[string]*pullSeries)}
+
+		_ = metrics.NewGauge(`cprobe_pull_series`, func() float64 {
+			lastValues.mu.RLock()
+			defer lastValues.mu.RUnlock()
+			return float64(len(lastValues.series))
+		})
+
+		go lastValues.expireLoop()
+	})
+	return lastValues
+}
+
+func (ps *pullStore) expireLoop() {
+	interval := *pullTTL / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		deadline := fasttime.UnixTimestamp() - uint64(pullTTL.Seconds())
+		ps.mu.Lock()
+		for key, s := range ps.series {
+			if s.updatedAt < deadline {
+				delete(ps.series, key)
+			}
+		}
+		ps.mu.Unlock()
+	}
+}
+
+// add stores copies of tss with the global extra labels and the global relabeling applied, tss is left intact
+func (ps *pullStore) add(tss []prompbmarshal.TimeSeries) {
+	copied := make([]prompbmarshal.TimeSeries, len(tss))
+	for i := range tss {
+		copied[i] = prompbmarshal.TimeSeries{
+			Labels:  append([]prompbmarshal.Label(nil), tss[i].Labels...),
+			Samples: tss[i].Samples,
+		}
+	}
+
+	if global := WriterConfig.Global; global != nil {
+		if global.ExtraLabels != nil && len(global.ExtraLabels.Labels) > 0 {
+			new(relabelCtx).appendExtraLabels(copied, global.ExtraLabels.Labels)
+		}
+		if global.ParsedRelabelConfigs.Len() > 0 {
+			copied = new(relabelCtx).applyRelabeling(copied, global.ParsedRelabelConfigs)
+		}
+	}
+
+	now := fasttime.UnixTimestamp()
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for i := range copied {
+		ts := &copied[i]
+		if len(ts.Samples) == 0 {
+			continue
+		}
+		sample := ts.Samples[len(ts.Samples)-1]
+
+		// the order of the labels from plugins isn't stable. The metadata for remote write 2.0 isn't exposed,
+		// the created timestamp would make a new series after every counter reset
+		labels := make([]prompbmarshal.Label, 0, len(ts.Labels))
+		for _, label := range ts.Labels {
+			switch label.Name {
+			case types.LabelHelp, types.LabelUnit, types.LabelCreated:
+			default:
+				labels = append(labels, label)
+			}
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+		key := pullSeriesKey(labels)
+		s, ok := ps.series[key]
+		if !ok {
+			s = &pullSeries{labels: labels}
+			ps.series[key] = s
+		}
+		s.value = sample.Value
+		s.timestamp = sample.Timestamp
+		s.updatedAt = now
+	}
+}
+
+func pullSeriesKey(labels []prompbmarshal.Label) string {
+	var sb strings.Builder
+	for _, label := range labels {
+		sb.WriteString(label.Name)
+		sb.WriteByte(0xff)
+		sb.WriteString(label.Value)
+		sb.WriteByte(0xff)
+	}
+	return sb.String()
+}
+
+// ParsePullMatches parses the match[] args of /federate, e.g. `{job="mysql"}`
+func ParsePullMatches(matches []string) ([]*promrelabel.IfExpression, error) {
+	ies := make([]*promrelabel.IfExpression, 0, len(matches))
+	for _, match := range matches {
+		ie := &promrelabel.IfExpression{}
+		if err := ie.Parse(match); err != nil {
+			return nil, fmt.Errorf("cannot parse match[]=%q: %w", match, err)
+		}
+		ies = append(ies, ie)
+	}
+	return ies, nil
+}
+
+type pullFamily struct {
+	name   string
+	tp     string
+	series []*pullSeries
+}
+
+// WritePullMetrics writes the latest values of the series of plugin, or of all plugins if plugin is empty.
+// Series must match one of matches if any. The output is OpenMetrics if openMetrics is true,
+// Prometheus text format otherwise.
+func WritePullMetrics(w io.Writer, plugin string, matches []*promrelabel.IfExpression, openMetrics bool) error {
+	if !*pullEnable {
+		return fmt.Errorf("pull mode is disabled, see -pull.enable")
+	}
+
+	ps := getPullStore()
+
+	var series []*pullSeries
+
+	ps.mu.RLock()
+	for _, s := range ps.series {
+		if plugin != "" && pullLabel(s.labels, types.LabelPlugin) != plugin {
+			continue
+		}
+		if !matchPullSeries(s.labels, matches) {
+			continue
+		}
+		// series are immutable once stored except for the value, copy it under the lock
+		cp := *s
+		series = append(series, &cp)
+	}
+	ps.mu.RUnlock()
+
+	return writePullFamilies(w, series, openMetrics)
+}
+
+// WriteTimeSeriesText writes the last sample of every series of tss in Prometheus text format without timestamps,
+// so the scraper uses the scrape time, e.g. for /probe
+func WriteTimeSeriesText(w io.Writer, tss []prompbmarshal.TimeSeries) error {
+	series := make([]*pullSeries, 0, len(tss))
+	for i := range tss {
+		ts := &tss[i]
+		if len(ts.Samples) == 0 {
+			continue
+		}
+
+		labels := append([]prompbmarshal.Label(nil), ts.Labels...)
+		sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+		series = append(series, &pullSeries{
+			labels: labels,
+			value:  ts.Samples[len(ts.Samples)-1].Value,
+		})
+	}
+
+	return writePullFamilies(w, series, false)
+}
+
+// writePullFamilies groups series by metric family and writes them, the labels of series must be sorted
+func writePullFamilies(w io.Writer, series []*pullSeries, openMetrics bool) error {
+	var families []*pullFamily
+	index := make(map[string]*pullFamily)
+
+	for _, s := range series {
+		name, tp := pullFamilyName(s.labels, openMetrics)
+		key := name + "/" + tp
+		f, ok := index[key]
+		if !ok {
+			f = &pullFamily{name: name, tp: tp}
+			index[key] = f
+			families = append(families, f)
+		}
+		f.series = append(f.series, s)
+	}
+
+	sort.Slice(families, func(i, j int) bool {
+		if families[i].name != families[j].name {
+			return families[i].name < families[j].name
+		}
+		return families[i].tp < families[j].tp
+	})
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		sort.Slice(f.series, func(i, j int) bool {
+			return pullSeriesKey(f.series[i].labels) < pullSeriesKey(f.series[j].labels)
+		})
+
+		if f.tp != "" {
+			fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, f.tp)
+		}
+		for _, s := range f.series {
+			writePullSample(bw, f, s, openMetrics)
+		}
+	}
+
+	if openMetrics {
+		bw.WriteString("# EOF\n")
+	}
+
+	return bw.Flush()
+}
+
+func matchPullSeries(labels []prompbmarshal.Label, matches []*promrelabel.IfExpression) bool {
+	if len(matches) == 0 {
+		return true
+	}
+	for _, ie := range matches {
+		if ie.Match(labels) {
+			return true
+		}
+	}
+	return false
+}
+
+func pullLabel(labels []prompbmarshal.Label, name string) string {
+	for _, label := range labels {
+		if label.Name == name {
+			return label.Value
+		}
+	}
+	return ""
+}
+
+// pullFamilyName returns the metric family name and type of the series, the type is empty if unknown
+func pullFamilyName(labels []prompbmarshal.Label, openMetrics bool) (string, string) {
+	name := pullLabel(labels, "__name__")
+	tp := pullLabel(labels, types.LabelType)
+
+	switch tp {
+	case "histogram":
+		base, _ := trimMetricSuffix(name, "_bucket", "_sum", "_count")
+		return base, tp
+	case "summary":
+		base, _ := trimMetricSuffix(name, "_sum", "_count", "_quantile")
+		return base, tp
+	case "counter":
+		if openMetrics {
+			// OpenMetrics counters must have the _total suffix
+			if !strings.HasSuffix(name, "_total") {
+				return name, "unknown"
+			}
+			return strings.TrimSuffix(name, "_total"), tp
+		}
+		return name, tp
+	case "gauge":
+		return name, tp
+	default:
+		if openMetrics {
+			return name, "unknown"
+		}
+		return name, ""
+	}
+}
+
+func writePullSample(bw *bufio.Writer, f *pullFamily, s *pullSeries, openMetrics bool) {
+	name := pullLabel(s.labels, "__name__")
+	if f.tp == "summary" && strings.HasSuffix(name, "_quantile") && pullLabel(s.labels, "quantile") != "" {
+		// types.Samples names quantiles <name>_quantile, the exposition format doesn't
+		name = f.name
+	}
+	bw.WriteString(name)
+
+	first := true
+	for _, label := range s.labels {
+		if strings.HasPrefix(label.Name, "__") {
+			continue
+		}
+		if first {
+			bw.WriteByte('{')
+			first = false
+		} else {
+			bw.WriteByte(',')
+		}
+		bw.WriteString(label.Name)
+		bw.WriteString(`="`)
+		bw.WriteString(escapePullLabelValue(label.Value))
+		bw.WriteByte('"')
+	}
+	if !first {
+		bw.WriteByte('}')
+	}
+
+	bw.WriteByte(' ')
+	bw.WriteString(formatPullValue(s.value))
+
+	if s.timestamp > 0 {
+		bw.WriteByte(' ')
+		if openMetrics {
+			// OpenMetrics timestamps are in seconds
+			bw.WriteString(strconv.FormatFloat(float64(s.timestamp)/1e3, 'f', -1, 64))
+		} else {
+			bw.WriteString(strconv.FormatInt(s.timestamp, 10))
+		}
+	}
+	bw.WriteByte('\n')
+}
+
+func formatPullValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var pullLabelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapePullLabelValue(s string) string {
+	return pullLabelValueReplacer.Replace(s)
+}
@@ -0,0 +1,98 @@
+package writer
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/types"
+)
+
+func TestWritePullMetrics(t *testing.T) {
+	*pullEnable = true
+	defer func() { *pullEnable = false }()
+
+	newTS := func(value float64, kvs ...string) prompbmarshal.TimeSeries {
+		var labels []prompbmarshal.Label
+		for i := 0; i < len(kvs); i += 2 {
+			labels = append(labels, prompbmarshal.Label{Name: kvs[i], Value: kvs[i+1]})
+		}
+		return prompbmarshal.TimeSeries{
+			Labels:  labels,
+			Samples: []prompbmarshal.Sample{{Value: value, Timestamp: 1500}},
+		}
+	}
+
+	getPullStore().add([]prompbmarshal.TimeSeries{
+		newTS(1, "__name__", "mysql_up", types.LabelPlugin, "mysql", types.LabelType, "gauge", "instance", "a"),
+		newTS(2, "instance", "a", "__name__", "mysql_up", types.LabelPlugin, "mysql", types.LabelType, "gauge"),
+		newTS(5, "__name__", "mysql_queries_total", types.LabelPlugin, "mysql", types.LabelType, "counter", "instance", `a"b`),
+		newTS(1, "__name__", "redis_up", types.LabelPlugin, "redis", "instance", "b"),
+	})
+
+	f := func(plugin, match string, openMetrics bool, want string) {
+		t.Helper()
+		var matches []string
+		if match != "" {
+			matches = append(matches, match)
+		}
+		ies, err := ParsePullMatches(matches)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var bb bytes.Buffer
+		if err := WritePullMetrics(&bb, plugin, ies, openMetrics); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if bb.String() != want {
+			t.Fatalf("unexpected output\ngot:\n%s\nwant:\n%s", bb.String(), want)
+		}
+	}
+
+	f("mysql", "", false, `# TYPE mysql_queries_total counter
+mysql_queries_total{instance="a\"b"} 5 1500
+# TYPE mysql_up gauge
+mysql_up{instance="a"} 2 1500
+`)
+	f("", `{instance="b"}`, true, `# TYPE redis_up unknown
+redis_up{instance="b"} 1 1.5
+# EOF
+`)
+
+	if _, err := ParsePullMatches([]string{"{"}); err == nil {
+		t.Fatalf("expecting error for invalid match[]")
+	}
+}
+
+func TestWriteTimeSeriesText(t *testing.T) {
+	tss := []prompbmarshal.TimeSeries{
+		{
+			Labels: []prompbmarshal.Label{
+				{Name: "__name__", Value: "mysql_up"},
+				{Name: types.LabelPlugin, Value: "mysql"},
+				{Name: types.LabelType, Value: "gauge"},
+			},
+			Samples: []prompbmarshal.Sample{{Value: 1, Timestamp: 1500}},
+		},
+		{
+			Labels: []prompbmarshal.Label{
+				{Name: "error", Value: ""},
+				{Name: "__name__", Value: "cprobe_error"},
+			},
+			Samples: []prompbmarshal.Sample{{Value: 0, Timestamp: 1500}},
+		},
+	}
+
+	var bb bytes.Buffer
+	if err := WriteTimeSeriesText(&bb, tss); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := `cprobe_error{error=""} 0
+# TYPE mysql_up gauge
+mysql_up 1
+`
+	if bb.String() != want {
+		t.Fatalf("unexpected output\ngot:\n%s\nwant:\n%s", bb.String(), want)
+	}
+}
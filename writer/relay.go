@@ -0,0 +1,165 @@
+package writer
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/cprobe/cprobe/lib/flagutil"
+	"github.com/cprobe/cprobe/lib/prompb"
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/types"
+	"github.com/golang/snappy"
+)
+
+var (
+	relayEnable         = flag.Bool("relay.enable", false, "Accept Prometheus remote write at /api/v1/write and Influx line protocol at /write and /api/v2/write, the received series are sent to the writers")
+	relayMaxRequestSize = flagutil.NewBytes("relay.maxRequestSize", 32*1024*1024, "The maximum size in bytes of a request body accepted by the relay endpoints")
+)
+
+// relay 接收到的数据分批交给 writer，避免一个很大的请求变成一个很大的 remote write 请求
+const relayBatchSize = 10000
+
+var (
+	relayRemoteWriteRows = metrics.NewCounter(`cprobe_relay_rows_received_total{type="remotewrite"}`)
+	relayInfluxRows      = metrics.NewCounter(`cprobe_relay_rows_received_total{type="influx"}`)
+)
+
+// RelayEnabled returns true if cprobe accepts pushed data
+func RelayEnabled() bool {
+	return *relayEnable
+}
+
+// RelayRemoteWrite reads a snappy compressed Prometheus remote write request from r and sends the series to the writers.
+// It returns the number of received series.
+func RelayRemoteWrite(r io.Reader) (int, error) {
+	compressed, err := readRelayBody(r)
+	if err != nil {
+		return 0, err
+	}
+
+	// snappy.Decode 按照 header 里声明的长度分配内存，很小的 body 就能声明好几个 G，先检查
+	n, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return 0, fmt.Errorf("cannot decompress snappy body: %w", err)
+	}
+	if int64(n) > relayMaxRequestSize.N {
+		return 0, fmt.Errorf("decompressed body size %d exceeds -relay.maxRequestSize=%d", n, relayMaxRequestSize.N)
+	}
+
+	bs, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return 0, fmt.Errorf("cannot decompress snappy body: %w", err)
+	}
+
+	var req prompb.WriteRequest
+	if err = req.Unmarshal(bs); err != nil {
+		return 0, fmt.Errorf("cannot unmarshal WriteRequest: %w", err)
+	}
+
+	tss := make([]prompbmarshal.TimeSeries, 0, len(req.Timeseries))
+	for i := range req.Timeseries {
+		ts := &req.Timeseries[i]
+		// labels point into bs, copy them
+		labels := make([]prompbmarshal.Label, 0, len(ts.Labels))
+		for _, label := range ts.Labels {
+			labels = append(labels, prompbmarshal.Label{Name: string(label.Name), Value: string(label.Value)})
+		}
+		samples := make([]prompbmarshal.Sample, 0, len(ts.Samples))
+		for _, sample := range ts.Samples {
+			samples = append(samples, prompbmarshal.Sample{Value: sample.Value, Timestamp: sample.Timestamp})
+		}
+		tss = append(tss, prompbmarshal.TimeSeries{Labels: labels, Samples: samples})
+	}
+
+	relayRemoteWriteRows.Add(len(tss))
+	relayTimeSeries(tss)
+
+	return len(tss), nil
+}
+
+// RelayInflux reads Influx line protocol from r and sends the series to the writers.
+// contentEncoding is the Content-Encoding of the request, precision is the `precision` query arg.
+// It returns the number of received series.
+func RelayInflux(r io.Reader, contentEncoding, precision string) (int, error) {
+	if contentEncoding == "gzip" {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return 0, fmt.Errorf("cannot read gzipped body: %w", err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	bs, err := readRelayBody(r)
+	if err != nil {
+		return 0, err
+	}
+
+	tss, err := parseInfluxLines(string(bs), precision, time.Now().UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+
+	relayInfluxRows.Add(len(tss))
+	relayTimeSeries(tss)
+
+	return len(tss), nil
+}
+
+func readRelayBody(r io.Reader) ([]byte, error) {
+	limit := relayMaxRequestSize.N
+	bs, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read request body: %w", err)
+	}
+	if int64(len(bs)) > limit {
+		return nil, fmt.Errorf("request body exceeds -relay.maxRequestSize=%d", limit)
+	}
+	return bs, nil
+}
+
+func relayTimeSeries(tss []prompbmarshal.TimeSeries) {
+	for start := 0; start < len(tss); start += relayBatchSize {
+		end := start + relayBatchSize
+		if end > len(tss) {
+			end = len(tss)
+		}
+		WriteTimeSeries(tss[start:end])
+	}
+}
+
+// parseInfluxLines converts line protocol to series named <measurement>_<field>, the same as the plugins do.
+// types.LabelMeasurement and types.LabelField are kept so the influx writer can rebuild the lines.
+// Lines without timestamp get nowMillis.
+func parseInfluxLines(s, precision string, nowMillis int64) ([]prompbmarshal.TimeSeries, error) {
+	lines, err := types.ParseInfluxLines(s, precision, nowMillis)
+	if err != nil {
+		return nil, err
+	}
+
+	var tss []prompbmarshal.TimeSeries
+	for _, line := range lines {
+		for _, field := range line.Fields {
+			labels := make([]prompbmarshal.Label, 0, len(line.Tags)+3)
+			labels = append(labels,
+				prompbmarshal.Label{Name: "__name__", Value: line.Measurement + "_" + field.Key},
+				prompbmarshal.Label{Name: types.LabelMeasurement, Value: line.Measurement},
+				prompbmarshal.Label{Name: types.LabelField, Value: field.Key},
+			)
+			for _, tag := range line.Tags {
+				labels = append(labels, prompbmarshal.Label{Name: tag.Key, Value: tag.Value})
+			}
+
+			tss = append(tss, prompbmarshal.TimeSeries{
+				Labels:  labels,
+				Samples: []prompbmarshal.Sample{{Value: field.Value, Timestamp: line.TimestampMs}},
+			})
+		}
+	}
+
+	return tss, nil
+}
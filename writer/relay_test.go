@@ -0,0 +1,71 @@
+package writer
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/types"
+)
+
+func TestParseInfluxLines(t *testing.T) {
+	body := `# comment
+cpu,host=a\ b,region=bj usage_idle=90.5,usage_user=3i,msg="a b,c=d" 1700000000000000000
+
+mem,host=a used_percent=12,ok=t
+`
+	tss, err := parseInfluxLines(body, "", 42)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	newTS := func(value float64, ts int64, kvs ...string) prompbmarshal.TimeSeries {
+		var labels []prompbmarshal.Label
+		for i := 0; i < len(kvs); i += 2 {
+			labels = append(labels, prompbmarshal.Label{Name: kvs[i], Value: kvs[i+1]})
+		}
+		return prompbmarshal.TimeSeries{
+			Labels:  labels,
+			Samples: []prompbmarshal.Sample{{Value: value, Timestamp: ts}},
+		}
+	}
+
+	want := []prompbmarshal.TimeSeries{
+		newTS(90.5, 1700000000000, "__name__", "cpu_usage_idle", types.LabelMeasurement, "cpu", types.LabelField, "usage_idle", "host", "a b", "region", "bj"),
+		newTS(3, 1700000000000, "__name__", "cpu_usage_user", types.LabelMeasurement, "cpu", types.LabelField, "usage_user", "host", "a b", "region", "bj"),
+		newTS(12, 42, "__name__", "mem_used_percent", types.LabelMeasurement, "mem", types.LabelField, "used_percent", "host", "a"),
+		newTS(1, 42, "__name__", "mem_ok", types.LabelMeasurement, "mem", types.LabelField, "ok", "host", "a"),
+	}
+	if !reflect.DeepEqual(tss, want) {
+		t.Fatalf("unexpected series\ngot:  %v\nwant: %v", tss, want)
+	}
+
+	for _, line := range []string{`cpu`, `cpu,host usage=1`, `cpu usage=abc`, `cpu usage=1 abc`} {
+		if _, err := parseInfluxLines(line, "s", 0); err == nil {
+			t.Fatalf("expecting error for %q", line)
+		}
+	}
+
+	if _, err := parseInfluxLines(`cpu usage=1 1`, "d", 0); err == nil {
+		t.Fatalf("expecting error for unsupported precision")
+	}
+}
+
+func TestRelayRemoteWriteDecodedLenLimit(t *testing.T) {
+	// a snappy header claiming 1GiB followed by nothing
+	var body []byte
+	for n := uint64(1 << 30); ; n >>= 7 {
+		if n < 0x80 {
+			body = append(body, byte(n))
+			break
+		}
+		body = append(body, byte(n)|0x80)
+	}
+
+	_, err := RelayRemoteWrite(bytes.NewReader(body))
+	if err == nil || !strings.Contains(err.Error(), "exceeds -relay.maxRequestSize") {
+		t.Fatalf("expecting the size limit error, got %v", err)
+	}
+}
@@ -0,0 +1,334 @@
+package writer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/cprobe/cprobe/lib/encoding/zstd"
+	"github.com/cprobe/cprobe/lib/logger"
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/types"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	RemoteWriteVersion1 = "1.0"
+	RemoteWriteVersion2 = "2.0"
+
+	remoteWriteContentTypeV2 = "application/x-protobuf;proto=io.prometheus.write.v2.Request"
+)
+
+// RemoteWriteConfig is the `remote_write` section of a writer with `type: remotewrite`.
+type RemoteWriteConfig struct {
+	// 1.0 or 2.0, the writer falls back to 1.0 if the receiver doesn't support 2.0
+	Version string `yaml:"version"`
+	// snappy or zstd, the writer falls back to snappy if the receiver doesn't support zstd
+	Compression string `yaml:"compression"`
+
+	// negotiation state of version 2.0, see rwState*
+	state atomic.Int32
+	// negotiation state of zstd, see zstdState*
+	zstdState atomic.Int32
+}
+
+const (
+	// 2.0 is configured, but no request has succeeded yet
+	rwStateUnknown int32 = iota
+	// the receiver accepted a 2.0 request
+	rwStateV2
+	// the receiver rejected a 2.0 request with 415, all the requests use 1.0 from now on
+	rwStateV1Fallback
+)
+
+const (
+	// zstd is configured, but no request has succeeded yet
+	zstdStateUnknown int32 = iota
+	// the receiver accepted a zstd request
+	zstdStateAccepted
+	// the receiver rejected a zstd request with 415 or 400, all the requests use snappy from now on.
+	// zstd isn't in the remote write spec, receivers may not know it
+	zstdStateFallback
+)
+
+func (rc *RemoteWriteConfig) parse() error {
+	switch rc.Version {
+	case "":
+		rc.Version = RemoteWriteVersion1
+	case RemoteWriteVersion1, RemoteWriteVersion2:
+	default:
+		return fmt.Errorf("unsupported remote_write version %q, must be 1.0 or 2.0", rc.Version)
+	}
+
+	switch rc.Compression {
+	case "":
+		rc.Compression = "snappy"
+	case "snappy", "zstd":
+	default:
+		return fmt.Errorf("unsupported remote_write compression %q, must be snappy or zstd", rc.Compression)
+	}
+
+	return nil
+}
+
+func (rc *RemoteWriteConfig) useV2() bool {
+	return rc != nil && rc.Version == RemoteWriteVersion2 && rc.state.Load() != rwStateV1Fallback
+}
+
+// compression returns the negotiated compression, which is also the Content-Encoding of the requests
+func (rc *RemoteWriteConfig) compression() string {
+	if rc != nil && rc.Compression == "zstd" && rc.zstdState.Load() != zstdStateFallback {
+		return "zstd"
+	}
+	return "snappy"
+}
+
+type fallbackKey struct{}
+
+// remoteWriteFallback is attached to a request until the receiver is known to accept its version and compression.
+// The uncompressed bodies are kept instead of the series, so the series can be released
+type remoteWriteFallback struct {
+	tenant string
+	// the uncompressed body of the request
+	raw []byte
+	v2  bool
+	// the uncompressed 1.0 body of a 2.0 request
+	rawV1 []byte
+	// the compression of the request
+	compression string
+}
+
+// writeRemoteWrite encodes tss, which may contain the meta labels, with the negotiated protocol version
+func (w *Writer) writeRemoteWrite(tss []prompbmarshal.TimeSeries, tenant string) {
+	rc := w.RemoteWrite
+	fb := &remoteWriteFallback{tenant: tenant}
+
+	if rc.useV2() {
+		fb.raw, fb.v2 = marshalRemoteWriteV2(tss), true
+		if rc.state.Load() == rwStateUnknown {
+			// keep a way back to 1.0 until the receiver is known to accept 2.0
+			rawV1, err := marshalRemoteWriteV1(tss)
+			if err != nil {
+				logger.Warnf("cannot create remote write 1.0 body: %s", err)
+			}
+			fb.rawV1 = rawV1
+		}
+	} else {
+		raw, err := marshalRemoteWriteV1(tss)
+		if err != nil {
+			logger.Warnf("cannot create http request: %s", err)
+			return
+		}
+		fb.raw = raw
+	}
+
+	httpReq, err := w.newRemoteWriteRequest(fb)
+	if err != nil {
+		logger.Warnf("cannot create http request: %s", err)
+		return
+	}
+	w.RequestQueue.PushFront(httpReq)
+}
+
+// newRemoteWriteRequest compresses fb.raw with the negotiated compression, fb is attached to the request
+// if the receiver may still reject the version or the compression
+func (w *Writer) newRemoteWriteRequest(fb *remoteWriteFallback) (*http.Request, error) {
+	rc := w.RemoteWrite
+	fb.compression = rc.compression()
+
+	var body []byte
+	if fb.compression == "zstd" {
+		body = zstd.CompressLevel(nil, fb.raw, 1)
+	} else {
+		body = snappy.Encode(nil, fb.raw)
+	}
+
+	req, err := w.NewRequest(body, fb.tenant)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Encoding", fb.compression)
+	if fb.v2 {
+		req.Header.Set("Content-Type", remoteWriteContentTypeV2)
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "2.0.0")
+	}
+
+	if fb.rawV1 != nil || (fb.compression == "zstd" && rc.zstdState.Load() == zstdStateUnknown) {
+		req = req.WithContext(context.WithValue(req.Context(), fallbackKey{}, fb))
+	}
+	return req, nil
+}
+
+// marshalRemoteWriteV1 returns the uncompressed WriteRequest of tss, the meta labels of tss are removed in place
+func marshalRemoteWriteV1(tss []prompbmarshal.TimeSeries) ([]byte, error) {
+	req := prompbmarshal.WriteRequest{
+		Timeseries: dropMetaLabels(tss),
+	}
+
+	bs, err := req.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal WriteRequest: %w", err)
+	}
+
+	return bs, nil
+}
+
+// onRemoteWriteResponse updates the negotiation state, it returns a request to resend if the receiver rejected
+// zstd or 2.0. zstd falls back to snappy first, so a 2.0 receiver without zstd keeps 2.0
+func (w *Writer) onRemoteWriteResponse(req *http.Request, statusCode int) *http.Request {
+	fb, ok := req.Context().Value(fallbackKey{}).(*remoteWriteFallback)
+	if !ok {
+		return nil
+	}
+
+	rc := w.RemoteWrite
+	if statusCode/100 == 2 {
+		if fb.v2 {
+			rc.state.CompareAndSwap(rwStateUnknown, rwStateV2)
+		}
+		if fb.compression == "zstd" {
+			rc.zstdState.CompareAndSwap(zstdStateUnknown, zstdStateAccepted)
+		}
+		return nil
+	}
+
+	switch {
+	case fb.compression == "zstd" && (statusCode == http.StatusUnsupportedMediaType || statusCode == http.StatusBadRequest) &&
+		rc.zstdState.Load() != zstdStateAccepted:
+		if rc.zstdState.CompareAndSwap(zstdStateUnknown, zstdStateFallback) {
+			logger.Warnf("%q doesn't support zstd, fall back to snappy", w.URL)
+		}
+	case fb.rawV1 != nil && statusCode == http.StatusUnsupportedMediaType:
+		if rc.state.CompareAndSwap(rwStateUnknown, rwStateV1Fallback) {
+			logger.Warnf("%q doesn't support remote write 2.0, fall back to 1.0", w.URL)
+		}
+		fb = &remoteWriteFallback{tenant: fb.tenant, raw: fb.rawV1}
+	default:
+		return nil
+	}
+
+	newReq, err := w.newRemoteWriteRequest(fb)
+	if err != nil {
+		logger.Warnf("cannot create remote write request: %s", err)
+		return nil
+	}
+	return newReq
+}
+
+// marshalRemoteWriteV2 encodes tss as io.prometheus.write.v2.Request. The metric type, help and unit from
+// types.LabelType, types.LabelHelp and types.LabelUnit go to the metadata, types.LabelCreated goes to
+// created_timestamp and the other meta labels are dropped.
+func marshalRemoteWriteV2(tss []prompbmarshal.TimeSeries) []byte {
+	// the first symbol must be an empty string
+	symbols := []string{""}
+	refs := map[string]uint32{"": 0}
+	ref := func(s string) uint32 {
+		if n, ok := refs[s]; ok {
+			return n
+		}
+		n := uint32(len(symbols))
+		symbols = append(symbols, s)
+		refs[s] = n
+		return n
+	}
+
+	var body []byte
+	for i := range tss {
+		ts := &tss[i]
+
+		var metricType uint64
+		var help, unit string
+		var created int64
+		labels := make([]prompbmarshal.Label, 0, len(ts.Labels))
+		for _, label := range ts.Labels {
+			switch label.Name {
+			case types.LabelType:
+				metricType = remoteWriteV2MetricType(label.Value)
+			case types.LabelHelp:
+				help = label.Value
+			case types.LabelUnit:
+				unit = label.Value
+			case types.LabelCreated:
+				created, _ = strconv.ParseInt(label.Value, 10, 64)
+			case types.LabelMeasurement, types.LabelField, types.LabelPlugin, types.LabelTenant:
+			default:
+				labels = append(labels, label)
+			}
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+		var tsb []byte
+
+		var refsb []byte
+		for _, label := range labels {
+			refsb = protowire.AppendVarint(refsb, uint64(ref(label.Name)))
+			refsb = protowire.AppendVarint(refsb, uint64(ref(label.Value)))
+		}
+		tsb = protowire.AppendTag(tsb, 1, protowire.BytesType)
+		tsb = protowire.AppendBytes(tsb, refsb)
+
+		for _, sample := range ts.Samples {
+			var sb []byte
+			sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+			sb = protowire.AppendFixed64(sb, math.Float64bits(sample.Value))
+			sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+			sb = protowire.AppendVarint(sb, uint64(sample.Timestamp))
+			tsb = protowire.AppendTag(tsb, 2, protowire.BytesType)
+			tsb = protowire.AppendBytes(tsb, sb)
+		}
+
+		var mb []byte
+		if metricType != 0 {
+			mb = protowire.AppendTag(mb, 1, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, metricType)
+		}
+		if help != "" {
+			mb = protowire.AppendTag(mb, 3, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, uint64(ref(help)))
+		}
+		if unit != "" {
+			mb = protowire.AppendTag(mb, 4, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, uint64(ref(unit)))
+		}
+		if len(mb) > 0 {
+			tsb = protowire.AppendTag(tsb, 5, protowire.BytesType)
+			tsb = protowire.AppendBytes(tsb, mb)
+		}
+
+		if created > 0 {
+			tsb = protowire.AppendTag(tsb, 6, protowire.VarintType)
+			tsb = protowire.AppendVarint(tsb, uint64(created))
+		}
+
+		body = protowire.AppendTag(body, 5, protowire.BytesType)
+		body = protowire.AppendBytes(body, tsb)
+	}
+
+	var b []byte
+	for _, s := range symbols {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendString(b, s)
+	}
+	return append(b, body...)
+}
+
+// remoteWriteV2MetricType returns io.prometheus.write.v2.Metadata.MetricType
+func remoteWriteV2MetricType(tp string) uint64 {
+	switch tp {
+	case "counter":
+		return 1
+	case "gauge":
+		return 2
+	case "histogram":
+		return 3
+	case "summary":
+		return 5
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,236 @@
+package writer
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/listx"
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/types"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestMarshalRemoteWriteV2(t *testing.T) {
+	tss := []prompbmarshal.TimeSeries{
+		{
+			Labels: []prompbmarshal.Label{
+				{Name: "__name__", Value: "up"},
+				{Name: types.LabelType, Value: "counter"},
+				{Name: types.LabelPlugin, Value: "mysql"},
+				{Name: types.LabelHelp, Value: "Whether the target is up."},
+				{Name: types.LabelUnit, Value: "seconds"},
+				{Name: types.LabelCreated, Value: "900"},
+				{Name: "instance", Value: "a"},
+			},
+			Samples: []prompbmarshal.Sample{{Value: 1.5, Timestamp: 1000}},
+		},
+	}
+
+	var symbols []string
+	var refs []uint64
+	var value float64
+	var timestamp, metricType, helpRef, unitRef, created uint64
+
+	b := marshalRemoteWriteV2(tss)
+	for len(b) > 0 {
+		num, _, n := protowire.ConsumeTag(b)
+		b = b[n:]
+		v, n := protowire.ConsumeBytes(b)
+		b = b[n:]
+		switch num {
+		case 4:
+			symbols = append(symbols, string(v))
+		case 5:
+			for len(v) > 0 {
+				num, typ, n := protowire.ConsumeTag(v)
+				v = v[n:]
+				if typ == protowire.VarintType {
+					x, n := protowire.ConsumeVarint(v)
+					v = v[n:]
+					if num == 6 {
+						created = x
+					}
+					continue
+				}
+				field, n := protowire.ConsumeBytes(v)
+				v = v[n:]
+				switch num {
+				case 1:
+					for len(field) > 0 {
+						ref, n := protowire.ConsumeVarint(field)
+						field = field[n:]
+						refs = append(refs, ref)
+					}
+				case 2:
+					_, _, n := protowire.ConsumeTag(field)
+					bits, m := protowire.ConsumeFixed64(field[n:])
+					value = math.Float64frombits(bits)
+					_, _, k := protowire.ConsumeTag(field[n+m:])
+					timestamp, _ = protowire.ConsumeVarint(field[n+m+k:])
+				case 5:
+					for len(field) > 0 {
+						num, _, n := protowire.ConsumeTag(field)
+						field = field[n:]
+						x, n := protowire.ConsumeVarint(field)
+						field = field[n:]
+						switch num {
+						case 1:
+							metricType = x
+						case 3:
+							helpRef = x
+						case 4:
+							unitRef = x
+						}
+					}
+				}
+			}
+		}
+	}
+
+	if !reflect.DeepEqual(symbols, []string{"", "__name__", "up", "instance", "a", "Whether the target is up.", "seconds"}) {
+		t.Fatalf("unexpected symbols: %q", symbols)
+	}
+	if !reflect.DeepEqual(refs, []uint64{1, 2, 3, 4}) {
+		t.Fatalf("unexpected labels_refs: %v", refs)
+	}
+	if value != 1.5 || timestamp != 1000 {
+		t.Fatalf("unexpected sample %v@%d", value, timestamp)
+	}
+	if metricType != 1 || helpRef != 5 || unitRef != 6 {
+		t.Fatalf("unexpected metadata: type %d, help_ref %d, unit_ref %d", metricType, helpRef, unitRef)
+	}
+	if created != 900 {
+		t.Fatalf("unexpected created_timestamp: %d", created)
+	}
+}
+
+func TestRemoteWriteFallback(t *testing.T) {
+	w := &Writer{URL: "http://127.0.0.1/api/v1/write", RemoteWrite: &RemoteWriteConfig{Version: RemoteWriteVersion2}}
+	if err := w.RemoteWrite.parse(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	w.RequestQueue = listx.NewSafeList[*http.Request]()
+
+	tss := []prompbmarshal.TimeSeries{{
+		Labels:  []prompbmarshal.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompbmarshal.Sample{{Value: 1, Timestamp: 1000}},
+	}}
+
+	w.writeRemoteWrite(tss, "")
+	req := w.RequestQueue.PopBackN(1)[0]
+	if req.Header.Get("X-Prometheus-Remote-Write-Version") != "2.0.0" {
+		t.Fatalf("expecting a 2.0 request, got headers %v", req.Header)
+	}
+
+	// the fallback keeps its own encoded body, not the series
+	tss[0].Labels[0].Value = "changed"
+
+	newReq := w.onRemoteWriteResponse(req, http.StatusUnsupportedMediaType)
+	if newReq == nil || newReq.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+		t.Fatalf("expecting a 1.0 request to resend")
+	}
+	compressed, err := io.ReadAll(newReq.Body)
+	if err != nil {
+		t.Fatalf("cannot read body: %s", err)
+	}
+	bs, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		t.Fatalf("cannot decode body: %s", err)
+	}
+	if series := decodeRemoteWrite(t, bs); len(series) != 1 || series[0] != "__name__=up 1" {
+		t.Fatalf("unexpected series in the 1.0 request: %v", series)
+	}
+	if w.RemoteWrite.useV2() {
+		t.Fatalf("expecting the writer to fall back to 1.0")
+	}
+
+	w.writeRemoteWrite(tss, "")
+	req = w.RequestQueue.PopBackN(1)[0]
+	if req.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+		t.Fatalf("expecting a 1.0 request after fallback")
+	}
+}
+
+func TestRemoteWriteZstdFallback(t *testing.T) {
+	newWriter := func(version string) *Writer {
+		w := &Writer{URL: "http://127.0.0.1/api/v1/write", RemoteWrite: &RemoteWriteConfig{Version: version, Compression: "zstd"}}
+		if err := w.RemoteWrite.parse(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		w.RequestQueue = listx.NewSafeList[*http.Request]()
+		return w
+	}
+	tss := func() []prompbmarshal.TimeSeries {
+		return []prompbmarshal.TimeSeries{{
+			Labels:  []prompbmarshal.Label{{Name: "__name__", Value: "up"}},
+			Samples: []prompbmarshal.Sample{{Value: 1, Timestamp: 1000}},
+		}}
+	}
+	check := func(req *http.Request, version, encoding string) {
+		t.Helper()
+		if req == nil {
+			t.Fatalf("expecting a %s %s request to resend", version, encoding)
+		}
+		if v := req.Header.Get("X-Prometheus-Remote-Write-Version"); v != version {
+			t.Fatalf("unexpected version %q, want %q", v, version)
+		}
+		if e := req.Header.Get("Content-Encoding"); e != encoding {
+			t.Fatalf("unexpected encoding %q, want %q", e, encoding)
+		}
+	}
+
+	// 2.0 falls back to snappy first, and then to 1.0
+	w := newWriter(RemoteWriteVersion2)
+	w.writeRemoteWrite(tss(), "")
+	req := w.RequestQueue.PopBackN(1)[0]
+	check(req, "2.0.0", "zstd")
+	req = w.onRemoteWriteResponse(req, http.StatusUnsupportedMediaType)
+	check(req, "2.0.0", "snappy")
+	req = w.onRemoteWriteResponse(req, http.StatusUnsupportedMediaType)
+	check(req, "0.1.0", "snappy")
+	compressed, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("cannot read body: %s", err)
+	}
+	bs, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		t.Fatalf("cannot decode body: %s", err)
+	}
+	if series := decodeRemoteWrite(t, bs); len(series) != 1 || series[0] != "__name__=up 1" {
+		t.Fatalf("unexpected series in the 1.0 request: %v", series)
+	}
+	if w.onRemoteWriteResponse(req, http.StatusNoContent) != nil {
+		t.Fatalf("unexpected request to resend")
+	}
+	w.writeRemoteWrite(tss(), "")
+	check(w.RequestQueue.PopBackN(1)[0], "0.1.0", "snappy")
+
+	// 1.0 with 400
+	w = newWriter(RemoteWriteVersion1)
+	w.writeRemoteWrite(tss(), "")
+	req = w.RequestQueue.PopBackN(1)[0]
+	check(req, "0.1.0", "zstd")
+	req = w.onRemoteWriteResponse(req, http.StatusBadRequest)
+	check(req, "0.1.0", "snappy")
+	if w.onRemoteWriteResponse(req, http.StatusBadRequest) != nil {
+		t.Fatalf("unexpected request to resend a snappy 1.0 request")
+	}
+
+	// a 400 after zstd is accepted is a bad request, not a fallback
+	w = newWriter(RemoteWriteVersion1)
+	w.writeRemoteWrite(tss(), "")
+	req = w.RequestQueue.PopBackN(1)[0]
+	if w.onRemoteWriteResponse(req, http.StatusNoContent) != nil {
+		t.Fatalf("unexpected request to resend")
+	}
+	w.writeRemoteWrite(tss(), "")
+	req = w.RequestQueue.PopBackN(1)[0]
+	check(req, "0.1.0", "zstd")
+	if w.onRemoteWriteResponse(req, http.StatusBadRequest) != nil {
+		t.Fatalf("unexpected fallback after zstd is accepted")
+	}
+}
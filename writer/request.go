@@ -3,24 +3,41 @@ package writer
 import (
 	"bytes"
 	"net/http"
+	"net/url"
 	"strings"
 
+	"github.com/cprobe/cprobe/lib/awsapi"
 	"github.com/cprobe/cprobe/lib/logger"
 )
 
-func (w *Writer) NewRequest(body []byte) (*http.Request, error) {
+const tenantPlaceholder = "{{tenant}}"
+
+// NewRequest creates a request with body for tenant, tenant may be empty
+func (w *Writer) NewRequest(body []byte, tenant string) (*http.Request, error) {
+	if tenant == "" {
+		tenant = w.DefaultTenant
+	}
+
+	u := w.URL.Value()
+	tenantInURL := strings.Contains(u, tenantPlaceholder) || strings.Contains(u, url.PathEscape(tenantPlaceholder))
+	if tenantInURL {
+		u = strings.ReplaceAll(u, tenantPlaceholder, url.PathEscape(tenant))
+		// the influx writer re-encodes the url, the placeholder may be escaped
+		u = strings.ReplaceAll(u, url.PathEscape(tenantPlaceholder), url.PathEscape(tenant))
+	}
+
 	reqBody := bytes.NewBuffer(body)
-	req, err := http.NewRequest(http.MethodPost, w.URL, reqBody)
+	req, err := http.NewRequest(http.MethodPost, u, reqBody)
 	if err != nil {
-		logger.Panicf("BUG: unexpected error from http.NewRequest(%q): %s", w.URL, err)
+		logger.Panicf("BUG: unexpected error from http.NewRequest(%q): %s", u, err)
 	}
 
 	if w.BasicAuthUser != "" && w.BasicAuthPass != "" {
-		req.SetBasicAuth(w.BasicAuthUser, w.BasicAuthPass)
+		req.SetBasicAuth(w.BasicAuthUser, w.BasicAuthPass.Value())
 	}
 
 	for _, header := range w.Headers {
-		parts := strings.SplitN(header, ":", 2)
+		parts := strings.SplitN(header.Value(), ":", 2)
 		if len(parts) != 2 {
 			logger.Panicf("BUG: invalid header %q", header)
 		}
@@ -35,9 +52,39 @@ func (w *Writer) NewRequest(body []byte) (*http.Request, error) {
 	}
 
 	req.Header.Set("User-Agent", "cprobe")
-	req.Header.Set("Content-Type", "application/x-protobuf")
-	req.Header.Set("Content-Encoding", "snappy")
-	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	if w.awsConfig != nil {
+		// the request is signed by authorize right before sending, the signature needs the hash of the body
+		req.Header.Set(amzContentSha256Header, awsapi.HashHex(body))
+	}
+
+	if !tenantInURL && tenant != "" {
+		req.Header.Set(w.TenantHeader, tenant)
+	}
+
+	switch w.Type {
+	case WriterTypeInflux:
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		if w.Influx.ContentEncoding == "gzip" {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		if w.Influx.Token != "" {
+			req.Header.Set("Authorization", "Token "+w.Influx.Token.Value())
+		}
+	case WriterTypeOTLP:
+		if w.OTLP.Encoding == OTLPEncodingJSON {
+			req.Header.Set("Content-Type", "application/json")
+		} else {
+			req.Header.Set("Content-Type", "application/x-protobuf")
+		}
+		if w.OTLP.Compression == "gzip" {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+	default:
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("Content-Encoding", w.RemoteWrite.compression())
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	}
 
 	return req, nil
 }
@@ -0,0 +1,52 @@
+package writer
+
+import (
+	"testing"
+
+	"github.com/cprobe/cprobe/lib/prompbmarshal"
+	"github.com/cprobe/cprobe/types"
+)
+
+func TestNewRequestTenant(t *testing.T) {
+	f := func(w *Writer, tenant, wantURL, wantHeader string) {
+		t.Helper()
+		req, err := w.NewRequest(nil, tenant)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if req.URL.String() != wantURL {
+			t.Fatalf("unexpected url: %s, want: %s", req.URL, wantURL)
+		}
+		if got := req.Header.Get("X-Scope-OrgID"); got != wantHeader {
+			t.Fatalf("unexpected X-Scope-OrgID: %q, want: %q", got, wantHeader)
+		}
+	}
+
+	vm := &Writer{URL: "http://vminsert:8480/insert/{{tenant}}/prometheus/api/v1/write", DefaultTenant: "0", TenantHeader: "X-Scope-OrgID"}
+	f(vm, "12:3", "http://vminsert:8480/insert/12:3/prometheus/api/v1/write", "")
+	f(vm, "", "http://vminsert:8480/insert/0/prometheus/api/v1/write", "")
+
+	mimir := &Writer{URL: "http://mimir/api/v1/push", TenantHeader: "X-Scope-OrgID"}
+	f(mimir, "team-a", "http://mimir/api/v1/push", "team-a")
+	f(mimir, "", "http://mimir/api/v1/push", "")
+}
+
+func TestSplitByTenant(t *testing.T) {
+	tss := []prompbmarshal.TimeSeries{
+		{Labels: []prompbmarshal.Label{{Name: "__name__", Value: "a"}, {Name: types.LabelTenant, Value: "t1"}}},
+		{Labels: []prompbmarshal.Label{{Name: "__name__", Value: "b"}}},
+		{Labels: []prompbmarshal.Label{{Name: types.LabelTenant, Value: "t1"}, {Name: "__name__", Value: "c"}}},
+	}
+
+	batches := splitByTenant(tss)
+	if len(batches) != 2 || batches[0].tenant != "t1" || len(batches[0].tss) != 2 || batches[1].tenant != "" || len(batches[1].tss) != 1 {
+		t.Fatalf("unexpected batches: %v", batches)
+	}
+	for _, batch := range batches {
+		for _, ts := range batch.tss {
+			if len(ts.Labels) != 1 || ts.Labels[0].Name != "__name__" {
+				t.Fatalf("unexpected labels: %v", ts.Labels)
+			}
+		}
+	}
+}
@@ -31,21 +31,43 @@ func (w *Writer) StartSender() {
 
 func (w *Writer) send(req *http.Request) {
 	for i := 0; i < w.RetryTimes; i++ {
+		if i > 0 && req.GetBody != nil {
+			// the body is consumed by the previous attempt
+			body, err := req.GetBody()
+			if err != nil {
+				logger.Errorf("cannot rewind request body for %q: %s", req.URL.Redacted(), err)
+				return
+			}
+			req.Body = body
+		}
+
+		if err := w.authorize(req); err != nil {
+			logger.Errorf("cannot authorize request to %q: %s, retry #%d", req.URL.Redacted(), err, i+1)
+			time.Sleep(time.Duration(w.RetryIntervalMillis) * time.Millisecond)
+			continue
+		}
+
 		res, err := w.Client.Do(req)
 		if err == nil {
+			res.Body.Close()
+			if newReq := w.onRemoteWriteResponse(req, res.StatusCode); newReq != nil {
+				// the receiver doesn't support zstd or remote write 2.0, resend the data with snappy or 1.0
+				w.send(newReq)
+				return
+			}
 			if res.StatusCode/100 != 2 {
-				logger.Errorf("unexpected status code %d from %q", res.StatusCode, req.URL)
+				logger.Errorf("unexpected status code %d from %q", res.StatusCode, req.URL.Redacted())
 				return
 			}
 			return
 		}
 
 		if strings.Contains(err.Error(), "onnection") {
-			logger.Errorf("error sending request to %q: %s, retry #%d", req.URL, err, i+1)
+			logger.Errorf("error sending request to %q: %s, retry #%d", req.URL.Redacted(), err, i+1)
 			time.Sleep(time.Duration(w.RequestTimeoutMillis) * time.Millisecond)
 			continue
 		}
 
-		logger.Errorf("error sending request to %q: %s", req.URL, err)
+		logger.Errorf("error sending request to %q: %s", req.URL.Redacted(), err)
 	}
 }
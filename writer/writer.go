@@ -9,14 +9,17 @@ import (
 	"strings"
 	"time"
 
+	"github.com/cprobe/cprobe/lib/awsapi"
 	"github.com/cprobe/cprobe/lib/cgroup"
 	"github.com/cprobe/cprobe/lib/clienttls"
 	"github.com/cprobe/cprobe/lib/fileutil"
 	"github.com/cprobe/cprobe/lib/httpproxy"
 	"github.com/cprobe/cprobe/lib/listx"
 	"github.com/cprobe/cprobe/lib/netutil"
+	"github.com/cprobe/cprobe/lib/promauth"
 	"github.com/cprobe/cprobe/lib/promrelabel"
 	"github.com/cprobe/cprobe/lib/promutils"
+	"github.com/cprobe/cprobe/lib/secret"
 	"github.com/pkg/errors"
 )
 
@@ -26,30 +29,142 @@ var (
 	WriterConfig = &WriterYaml{}
 )
 
+const (
+	WriterTypeRemoteWrite = "remotewrite"
+	WriterTypeInflux      = "influx"
+	WriterTypeKafka       = "kafka"
+	WriterTypeOTLP        = "otlp"
+)
+
 type Writer struct {
-	URL                  string                      `yaml:"url"`
+	Type                 string                      `yaml:"type"`
+	URL                  secret.URL                  `yaml:"url"`
 	RetryTimes           int                         `yaml:"retry_times"`
 	RetryIntervalMillis  int64                       `yaml:"retry_interval_millis"`
 	BasicAuthUser        string                      `yaml:"basic_auth_user"`
-	BasicAuthPass        string                      `yaml:"basic_auth_pass"`
-	Headers              []string                    `yaml:"headers"`
+	BasicAuthPass        secret.Secret               `yaml:"basic_auth_pass"`
+	Headers              []secret.Header             `yaml:"headers"`
 	ConnectTimeoutMillis int64                       `yaml:"connect_timeout_millis"`
 	RequestTimeoutMillis int64                       `yaml:"request_timeout_millis"`
 	MaxIdleConnsPerHost  int                         `yaml:"max_idle_conns_per_host"`
 	Concurrency          int                         `yaml:"concurrency"`
-	ProxyURL             string                      `yaml:"proxy_url"`
+	ProxyURL             secret.URL                  `yaml:"proxy_url"`
 	Interface            string                      `yaml:"interface"`
 	FollowRedirects      bool                        `yaml:"follow_redirects"`
 	ExtraLabels          *promutils.Labels           `yaml:"extra_labels"`
 	RelabelConfigs       []promrelabel.RelabelConfig `yaml:"metric_relabel_configs"`
 	ParsedRelabelConfigs *promrelabel.ParsedConfigs  `yaml:"-"`
 
+	// tokens from bearer_token_file, authorization.credentials_file and oauth2 are refreshed without restart
+	Authorization   *promauth.Authorization `yaml:"authorization,omitempty"`
+	BearerTokenFile string                  `yaml:"bearer_token_file,omitempty"`
+	OAuth2          *promauth.OAuth2Config  `yaml:"oauth2,omitempty"`
+	AWSSigV4        *AWSSigV4Config         `yaml:"aws_sigv4,omitempty"`
+
+	// the tenant comes from the __tenant__ label, it is rendered into {{tenant}} of the url,
+	// or sent in tenant_header (X-Scope-OrgID by default) if the url doesn't have {{tenant}}
+	TenantHeader  string `yaml:"tenant_header"`
+	DefaultTenant string `yaml:"default_tenant"`
+
+	// series are accumulated and sent when one of the limits is reached, or every flush_interval_millis
+	MaxSamplesPerRequest int   `yaml:"max_samples_per_request"`
+	MaxBytes             int   `yaml:"max_bytes"`
+	FlushIntervalMillis  int64 `yaml:"flush_interval_millis"`
+
+	// only the series matching this selector are sent to the writer, e.g. '{__plugin__="mysql"}'
+	// it sees the labels before extra_labels of the writer and before relabeling
+	Match *promrelabel.IfExpression `yaml:"match,omitempty"`
+
+	RemoteWrite *RemoteWriteConfig `yaml:"remote_write,omitempty"`
+	Influx      *InfluxConfig      `yaml:"influx,omitempty"`
+	Kafka       *KafkaConfig       `yaml:"kafka,omitempty"`
+	OTLP        *OTLPConfig        `yaml:"otlp,omitempty"`
+
 	clienttls.ClientConfig `yaml:",inline"`
 	Client                 *http.Client                   `yaml:"-"`
 	RequestQueue           *listx.SafeList[*http.Request] `yaml:"-"`
+
+	acc        *accumulator
+	baseDir    string
+	authConfig *promauth.Config
+	awsConfig  *awsapi.Config
 }
 
 func (w *Writer) Parse() error {
+	switch w.Type {
+	case "":
+		w.Type = WriterTypeRemoteWrite
+		fallthrough
+	case WriterTypeRemoteWrite:
+		if w.RemoteWrite == nil {
+			w.RemoteWrite = &RemoteWriteConfig{}
+		}
+		if err := w.RemoteWrite.parse(); err != nil {
+			return err
+		}
+	case WriterTypeInflux:
+		if w.Influx == nil {
+			w.Influx = &InfluxConfig{}
+		}
+		if err := w.Influx.parse(w); err != nil {
+			return err
+		}
+	case WriterTypeOTLP:
+		if w.OTLP == nil {
+			w.OTLP = &OTLPConfig{}
+		}
+		if err := w.OTLP.parse(); err != nil {
+			return err
+		}
+	case WriterTypeKafka:
+		if w.Kafka == nil {
+			return fmt.Errorf("kafka section is required for writer type kafka")
+		}
+	default:
+		return fmt.Errorf("unsupported writer type %q", w.Type)
+	}
+
+	if strings.Contains(w.URL.Value(), tenantPlaceholder) && w.DefaultTenant == "" {
+		// the default tenant of VictoriaMetrics cluster
+		w.DefaultTenant = "0"
+	}
+
+	if w.TenantHeader == "" {
+		w.TenantHeader = "X-Scope-OrgID"
+	}
+
+	// relabel configs
+	var err error
+	w.ParsedRelabelConfigs, err = promrelabel.ParseRelabelConfigs(w.RelabelConfigs)
+	if err != nil {
+		return err
+	}
+
+	if w.MaxSamplesPerRequest <= 0 {
+		w.MaxSamplesPerRequest = 10000
+	}
+
+	if w.MaxBytes <= 0 {
+		w.MaxBytes = 8 * 1024 * 1024
+	}
+
+	if w.FlushIntervalMillis <= 0 {
+		w.FlushIntervalMillis = 1000
+	}
+
+	// kafka writer doesn't need the http client and the sender
+	if w.Type == WriterTypeKafka {
+		if err := w.Kafka.parse(w); err != nil {
+			return err
+		}
+		w.startAccumulator()
+		return nil
+	}
+
+	if err = w.parseAuth(); err != nil {
+		return err
+	}
+
 	if w.Concurrency <= 0 {
 		w.Concurrency = cgroup.AvailableCPUs() * 2
 	}
@@ -71,7 +186,6 @@ func (w *Writer) Parse() error {
 		Timeout: time.Duration(w.ConnectTimeoutMillis) * time.Millisecond,
 	}
 
-	var err error
 	if w.Interface != "" {
 		dialer.LocalAddr, err = netutil.LocalAddressByInterfaceName(w.Interface)
 		if err != nil {
@@ -79,7 +193,7 @@ func (w *Writer) Parse() error {
 		}
 	}
 
-	proxy, err := httpproxy.GetProxyFunc(w.ProxyURL)
+	proxy, err := httpproxy.GetProxyFunc(w.ProxyURL.Value())
 	if err != nil {
 		return err
 	}
@@ -90,7 +204,7 @@ func (w *Writer) Parse() error {
 		MaxIdleConnsPerHost: w.MaxIdleConnsPerHost,
 	}
 
-	if strings.HasPrefix(w.URL, "https") {
+	if strings.HasPrefix(w.URL.Value(), "https") {
 		tlsConfig, err := w.ClientConfig.TLSConfig()
 		if err != nil {
 			return err
@@ -110,12 +224,6 @@ func (w *Writer) Parse() error {
 		}
 	}
 
-	// relabel configs
-	w.ParsedRelabelConfigs, err = promrelabel.ParseRelabelConfigs(w.RelabelConfigs)
-	if err != nil {
-		return err
-	}
-
 	// request queue
 	w.RequestQueue = listx.NewSafeList[*http.Request]()
 
@@ -129,9 +237,16 @@ func (w *Writer) Parse() error {
 
 	go w.StartSender()
 
+	w.startAccumulator()
+
 	return nil
 }
 
+func (w *Writer) startAccumulator() {
+	w.acc = newAccumulator()
+	go w.startFlusher()
+}
+
 type Global struct {
 	ExtraLabels          *promutils.Labels           `yaml:"extra_labels"`
 	RelabelConfigs       []promrelabel.RelabelConfig `yaml:"metric_relabel_configs"`
@@ -141,10 +256,18 @@ type Global struct {
 type WriterYaml struct {
 	Global  *Global   `yaml:"global"`
 	Writers []*Writer `yaml:"writers"`
+
+	// relative file paths in writer.yaml are resolved against it
+	baseDir string
 }
 
 func (wy *WriterYaml) Parse() (err error) {
+	if wy.Global == nil {
+		wy.Global = &Global{}
+	}
+
 	for i := range wy.Writers {
+		wy.Writers[i].baseDir = wy.baseDir
 		if err = wy.Writers[i].Parse(); err != nil {
 			return err
 		}
@@ -178,6 +301,7 @@ func Init(configDirectory string) error {
 		return errors.Wrap(err, "cannot read writer config")
 	}
 
+	WriterConfig.baseDir = configDirectory
 	if err = WriterConfig.Parse(); err != nil {
 		return errors.Wrap(err, "cannot set writer fields")
 	}